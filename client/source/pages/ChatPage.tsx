@@ -14,8 +14,8 @@ import {
 	generateECDHKeyPair,
 	importPemToECDHKey,
 	importPemToECDSAKey,
-	signMessageWithSha256,
-	verifyMessageWithSha256,
+	signEnvelope,
+	verifyEnvelope,
 } from "../utils/crypto";
 import { showConfirmCard, showNoticeCard } from "../utils/toaster";
 import {
@@ -45,6 +45,8 @@ export default function ChatPage() {
 	const socketRef = useRef<WebSocket | null>(null);
 	const textareaRef = useRef<HTMLTextAreaElement | null>(null);
 	const ratchetChainRef = useRef<Record<string, InterfaceUserKeyChain>>({});
+	// NOTE: 服务器保存的棘轮状态版本号，写入时携带以避免多个标签页互相覆盖
+	const chainVersionRef = useRef<Record<string, number>>({});
 
 	const filteredUserList =
 		searchName.trim() === ""
@@ -161,6 +163,9 @@ export default function ChatPage() {
 					case "update_friendlist":
 						await handleUpdateFriendList(frame.data);
 						break;
+					case "keychain_conflict":
+						await handleKeychainConflict(frame.data);
+						break;
 					default:
 						console.log("📃WebSocket: unknown frame type: ", frame.type);
 				}
@@ -243,9 +248,12 @@ export default function ChatPage() {
 			salt_private_key: arrayBufferToBase64(saltPrivatePemCipher),
 		} as InterfaceWSExchangeKeyDate);
 
-		const signature = await signMessageWithSha256(
+		const envelope = await signEnvelope(
 			userInfor.private_key,
-			stringToArrayBuffer(addFriendContent)
+			"event_addfriend",
+			userInfor.uuid,
+			uuid,
+			addFriendContent
 		);
 
 		setSearchName("");
@@ -255,10 +263,7 @@ export default function ChatPage() {
 				type: "event_addfriend",
 				sender: userInfor.uuid,
 				receiver: uuid,
-				data: JSON.stringify({
-					signature: arrayBufferToHexString(signature),
-					data: addFriendContent,
-				} as InterfaceWSSignatureData),
+				data: JSON.stringify(envelope),
 			} as InterfaceWSFrame)
 		);
 		showNoticeCard(
@@ -295,10 +300,12 @@ export default function ChatPage() {
 		}
 		const signatureData = JSON.parse(data) as InterfaceWSSignatureData;
 
-		const isVerified = await verifyMessageWithSha256(
+		const isVerified = await verifyEnvelope(
 			await importPemToECDSAKey(atob(senderUser.public_key)),
-			hexStringToArrayBuffer(signatureData.signature),
-			stringToArrayBuffer(signatureData.data)
+			"event_addfriend",
+			senderUUID,
+			userInfor.uuid,
+			signatureData
 		);
 
 		if (!isVerified) {
@@ -352,9 +359,12 @@ export default function ChatPage() {
 		};
 
 		const addFriendContent = JSON.stringify(content);
-		const signature = await signMessageWithSha256(
+		const envelope = await signEnvelope(
 			userInfor.private_key,
-			stringToArrayBuffer(addFriendContent)
+			"event_allowfriend",
+			userInfor.uuid,
+			senderUUID,
+			addFriendContent
 		);
 
 		socketRef.current.send(
@@ -363,10 +373,7 @@ export default function ChatPage() {
 				type: "event_allowfriend",
 				sender: userInfor.uuid,
 				receiver: senderUUID,
-				data: JSON.stringify({
-					signature: arrayBufferToHexString(signature),
-					data: addFriendContent,
-				} as InterfaceWSSignatureData),
+				data: JSON.stringify(envelope),
 			} as InterfaceWSFrame)
 		);
 
@@ -446,10 +453,12 @@ export default function ChatPage() {
 		}
 		const signatureData = JSON.parse(data) as InterfaceWSSignatureData;
 
-		const isVerified = await verifyMessageWithSha256(
+		const isVerified = await verifyEnvelope(
 			await importPemToECDSAKey(atob(senderUser.public_key)),
-			hexStringToArrayBuffer(signatureData.signature),
-			stringToArrayBuffer(signatureData.data)
+			"event_allowfriend",
+			senderUUID,
+			userInfor.uuid,
+			signatureData
 		);
 
 		if (!isVerified) {
@@ -537,6 +546,8 @@ export default function ChatPage() {
 	const handleChangeKeyChain = async (senderUUID: string) => {
 		if (!socketRef.current || !isLoaded || !userInfor) return;
 
+		const version = chainVersionRef.current[senderUUID] ?? 0;
+
 		const { iv: chainIV, ciphertext: chainKey } = await encryptWithAESGCM(
 			userInfor.secret_key,
 			stringToArrayBuffer(
@@ -566,9 +577,46 @@ export default function ChatPage() {
 				data: JSON.stringify({
 					chain_iv: arrayBufferToBase64(chainIV),
 					chain_key: arrayBufferToBase64(chainKey),
+					version: version,
 				} as InterfaceWSChainKeyData),
 			} as InterfaceWSFrame)
 		);
+		// 写入成功后服务器的版本号加一，失败时会收到 keychain_conflict
+		chainVersionRef.current[senderUUID] = version + 1;
+	};
+
+	const decryptKeyChain = async (chainIV: string, chainKey: string) => {
+		const keyChainBuffer = await decryptWithAESGCM(
+			userInfor!.secret_key,
+			base64ToArrayBuffer(chainIV),
+			base64ToArrayBuffer(chainKey)
+		);
+		const keyChain = JSON.parse(
+			arrayBufferToString(keyChainBuffer)
+		) as InterfaceUserKeyChain & { public_key: string; private_key: string };
+
+		return {
+			...keyChain,
+			public_key: await importPemToECDHKey(atob(keyChain.public_key)),
+			private_key: await importPemToECDHKey(atob(keyChain.private_key), true),
+		} as InterfaceUserKeyChain;
+	};
+
+	const handleKeychainConflict = async (data: string) => {
+		if (!isLoaded || !userInfor) return;
+		const conflict = JSON.parse(data) as InterfaceWSKeychainConflictData;
+
+		// 其他标签页已经写入了更新的状态，以服务器保存的为准
+		chainVersionRef.current[conflict.friend_uuid] = conflict.version;
+		if (conflict.chain_iv && conflict.chain_key) {
+			ratchetChainRef.current[conflict.friend_uuid] = await decryptKeyChain(
+				conflict.chain_iv,
+				conflict.chain_key
+			);
+		}
+		console.log(
+			`📃KeyChain: version ${conflict.rejected} is stale, reloaded version ${conflict.version}`
+		);
 	};
 
 	const handleChangePublickey = async (data: string, senderUUID: string) => {
@@ -589,10 +637,12 @@ export default function ChatPage() {
 		}
 		const signatureData = JSON.parse(data) as InterfaceWSSignatureData;
 
-		const isVerified = await verifyMessageWithSha256(
+		const isVerified = await verifyEnvelope(
 			await importPemToECDSAKey(atob(senderUser.public_key)),
-			hexStringToArrayBuffer(signatureData.signature),
-			stringToArrayBuffer(signatureData.data)
+			"change_publickey",
+			senderUUID,
+			userInfor.uuid,
+			signatureData
 		);
 
 		if (!isVerified) {
@@ -622,6 +672,7 @@ export default function ChatPage() {
 
 		const parsedFriends: Array<InterfaceFriendInfor> = [];
 		const ratchetChains: Record<string, InterfaceUserKeyChain> = {};
+		const chainVersions: Record<string, number> = {};
 
 		for (const friend of friendListArray) {
 			if (!friend.chain_iv || !friend.chain_key) {
@@ -638,20 +689,7 @@ export default function ChatPage() {
 			const oldFriend = friendListRef.current.find(f => f.uuid === friend.uuid);
 			const oldMessages = oldFriend?.messages ?? [];
 
-			const keyChainBuffer = await decryptWithAESGCM(
-				userInfor.secret_key,
-				base64ToArrayBuffer(friend.chain_iv),
-				base64ToArrayBuffer(friend.chain_key)
-			);
-			const keyChain = JSON.parse(
-				arrayBufferToString(keyChainBuffer)
-			) as InterfaceUserKeyChain & { public_key: string; private_key: string };
-
-			const friendKeyChain = {
-				...keyChain,
-				public_key: await importPemToECDHKey(atob(keyChain.public_key)),
-				private_key: await importPemToECDHKey(atob(keyChain.private_key), true),
-			};
+			const friendKeyChain = await decryptKeyChain(friend.chain_iv, friend.chain_key);
 
 			const friendMessages: InterfaceMessage[] = [];
 
@@ -725,9 +763,11 @@ export default function ChatPage() {
 			});
 
 			ratchetChains[friend.uuid] = friendKeyChain;
+			chainVersions[friend.uuid] = friend.chain_version;
 		}
 
 		ratchetChainRef.current = ratchetChains;
+		chainVersionRef.current = chainVersions;
 
 		setFriendList(parsedFriends);
 		console.log("😉Update: fetch friendlist success");
@@ -821,9 +861,12 @@ export default function ChatPage() {
 				ratchetState.private_key = ecdhKeyPair.privateKey;
 
 				const pubPemBase64 = btoa(await exportECKeyToPem(ecdhKeyPair.publicKey));
-				const signature = await signMessageWithSha256(
+				const envelope = await signEnvelope(
 					userInfor.private_key,
-					stringToArrayBuffer(pubPemBase64)
+					"change_publickey",
+					userInfor.uuid,
+					currentFriendUUID,
+					pubPemBase64
 				);
 
 				socketRef.current.send(
@@ -832,10 +875,7 @@ export default function ChatPage() {
 						type: "change_publickey",
 						sender: userInfor.uuid,
 						receiver: currentFriendUUID,
-						data: JSON.stringify({
-							signature: arrayBufferToHexString(signature),
-							data: pubPemBase64,
-						} as InterfaceWSSignatureData),
+						data: JSON.stringify(envelope),
 					} as InterfaceWSFrame)
 				);
 
@@ -1042,9 +1082,12 @@ export default function ChatPage() {
 				ratchetState.private_key = ecdhKeyPair.privateKey;
 
 				const pubPemBase64 = btoa(await exportECKeyToPem(ecdhKeyPair.publicKey));
-				const signature = await signMessageWithSha256(
+				const envelope = await signEnvelope(
 					userInfor.private_key,
-					stringToArrayBuffer(pubPemBase64)
+					"change_publickey",
+					userInfor.uuid,
+					senderUUID,
+					pubPemBase64
 				);
 
 				socketRef.current.send(
@@ -1053,10 +1096,7 @@ export default function ChatPage() {
 						type: "change_publickey",
 						sender: userInfor.uuid,
 						receiver: senderUUID,
-						data: JSON.stringify({
-							signature: arrayBufferToHexString(signature),
-							data: pubPemBase64,
-						} as InterfaceWSSignatureData),
+						data: JSON.stringify(envelope),
 					} as InterfaceWSFrame)
 				);
 			}
@@ -48,12 +48,16 @@ export default function ForgotPage() {
 		}
 
 		try {
+			const { data: challenge } = await axios.post<InterfaceAuthChallengeResponse>(
+				`${CONFIG_BASE_URL}/api/auth/challenge`,
+				{ username: username } as InterfaceAuthChallengeRequest
+			);
+
+			if (challenge.code !== 200) throw new Error(challenge.message);
+
+			const nonce = challenge.data.nonce;
 			const timestamp = String(Date.now());
 			const privateKey = await importPemToECDSAKey(await selectedFile.text(), true);
-			const signature = await signMessageWithSha256(
-				privateKey,
-				stringToArrayBuffer(`${username}:${timestamp}`)
-			);
 			const passwordDigest = arrayBufferToHexString(
 				await calcSha256Digest(password)
 			);
@@ -62,14 +66,28 @@ export default function ForgotPage() {
 				await selectedFile.arrayBuffer()
 			);
 			const privateIVBase64 = arrayBufferToBase64(iv);
-			const signatureBase64 = arrayBufferToBase64(signature);
 			const privateKeyBase64 = arrayBufferToBase64(ciphertext);
+			const signature = await signMessageWithSha256(
+				privateKey,
+				stringToArrayBuffer(
+					[
+						username,
+						nonce,
+						timestamp,
+						passwordDigest,
+						privateIVBase64,
+						privateKeyBase64,
+					].join(":")
+				)
+			);
+			const signatureBase64 = arrayBufferToBase64(signature);
 
 			const { data } = await axios.post<InterfaceAuthForgotResponse>(
 				`${CONFIG_BASE_URL}/api/auth/forgot`,
 				{
 					username: username,
 					password: passwordDigest,
+					nonce: nonce,
 					signinfo: signatureBase64,
 					timestamp: timestamp,
 					private_iv: privateIVBase64,
@@ -5,11 +5,17 @@ interface InterfaceAuthValidRequest {
 	authorization: string;
 }
 
+// Api Request Interface: /api/auth/challenge
+interface InterfaceAuthChallengeRequest {
+	username: string;
+}
+
 // Api Request Interface: /api/auth/forgot
 interface InterfaceAuthForgotRequest {
 	username: string;
 	password: string; // Sha256(plain_password)
-	signinfo: string; // Base64(sign(username, sha256(username:timestamp)))
+	nonce: string; // From /api/auth/challenge, single use
+	signinfo: string; // Base64(sign(sha256(username:nonce:timestamp:password:private_iv:private_key)))
 	timestamp: string;
 	private_iv: string; // Base64(IV)
 	private_key: string; // Base64(Encrypt(ESDSA-P521-PrivKey-Pem, calcSecretKey(username, plain_password), IV))
@@ -6,6 +6,16 @@ interface InterfaceBaseResponse {
 // Api Response Interface: /api/auth/valid
 interface InterfaceAuthValidResponse extends InterfaceBaseResponse {}
 
+// Api Response Interface: /api/auth/challenge
+interface InterfaceAuthChallengeResponse extends InterfaceBaseResponse {
+	data: InterfaceAuthChallengeData;
+}
+
+interface InterfaceAuthChallengeData {
+	nonce: string;
+	expires_in: number;
+}
+
 // Api Response Interface: /api/auth/forgot
 interface InterfaceAuthForgotResponse extends InterfaceBaseResponse {}
 
@@ -6,6 +6,7 @@ type FrameType =
 	| "event_allowfriend" // 事件：好友请求被接受
 	| "change_keychain" // Sender -> Server：请求更新与某用户的棘轮状态
 	| "change_publickey" // Sender -> Receiver：请求更新与某用户的DH公钥
+	| "keychain_conflict" // Server -> Sender：棘轮状态的写入基于过期版本，返回服务器保存的状态
 	| "update_userlist" // Server -> Receiver: 服务器向用户端推送当前的用户列表
 	| "update_friendlist"; // Server -> Receiver: 服务器向用户推送最新的好友列表
 
@@ -55,15 +56,26 @@ interface InterfaceWSFriendlistData {
 	public_key: string;
 	chain_iv: string;
 	chain_key: string;
+	chain_version: number;
 	messages: Array<InterfaceWSMessage>;
 }
 
 interface InterfaceWSSignatureData {
 	data: string;
 	signature: string;
+	timestamp: number;
 }
 
 interface InterfaceWSChainKeyData {
 	chain_iv: string;
 	chain_key: string;
+	version: number;
+}
+
+interface InterfaceWSKeychainConflictData {
+	friend_uuid: string;
+	rejected: number;
+	version: number;
+	chain_iv: string;
+	chain_key: string;
 }
@@ -1,6 +1,8 @@
 import {
 	arrayBufferToBase64,
+	arrayBufferToHexString,
 	base64ToArrayBuffer,
+	hexStringToArrayBuffer,
 	stringToArrayBuffer,
 } from "./transfer";
 
@@ -117,6 +119,50 @@ export async function verifyMessageWithSha256(
 	);
 }
 
+// NOTE: 签名同时覆盖帧类型、收发双方和时间戳，签名数据无法被重放给其他接收方或作为其他帧类型
+function envelopeMessage(
+	type: string,
+	sender: string,
+	receiver: string,
+	timestamp: number,
+	data: string
+) {
+	return stringToArrayBuffer([type, sender, receiver, timestamp, data].join("\n"));
+}
+
+export async function signEnvelope(
+	privatekey: CryptoKey,
+	type: string,
+	sender: string,
+	receiver: string,
+	data: string
+): Promise<InterfaceWSSignatureData> {
+	const timestamp = Date.now();
+	const signature = await signMessageWithSha256(
+		privatekey,
+		envelopeMessage(type, sender, receiver, timestamp, data)
+	);
+	return {
+		data: data,
+		signature: arrayBufferToHexString(signature),
+		timestamp: timestamp,
+	};
+}
+
+export async function verifyEnvelope(
+	publickey: CryptoKey,
+	type: string,
+	sender: string,
+	receiver: string,
+	envelope: InterfaceWSSignatureData
+) {
+	return verifyMessageWithSha256(
+		publickey,
+		hexStringToArrayBuffer(envelope.signature),
+		envelopeMessage(type, sender, receiver, envelope.timestamp, envelope.data)
+	);
+}
+
 export async function calcSecretKey(username: string, password: string) {
 	const usernameBuffer = stringToArrayBuffer(username);
 	const passwordBuffer = stringToArrayBuffer(password);
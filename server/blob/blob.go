@@ -0,0 +1,24 @@
+package blob
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidBlobID  = errors.New("invalid blob id")
+	ErrOffsetMismatch = errors.New("chunk offset does not match blob size")
+)
+
+// Store keeps opaque blobs, the server never sees their plaintext so a
+// backend only has to support appending chunks and reading them back.
+type Store interface {
+	// Append writes the chunk at offset, which must equal the current size,
+	// and returns the new size of the blob.
+	Append(id string, offset int64, chunk io.Reader) (int64, error)
+	// Size returns how many bytes were stored so far, 0 for unknown blobs.
+	Size(id string) (int64, error)
+	Open(id string) (io.ReadSeekCloser, error)
+	Delete(id string) error
+}
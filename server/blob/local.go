@@ -0,0 +1,125 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// localStore saves every blob as one file under root, sharded by the first
+// two characters of the id.
+type localStore struct {
+	root  string
+	locks sync.Map
+}
+
+func NewLocalStore(root string) (Store, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	return &localStore{root: root}, nil
+}
+
+func (s *localStore) path(id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", ErrInvalidBlobID
+	}
+	return filepath.Join(s.root, id[:2], id), nil
+}
+
+func (s *localStore) lock(id string) func() {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func (s *localStore) Append(id string, offset int64, chunk io.Reader) (int64, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock := s.lock(id)
+	defer unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	} else if info.Size() != offset {
+		return info.Size(), ErrOffsetMismatch
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	written, err := io.Copy(file, chunk)
+	if err != nil {
+		// 写入一半的分片需要截断，保证客户端可以从原位置重新上传
+		file.Truncate(offset)
+		return offset, err
+	}
+	return offset + written, nil
+}
+
+func (s *localStore) Size(id string) (int64, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localStore) Open(id string) (io.ReadSeekCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *localStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lock(id)
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.locks.Delete(id)
+	return nil
+}
@@ -1,21 +1,180 @@
 package config
 
-import "os"
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var (
 	ROOT_PATH = getEnv("ROOT_PATH", "/")
-	JWT_SERRET = getEnv("JWT_SECRET", "password")
+
+	// NOTE: 可选 EdDSA、ES256，密钥文件为空时只保存在内存中，重启后需重新登录
+	JWT_ALGORITHM         = getEnv("JWT_ALGORITHM", "EdDSA")
+	JWT_KEYSET_PATH       = getEnv("JWT_KEYSET_PATH", "keys/jwks.json")
+	JWT_ROTATION_INTERVAL = getEnvDuration("JWT_ROTATION_INTERVAL", 7*24*time.Hour)
+
+	// NOTE: 访问令牌短期有效，通过刷新令牌续期
+	ACCESS_TOKEN_TTL           = getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	REFRESH_TOKEN_TTL          = getEnvDuration("REFRESH_TOKEN_TTL", 24*time.Hour)
+	REFRESH_TOKEN_REMEMBER_TTL = getEnvDuration("REFRESH_TOKEN_REMEMBER_TTL", 7*24*time.Hour)
+
+	// NOTE: 可选 mysql、sqlite、memory
+	DATABASE_DRIVER = getEnv("DATABASE_DRIVER", "mysql")
+	SQLITE_PATH     = getEnv("SQLITE_PATH", "double_ratchet.db")
 
 	MYSQL_USER     = getEnv("MYSQL_USER", "root")
 	MYSQL_PORT     = getEnv("MYSQL_PORT", "3306")
 	MYSQL_HOST     = getEnv("MYSQL_HOST", "localhost")
 	MYSQL_SECRET   = getEnv("MYSQL_SECRET", "password")
 	MYSQL_DATABASE = getEnv("MYSQL_DATABASE", "double_ratchet")
+
+	// NOTE: 可选 argon2id、bcrypt，已有哈希会在登录时按当前策略重新计算
+	PASSWORD_ALGORITHM      = getEnv("PASSWORD_ALGORITHM", "argon2id")
+	PASSWORD_BCRYPT_COST    = getEnvInt("PASSWORD_BCRYPT_COST", 12)
+	PASSWORD_ARGON2_TIME    = getEnvInt("PASSWORD_ARGON2_TIME", 3)
+	PASSWORD_ARGON2_MEMORY  = getEnvInt("PASSWORD_ARGON2_MEMORY", 64*1024)
+	PASSWORD_ARGON2_THREADS = getEnvInt("PASSWORD_ARGON2_THREADS", 2)
+
+	// NOTE: 附件大小单位为字节，配额为单个用户所有附件的总大小
+	ATTACHMENT_PATH       = getEnv("ATTACHMENT_PATH", "uploads/attachments")
+	ATTACHMENT_CHUNK_SIZE = getEnvInt("ATTACHMENT_CHUNK_SIZE", 4<<20)
+	ATTACHMENT_MAX_SIZE   = getEnvInt("ATTACHMENT_MAX_SIZE", 100<<20)
+	ATTACHMENT_QUOTA      = getEnvInt("ATTACHMENT_QUOTA", 1<<30)
+
+	AVATAR_PATH     = getEnv("AVATAR_PATH", "uploads/avatars")
+	AVATAR_MAX_SIZE = getEnvInt("AVATAR_MAX_SIZE", 5<<20)
+
+	OUTBOX_RETRY_INTERVAL = getEnvDuration("OUTBOX_RETRY_INTERVAL", 2*time.Second)
+	OUTBOX_RETRY_MAX      = getEnvDuration("OUTBOX_RETRY_MAX", time.Minute)
+	OUTBOX_RETRY_LIMIT    = getEnvInt("OUTBOX_RETRY_LIMIT", 8)
+	MESSAGE_EXPIRATION    = getEnvDuration("MESSAGE_EXPIRATION", 7*24*time.Hour)
+
+	// NOTE: 超过 WS_PONG_TIMEOUT 没有收到任何数据的连接视为断开，间隔需小于超时时间
+	WS_PING_INTERVAL = getEnvDuration("WS_PING_INTERVAL", 30*time.Second)
+	WS_PONG_TIMEOUT  = getEnvDuration("WS_PONG_TIMEOUT", 75*time.Second)
+	WS_WRITE_TIMEOUT = getEnvDuration("WS_WRITE_TIMEOUT", 10*time.Second)
+
+	// NOTE: 每个连接的发送队列长度，溢出策略可选 drop_oldest、disconnect、spill
+	WS_QUEUE_SIZE     = getEnvInt("WS_QUEUE_SIZE", 256)
+	WS_QUEUE_OVERFLOW = getEnv("WS_QUEUE_OVERFLOW", "spill")
+
+	// NOTE: 单条消息允许跳过的消息密钥数量上限，超出的消息直接拒绝
+	MESSAGE_MAX_SKIP = getEnvInt("MESSAGE_MAX_SKIP", 1000)
+
+	// NOTE: 每个好友保留的棘轮状态历史版本数量，用于覆盖后恢复
+	KEYCHAIN_HISTORY_LIMIT = getEnvInt("KEYCHAIN_HISTORY_LIMIT", 10)
+
+	// NOTE: 令牌桶容量及其完全恢复所需时间，分别针对 IP、账户和单个 WebSocket 连接
+	RATE_LIMIT_IP_BURST         = getEnvInt("RATE_LIMIT_IP_BURST", 30)
+	RATE_LIMIT_IP_INTERVAL      = getEnvDuration("RATE_LIMIT_IP_INTERVAL", time.Minute)
+	RATE_LIMIT_ACCOUNT_BURST    = getEnvInt("RATE_LIMIT_ACCOUNT_BURST", 10)
+	RATE_LIMIT_ACCOUNT_INTERVAL = getEnvDuration("RATE_LIMIT_ACCOUNT_INTERVAL", time.Minute)
+	RATE_LIMIT_FRAME_BURST      = getEnvInt("RATE_LIMIT_FRAME_BURST", 100)
+	RATE_LIMIT_FRAME_INTERVAL   = getEnvDuration("RATE_LIMIT_FRAME_INTERVAL", 10*time.Second)
+
+	// NOTE: 每对 (请求者, 目标用户) 拉取预密钥包的频率，防止耗尽对方的一次性预密钥
+	RATE_LIMIT_BUNDLE_BURST    = getEnvInt("RATE_LIMIT_BUNDLE_BURST", 5)
+	RATE_LIMIT_BUNDLE_INTERVAL = getEnvDuration("RATE_LIMIT_BUNDLE_INTERVAL", time.Hour)
+
+	// NOTE: 找回密码的挑战有效期，以及时间戳允许与服务器相差的范围（前后均校验）
+	RECOVERY_NONCE_TTL  = getEnvDuration("RECOVERY_NONCE_TTL", 5*time.Minute)
+	RECOVERY_CLOCK_SKEW = getEnvDuration("RECOVERY_CLOCK_SKEW", time.Minute)
+
+	// NOTE: 签名信封的时间戳允许与服务器相差的范围，超出的 change_publickey 视为重放
+	ENVELOPE_CLOCK_SKEW = getEnvDuration("ENVELOPE_CLOCK_SKEW", 5*time.Minute)
+
+	// NOTE: 窗口内连续失败达到阈值后锁定，此后每次失败锁定时间翻倍直到上限
+	LOCKOUT_THRESHOLD = getEnvInt("LOCKOUT_THRESHOLD", 5)
+	LOCKOUT_WINDOW    = getEnvDuration("LOCKOUT_WINDOW", 15*time.Minute)
+	LOCKOUT_BASE      = getEnvDuration("LOCKOUT_BASE", 30*time.Second)
+	LOCKOUT_MAX       = getEnvDuration("LOCKOUT_MAX", time.Hour)
+
+	// NOTE: expvar 指标的路径，为空时不暴露，开启时应只对内网开放
+	METRICS_PATH = getEnv("METRICS_PATH", "")
+
+	// NOTE: 信任其 X-Forwarded-For 的反向代理，逗号分隔的 IP 或 CIDR，为空时只使用连接的对端地址
+	TRUSTED_PROXIES = getEnvList("TRUSTED_PROXIES")
 )
 
+// Validate rejects settings that have no safe fallback, the server refuses to
+// start instead of silently picking another behaviour.
+func Validate() error {
+	switch JWT_ALGORITHM {
+	case "EdDSA", "ES256":
+	default:
+		return fmt.Errorf("unknown JWT_ALGORITHM %q, expected EdDSA or ES256", JWT_ALGORITHM)
+	}
+
+	switch PASSWORD_ALGORITHM {
+	case "argon2id", "bcrypt":
+	default:
+		return fmt.Errorf("unknown PASSWORD_ALGORITHM %q, expected argon2id or bcrypt", PASSWORD_ALGORITHM)
+	}
+
+	// NOTE: 参数会被截断为 argon2 的 uint8/uint32 类型，time 或 threads 为 0 时 argon2 会直接 panic
+	if PASSWORD_ARGON2_TIME < 1 || int64(PASSWORD_ARGON2_TIME) > math.MaxUint32 {
+		return fmt.Errorf("invalid PASSWORD_ARGON2_TIME %d, expected 1 to %d", PASSWORD_ARGON2_TIME, uint32(math.MaxUint32))
+	}
+	if PASSWORD_ARGON2_THREADS < 1 || PASSWORD_ARGON2_THREADS > math.MaxUint8 {
+		return fmt.Errorf("invalid PASSWORD_ARGON2_THREADS %d, expected 1 to %d", PASSWORD_ARGON2_THREADS, math.MaxUint8)
+	}
+	if PASSWORD_ARGON2_MEMORY < 8*PASSWORD_ARGON2_THREADS || int64(PASSWORD_ARGON2_MEMORY) > math.MaxUint32 {
+		return fmt.Errorf("invalid PASSWORD_ARGON2_MEMORY %d, expected 8 KiB per thread up to %d", PASSWORD_ARGON2_MEMORY, uint32(math.MaxUint32))
+	}
+	// NOTE: 与 bcrypt.MinCost、bcrypt.MaxCost 一致
+	if PASSWORD_BCRYPT_COST < 4 || PASSWORD_BCRYPT_COST > 31 {
+		return fmt.Errorf("invalid PASSWORD_BCRYPT_COST %d, expected 4 to 31", PASSWORD_BCRYPT_COST)
+	}
+
+	switch WS_QUEUE_OVERFLOW {
+	case "drop_oldest", "disconnect", "spill":
+	default:
+		return fmt.Errorf("unknown WS_QUEUE_OVERFLOW %q, expected drop_oldest, disconnect or spill", WS_QUEUE_OVERFLOW)
+	}
+
+	for _, proxy := range TRUSTED_PROXIES {
+		if _, err := netip.ParsePrefix(proxy); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(proxy); err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry %q, expected an IP or CIDR", proxy)
+		}
+	}
+	return nil
+}
+
 func getEnv(key string, defaultVal string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
 	}
 	return defaultVal
 }
+
+func getEnvList(key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvInt(key string, defaultVal int) int {
+	if val, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return val
+	}
+	return defaultVal
+}
+
+func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return val
+	}
+	return defaultVal
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func()
+		want  string
+	}{
+		{"defaults", func() {}, ""},
+		{"queue overflow", func() { WS_QUEUE_OVERFLOW = "block" }, "WS_QUEUE_OVERFLOW"},
+		{"trusted proxy", func() { TRUSTED_PROXIES = []string{"10.0.0.0/8", "proxy.local"} }, "TRUSTED_PROXIES"},
+		{"jwt algorithm", func() { JWT_ALGORITHM = "HS256" }, "JWT_ALGORITHM"},
+		{"password algorithm", func() { PASSWORD_ALGORITHM = "scrypt" }, "PASSWORD_ALGORITHM"},
+		{"argon2 time zero", func() { PASSWORD_ARGON2_TIME = 0 }, "PASSWORD_ARGON2_TIME"},
+		{"argon2 threads zero", func() { PASSWORD_ARGON2_THREADS = 0 }, "PASSWORD_ARGON2_THREADS"},
+		{"argon2 threads overflow", func() { PASSWORD_ARGON2_THREADS = 256 }, "PASSWORD_ARGON2_THREADS"},
+		{"argon2 memory", func() { PASSWORD_ARGON2_MEMORY = 8 }, "PASSWORD_ARGON2_MEMORY"},
+		{"bcrypt cost", func() { PASSWORD_BCRYPT_COST = 32 }, "PASSWORD_BCRYPT_COST"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overflow, proxies := WS_QUEUE_OVERFLOW, TRUSTED_PROXIES
+			jwtAlgorithm, passwordAlgorithm := JWT_ALGORITHM, PASSWORD_ALGORITHM
+			argon2Time, argon2Threads, argon2Memory, bcryptCost := PASSWORD_ARGON2_TIME, PASSWORD_ARGON2_THREADS, PASSWORD_ARGON2_MEMORY, PASSWORD_BCRYPT_COST
+			defer func() {
+				WS_QUEUE_OVERFLOW, TRUSTED_PROXIES = overflow, proxies
+				JWT_ALGORITHM, PASSWORD_ALGORITHM = jwtAlgorithm, passwordAlgorithm
+				PASSWORD_ARGON2_TIME, PASSWORD_ARGON2_THREADS, PASSWORD_ARGON2_MEMORY, PASSWORD_BCRYPT_COST = argon2Time, argon2Threads, argon2Memory, bcryptCost
+			}()
+			test.apply()
+
+			err := Validate()
+			if test.want == "" && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+				t.Fatalf("Validate() = %v, want an error about %s", err, test.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,15 @@
 package database
 
-import (
-	"fmt"
-	"log"
-
-	"double-ratchet-server/config"
-
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
-)
-
 type User struct {
-	ID         uint   `gorm:"primaryKey"`
-	UUID       string `gorm:"type:varchar(36);not null;uniqueIndex"`
-	Username   string `gorm:"type:varchar(64);not null;unique"`
-	Password   string `gorm:"type:varchar(64);not null"`
-	AvatarUrl  string `gorm:"type:varchar(64);not null"`
-	PublicKey  string `gorm:"type:text;not null"`
-	PrivateIV  string `gorm:"type:text;not null"`
-	PrivateKey string `gorm:"type:text;not null"`
+	ID           uint   `gorm:"primaryKey"`
+	UUID         string `gorm:"type:varchar(36);not null;uniqueIndex"`
+	Username     string `gorm:"type:varchar(64);not null;unique"`
+	Password     string `gorm:"type:varchar(255);not null"`
+	AvatarUrl    string `gorm:"type:varchar(255);not null"`
+	PublicKey    string `gorm:"type:text;not null"`
+	PrivateIV    string `gorm:"type:text;not null"`
+	PrivateKey   string `gorm:"type:text;not null"`
+	KeyAlgorithm string `gorm:"type:varchar(16);not null;default:''"`
 }
 
 type Friend struct {
@@ -26,31 +17,211 @@ type Friend struct {
 	FriendUUID string `gorm:"type:varchar(36);primaryKey"`
 	ChainIV    string `gorm:"type:text"`
 	ChainKey   string `gorm:"type:longtext"`
+	// ChainVersion grows by one with every keychain write, a write based on
+	// an older version is rejected.
+	ChainVersion uint64 `gorm:"not null;default:0"`
+	// VerifiedKey is the fingerprint of the friend's identity key the user
+	// compared out of band, a later key change leaves it stale.
+	VerifiedKey string `gorm:"type:varchar(64);not null;default:''"`
 }
 
+// NOTE: 消息投递状态 queued -> sent -> acked，超时未确认则为 expired
+const (
+	MessageQueued  = "queued"
+	MessageSent    = "sent"
+	MessageAcked   = "acked"
+	MessageExpired = "expired"
+)
+
+// Message.Timestamp is chosen by the sender and only shown to clients,
+// CreatedAt is set by the server and is what expiry is based on.
 type Message struct {
 	ID          uint   `gorm:"primaryKey"`
 	Type        string `gorm:"type:varchar(36)"`
-	Sender      string `gorm:"type:varchar(36);index"`
-	Receiver    string `gorm:"type:varchar(36);index"`
+	Sender      string `gorm:"type:varchar(36);index;index:idx_messages_conversation,priority:1"`
+	Receiver    string `gorm:"type:varchar(36);index;index:idx_messages_conversation,priority:2"`
 	Data        string `gorm:"type:longtext"`
+	Status      string `gorm:"type:varchar(16);index;default:queued"`
 	IsDelivered bool   `gorm:"type:bool"`
-	Timestamp   int64  `gorm:"autoCreateTime:milli"`
+	Sequence    uint64 `gorm:"not null;default:0"`
+	Timestamp   int64  `gorm:"autoCreateTime:milli;index:idx_messages_conversation,priority:3"`
+	CreatedAt   int64  `gorm:"autoCreateTime:milli"`
 }
 
-var MDB *gorm.DB
+// Device is created the first time a device connects, Cursor is the last
+// message id at that moment so older delivered history is not replayed.
+type Device struct {
+	UserUUID  string `gorm:"type:varchar(36);primaryKey"`
+	DeviceID  string `gorm:"type:varchar(64);primaryKey"`
+	Cursor    uint   `gorm:"not null"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
 
-func init() {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", config.MYSQL_USER, config.MYSQL_SECRET, config.MYSQL_HOST, config.MYSQL_PORT, config.MYSQL_DATABASE)
+// MessageDelivery is the ack of one device, group messages reach several
+// users so the user is part of the key as well.
+type MessageDelivery struct {
+	MessageID uint   `gorm:"primaryKey"`
+	UserUUID  string `gorm:"type:varchar(36);primaryKey"`
+	DeviceID  string `gorm:"type:varchar(64);primaryKey"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
 
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	if err != nil {
-		log.Fatalf("connect mysql error: %s\n", err.Error())
+// PublickeyEnvelope is the newest change_publickey envelope one device of
+// UserUUID sent to Receiver, an envelope that is not newer is a replay.
+type PublickeyEnvelope struct {
+	UserUUID  string `gorm:"type:varchar(36);primaryKey"`
+	DeviceID  string `gorm:"type:varchar(64);primaryKey"`
+	Receiver  string `gorm:"type:varchar(36);primaryKey"`
+	Timestamp int64  `gorm:"not null"`
+}
+
+// NOTE: 群组消息的 Receiver 为群组的 UUID
+type Group struct {
+	ID        uint   `gorm:"primaryKey"`
+	UUID      string `gorm:"type:varchar(36);not null;uniqueIndex"`
+	Name      string `gorm:"type:varchar(64);not null"`
+	Owner     string `gorm:"type:varchar(36);not null"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
+
+// GroupMember.Cursor is the last message id when the member joined, so a new
+// member never receives ciphertext encrypted under sender keys it lacks.
+type GroupMember struct {
+	GroupUUID string `gorm:"type:varchar(36);primaryKey"`
+	UserUUID  string `gorm:"type:varchar(36);primaryKey;index"`
+	Cursor    uint   `gorm:"not null"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
+
+// GroupReceipt records that at least one device of a member acked a group message.
+type GroupReceipt struct {
+	MessageID uint   `gorm:"primaryKey"`
+	UserUUID  string `gorm:"type:varchar(36);primaryKey"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
+
+type SignedPrekey struct {
+	UserUUID  string `gorm:"type:varchar(36);primaryKey"`
+	KeyID     uint   `gorm:"not null"`
+	PublicKey string `gorm:"type:text;not null"`
+	Signature string `gorm:"type:text;not null"`
+	Timestamp int64  `gorm:"autoUpdateTime:milli"`
+}
+
+type OneTimePrekey struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserUUID  string `gorm:"type:varchar(36);not null;uniqueIndex:idx_prekey_user_key"`
+	KeyID     uint   `gorm:"not null;uniqueIndex:idx_prekey_user_key"`
+	PublicKey string `gorm:"type:text;not null"`
+}
+
+// Attachment describes an encrypted blob, Size is declared up front so the
+// quota is reserved before the first chunk arrives.
+type Attachment struct {
+	ID        uint   `gorm:"primaryKey"`
+	UUID      string `gorm:"type:varchar(36);not null;uniqueIndex"`
+	Owner     string `gorm:"type:varchar(36);not null;index"`
+	Size      int64  `gorm:"not null"`
+	Completed bool   `gorm:"type:bool;not null;default:false"`
+	Timestamp int64  `gorm:"autoCreateTime:milli"`
+}
+
+// NOTE: Recipient 可以是用户 UUID，也可以是群组 UUID
+type AttachmentRecipient struct {
+	AttachmentUUID string `gorm:"type:varchar(36);primaryKey"`
+	Recipient      string `gorm:"type:varchar(36);primaryKey"`
+}
+
+// Session is one login of a user. Only hashes of refresh tokens are kept,
+// PreviousHash detects a rotated refresh token being replayed.
+type Session struct {
+	ID           uint   `gorm:"primaryKey"`
+	UUID         string `gorm:"type:varchar(36);not null;uniqueIndex"`
+	UserUUID     string `gorm:"type:varchar(36);not null;index"`
+	RefreshHash  string `gorm:"type:varchar(64);not null;uniqueIndex"`
+	PreviousHash string `gorm:"type:varchar(64);index"`
+	Remember     bool   `gorm:"type:bool;not null;default:false"`
+	Revoked      bool   `gorm:"type:bool;not null;default:false"`
+	ExpiresAt    int64  `gorm:"not null"`
+	CreatedAt    int64  `gorm:"autoCreateTime:milli"`
+}
+
+// RecoveryNonce is a single-use password recovery challenge, only the sha256
+// of the nonce is stored.
+type RecoveryNonce struct {
+	Hash      string `gorm:"type:varchar(64);primaryKey"`
+	Username  string `gorm:"type:varchar(64);not null;index"`
+	ExpiresAt int64  `gorm:"not null;index"`
+}
+
+// IdentityKey is one entry of the identity key history of a user, the newest
+// entry matches User.PublicKey.
+type IdentityKey struct {
+	ID           uint   `gorm:"primaryKey"`
+	UserUUID     string `gorm:"type:varchar(36);not null;index"`
+	PublicKey    string `gorm:"type:text;not null"`
+	KeyAlgorithm string `gorm:"type:varchar(16);not null"`
+	Fingerprint  string `gorm:"type:varchar(64);not null"`
+	CreatedAt    int64  `gorm:"autoCreateTime:milli"`
+}
+
+// KeychainVersion keeps the recent keychain versions of a friendship, so a
+// ratchet state that was overwritten can still be recovered.
+type KeychainVersion struct {
+	UserUUID   string `gorm:"type:varchar(36);primaryKey"`
+	FriendUUID string `gorm:"type:varchar(36);primaryKey"`
+	Version    uint64 `gorm:"primaryKey;autoIncrement:false"`
+	ChainIV    string `gorm:"type:text"`
+	ChainKey   string `gorm:"type:longtext"`
+	CreatedAt  int64  `gorm:"autoCreateTime:milli"`
+}
+
+// AuditEvent records a frame that a client was not allowed to send, Sender
+// and Receiver are copied from the frame as the client claimed them.
+type AuditEvent struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserUUID  string `gorm:"type:varchar(36);not null;index"`
+	DeviceID  string `gorm:"type:varchar(64);not null"`
+	FrameType string `gorm:"type:varchar(32);not null"`
+	Sender    string `gorm:"type:varchar(36)"`
+	Receiver  string `gorm:"type:varchar(36)"`
+	Reason    string `gorm:"type:varchar(128);not null"`
+	CreatedAt int64  `gorm:"autoCreateTime:milli;index"`
+}
+
+// Conversation is the text stream from Sender to Receiver, it hands out the
+// sequence numbers and remembers the newest ratchet position of the sender.
+type Conversation struct {
+	Sender   string `gorm:"type:varchar(36);primaryKey"`
+	Receiver string `gorm:"type:varchar(36);primaryKey"`
+	Sequence uint64 `gorm:"not null;default:0"`
+	XRatchet int64  `gorm:"not null;default:0"`
+	YRatchet int64  `gorm:"not null;default:0"`
+}
+
+// advance moves the conversation to the ratchet position of a new message
+// and returns how many message keys the sender skipped to get there. Late
+// messages behind the newest position do not move it.
+func (c *Conversation) advance(xRatchet, yRatchet, maxSkip int64) (int64, error) {
+	// NOTE: 负的位置会让跳过数量变为负数而绕过窗口检查，并把会话位置拉回
+	if xRatchet < 0 || yRatchet < 0 {
+		return 0, ErrRatchetInvalid
 	}
+	c.Sequence++
 
-	if err = db.AutoMigrate(&User{}, &Friend{}, &Message{}); err != nil {
-		log.Fatalf("create mysql tables error: %s\n", err.Error())
+	var skipped int64
+	switch {
+	case c.Sequence == 1 || xRatchet > c.XRatchet:
+		skipped = yRatchet
+	case xRatchet == c.XRatchet && yRatchet > c.YRatchet:
+		skipped = yRatchet - c.YRatchet - 1
+	default:
+		return 0, nil
 	}
 
-	MDB = db
+	if skipped > maxSkip {
+		return skipped, ErrSkipWindow
+	}
+	c.XRatchet, c.YRatchet = xRatchet, yRatchet
+	return skipped, nil
 }
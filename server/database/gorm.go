@@ -0,0 +1,663 @@
+package database
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormStore struct {
+	db *gorm.DB
+}
+
+func OpenMySQL(dsn string) (Store, error) {
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	return NewGormStore(db)
+}
+
+func OpenSQLite(path string) (Store, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+	return NewGormStore(db)
+}
+
+// NewGormStore migrates the tables and wraps an opened gorm connection.
+func NewGormStore(db *gorm.DB) (Store, error) {
+	if err := db.AutoMigrate(&User{}, &Friend{}, &Message{}, &SignedPrekey{}, &OneTimePrekey{}, &Device{}, &MessageDelivery{}, &Group{}, &GroupMember{}, &GroupReceipt{}, &Attachment{}, &AttachmentRecipient{}, &Session{}, &RecoveryNonce{}, &IdentityKey{}, &KeychainVersion{}, &Conversation{}, &AuditEvent{}, &PublickeyEnvelope{}); err != nil {
+		return nil, err
+	}
+	return &gormStore{db: db}, nil
+}
+
+func translateError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrRecordNotFound
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicated
+	}
+	return err
+}
+
+func (s *gormStore) CreateUser(user *User) error {
+	return translateError(s.db.Create(user).Error)
+}
+
+func (s *gormStore) FindUserByUUID(uuid string) (*User, error) {
+	var user User
+	if err := s.db.Where("uuid = ?", uuid).First(&user).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &user, nil
+}
+
+func (s *gormStore) FindUserByUsername(username string) (*User, error) {
+	var user User
+	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &user, nil
+}
+
+func (s *gormStore) ListUsers() ([]User, error) {
+	var users []User
+	if err := s.db.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *gormStore) UpdateUserCredentials(uuid, password, privateIV, privateKey string) error {
+	return s.db.Model(&User{}).Where("uuid = ?", uuid).Updates(map[string]any{
+		"password":    password,
+		"private_iv":  privateIV,
+		"private_key": privateKey,
+	}).Error
+}
+
+func (s *gormStore) UpdateUserPassword(uuid, password string) error {
+	return s.db.Model(&User{}).Where("uuid = ?", uuid).Update("password", password).Error
+}
+
+func (s *gormStore) UpdateUserAvatar(uuid, avatarUrl string) error {
+	return s.db.Model(&User{}).Where("uuid = ?", uuid).Update("avatar_url", avatarUrl).Error
+}
+
+func (s *gormStore) UpdateUserKeyAlgorithm(uuid, algorithm string) error {
+	return s.db.Model(&User{}).Where("uuid = ?", uuid).Update("key_algorithm", algorithm).Error
+}
+
+func (s *gormStore) CreateFriend(friend *Friend) error {
+	return translateError(s.db.Create(friend).Error)
+}
+
+func (s *gormStore) ListFriends(userUUID string) ([]Friend, error) {
+	var friends []Friend
+	if err := s.db.Where("user_uuid = ?", userUUID).Find(&friends).Error; err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+func (s *gormStore) FindFriend(userUUID, friendUUID string) (*Friend, error) {
+	var friend Friend
+	if err := s.db.Where("user_uuid = ? AND friend_uuid = ?", userUUID, friendUUID).First(&friend).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &friend, nil
+}
+
+func (s *gormStore) UpdateFriendVerifiedKey(userUUID, friendUUID, fingerprint string) error {
+	return s.db.Model(&Friend{}).
+		Where("user_uuid = ? AND friend_uuid = ?", userUUID, friendUUID).
+		Update("verified_key", fingerprint).Error
+}
+
+func (s *gormStore) SaveFriendKeychain(userUUID, friendUUID string, expected uint64, chainIV, chainKey string, historyLimit int) (*Friend, bool, error) {
+	var friend Friend
+	saved := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Friend{}).
+			Where("user_uuid = ? AND friend_uuid = ? AND chain_version = ?", userUUID, friendUUID, expected).
+			Updates(map[string]any{
+				"chain_iv":      chainIV,
+				"chain_key":     chainKey,
+				"chain_version": expected + 1,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if err := tx.Where("user_uuid = ? AND friend_uuid = ?", userUUID, friendUUID).First(&friend).Error; err != nil {
+			return translateError(err)
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		saved = true
+
+		if err := tx.Create(&KeychainVersion{
+			UserUUID:   userUUID,
+			FriendUUID: friendUUID,
+			Version:    friend.ChainVersion,
+			ChainIV:    chainIV,
+			ChainKey:   chainKey,
+		}).Error; err != nil {
+			return err
+		}
+
+		if friend.ChainVersion <= uint64(historyLimit) {
+			return nil
+		}
+		return tx.Where("user_uuid = ? AND friend_uuid = ? AND version <= ?", userUUID, friendUUID, friend.ChainVersion-uint64(historyLimit)).
+			Delete(&KeychainVersion{}).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &friend, saved, nil
+}
+
+func (s *gormStore) ListKeychainVersions(userUUID, friendUUID string) ([]KeychainVersion, error) {
+	var versions []KeychainVersion
+	if err := s.db.Where("user_uuid = ? AND friend_uuid = ?", userUUID, friendUUID).
+		Order("version DESC").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s *gormStore) CreateMessage(msg *Message) error {
+	return s.db.Create(msg).Error
+}
+
+func (s *gormStore) CreateSequencedMessage(msg *Message, xRatchet, yRatchet, maxSkip int64) (int64, error) {
+	var skipped int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		conversation := Conversation{Sender: msg.Sender, Receiver: msg.Receiver}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("sender = ? AND receiver = ?", msg.Sender, msg.Receiver).
+			First(&conversation).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if skipped, err = conversation.advance(xRatchet, yRatchet, maxSkip); err != nil {
+			return err
+		}
+		if err := tx.Save(&conversation).Error; err != nil {
+			return err
+		}
+
+		msg.Sequence = conversation.Sequence
+		return tx.Create(msg).Error
+	})
+	return skipped, err
+}
+
+func (s *gormStore) ListSequencedMessages(sender, receiver string, sequences []uint64) ([]Message, error) {
+	var messages []Message
+	if err := s.db.Where("sender = ? AND receiver = ? AND sequence IN ?", sender, receiver, sequences).
+		Order("sequence ASC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *gormStore) FindMessage(id uint) (*Message, error) {
+	var msg Message
+	if err := s.db.Where("id = ?", id).First(&msg).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &msg, nil
+}
+
+func (s *gormStore) FindUndeliveredMessage(sender, receiver, msgType string) (*Message, error) {
+	var msg Message
+	if err := s.db.
+		Where("sender = ? AND receiver = ? AND type = ? AND is_delivered = ?", sender, receiver, msgType, false).
+		First(&msg).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &msg, nil
+}
+
+func (s *gormStore) AckUndeliveredMessages(sender, receiver, msgType string) error {
+	return s.db.Model(&Message{}).
+		Where("sender = ? AND receiver = ? AND type = ? AND is_delivered = ?", sender, receiver, msgType, false).
+		Updates(map[string]any{
+			"is_delivered": true,
+			"status":       MessageAcked,
+		}).Error
+}
+
+func (s *gormStore) FindLatestMessage(sender, receiver string, types []string) (*Message, error) {
+	var msg Message
+	if err := s.db.
+		Where("sender = ? AND receiver = ? AND type IN ?", sender, receiver, types).
+		Order("id DESC").
+		First(&msg).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &msg, nil
+}
+
+func (s *gormStore) ListConversation(userUUID, friendUUID string, types []string, limit int) ([]Message, error) {
+	var messages []Message
+	if err := s.db.
+		Where("is_delivered = ? AND ((sender = ? AND receiver = ?) OR (sender = ? AND receiver = ?)) AND type IN ?",
+			true, userUUID, friendUUID, friendUUID, userUUID, types,
+		).
+		Order("timestamp desc").
+		Limit(limit).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *gormStore) ListHistory(query HistoryQuery) ([]Message, bool, error) {
+	// NOTE: 两个方向分别查询，每个查询都能命中 (sender, receiver, timestamp) 联合索引
+	var messages []Message
+	for _, pair := range [][2]string{{query.UserUUID, query.FriendUUID}, {query.FriendUUID, query.UserUUID}} {
+		tx := s.db.Where("sender = ? AND receiver = ? AND is_delivered = ? AND type IN ?", pair[0], pair[1], true, query.Types)
+		if query.Before != nil {
+			tx = tx.Where("timestamp < ? OR (timestamp = ? AND id < ?)", query.Before.Timestamp, query.Before.Timestamp, query.Before.ID)
+		}
+		if query.After != nil {
+			tx = tx.Where("timestamp > ? OR (timestamp = ? AND id > ?)", query.After.Timestamp, query.After.Timestamp, query.After.ID)
+		}
+		if query.ascending() {
+			tx = tx.Order("timestamp asc, id asc")
+		} else {
+			tx = tx.Order("timestamp desc, id desc")
+		}
+
+		var page []Message
+		if err := tx.Limit(query.Limit + 1).Find(&page).Error; err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, page...)
+	}
+
+	sortHistory(messages, query.ascending())
+	if len(messages) > query.Limit {
+		return messages[:query.Limit], true, nil
+	}
+	return messages, false, nil
+}
+
+func (s *gormStore) ListDeviceMessages(device *Device) ([]Message, error) {
+	acked := s.db.Model(&MessageDelivery{}).
+		Select("message_id").
+		Where("user_uuid = ? AND device_id = ?", device.UserUUID, device.DeviceID)
+
+	var messages []Message
+	if err := s.db.
+		Where("receiver = ? AND (is_delivered = ? OR id > ?)", device.UserUUID, false, device.Cursor).
+		Where("status <> ? AND id NOT IN (?)", MessageExpired, acked).
+		Order("timestamp ASC").
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	// 群组消息以成员为单位确认，其余规则与单聊消息一致
+	received := s.db.Model(&GroupReceipt{}).
+		Select("message_id").
+		Where("user_uuid = ?", device.UserUUID)
+
+	var groupMessages []Message
+	if err := s.db.Model(&Message{}).
+		Select("messages.*").
+		Joins("JOIN group_members ON group_members.group_uuid = messages.receiver AND group_members.user_uuid = ?", device.UserUUID).
+		Where("messages.id > group_members.cursor AND messages.sender <> ?", device.UserUUID).
+		Where("messages.status <> ? AND messages.id NOT IN (?)", MessageExpired, acked).
+		Where("messages.id > ? OR messages.id NOT IN (?)", device.Cursor, received).
+		Find(&groupMessages).Error; err != nil {
+		return nil, err
+	}
+
+	if len(groupMessages) > 0 {
+		messages = append(messages, groupMessages...)
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp < messages[j].Timestamp })
+	}
+	return messages, nil
+}
+
+func (s *gormStore) MaxMessageID() (uint, error) {
+	var id uint
+	if err := s.db.Model(&Message{}).Select("COALESCE(MAX(id), 0)").Scan(&id).Error; err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *gormStore) MarkMessageSent(id uint) (bool, error) {
+	result := s.db.Model(&Message{}).
+		Where("id = ? AND status = ?", id, MessageQueued).
+		Update("status", MessageSent)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) MarkMessageAcked(id uint) (bool, error) {
+	result := s.db.Model(&Message{}).
+		Where("id = ? AND status <> ?", id, MessageAcked).
+		Updates(map[string]any{
+			"is_delivered": true,
+			"status":       MessageAcked,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) ListExpiredMessages(before int64) ([]Message, error) {
+	var messages []Message
+	if err := s.db.
+		Where("is_delivered = ? AND status IN ? AND created_at > 0 AND created_at < ?",
+			false, []string{MessageQueued, MessageSent}, before).
+		Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *gormStore) MarkMessageExpired(id uint) (bool, error) {
+	result := s.db.Model(&Message{}).
+		Where("id = ? AND is_delivered = ?", id, false).
+		Update("status", MessageExpired)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) FindDevice(userUUID, deviceID string) (*Device, error) {
+	var device Device
+	if err := s.db.Where("user_uuid = ? AND device_id = ?", userUUID, deviceID).First(&device).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &device, nil
+}
+
+func (s *gormStore) CreateDevice(device *Device) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(device).Error
+}
+
+func (s *gormStore) CreateMessageDelivery(delivery *MessageDelivery) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery).Error
+}
+
+func (s *gormStore) AdvancePublickeyEnvelope(envelope *PublickeyEnvelope) (bool, error) {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(envelope)
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error == nil, result.Error
+	}
+
+	// NOTE: 条件更新保证并发的相同信封只有一个被接受
+	result = s.db.Model(&PublickeyEnvelope{}).
+		Where("user_uuid = ? AND device_id = ? AND receiver = ? AND timestamp < ?",
+			envelope.UserUUID, envelope.DeviceID, envelope.Receiver, envelope.Timestamp).
+		Update("timestamp", envelope.Timestamp)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) SaveSignedPrekey(prekey *SignedPrekey) error {
+	return s.db.Save(prekey).Error
+}
+
+func (s *gormStore) FindSignedPrekey(userUUID string) (*SignedPrekey, error) {
+	var prekey SignedPrekey
+	if err := s.db.Where("user_uuid = ?", userUUID).First(&prekey).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &prekey, nil
+}
+
+func (s *gormStore) CountOneTimePrekeys(userUUID string) (int64, error) {
+	var count int64
+	err := s.db.Model(&OneTimePrekey{}).Where("user_uuid = ?", userUUID).Count(&count).Error
+	return count, err
+}
+
+func (s *gormStore) CreateOneTimePrekeys(prekeys []OneTimePrekey) error {
+	if len(prekeys) == 0 {
+		return nil
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&prekeys).Error
+}
+
+// ConsumeOneTimePrekey uses the delete as the claim: when two requests race
+// for the same row only one of them affects it, the other one retries.
+func (s *gormStore) ConsumeOneTimePrekey(userUUID string) (*OneTimePrekey, error) {
+	for {
+		var prekey OneTimePrekey
+		if err := s.db.Where("user_uuid = ?", userUUID).Order("id asc").First(&prekey).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		result := s.db.Where("id = ?", prekey.ID).Delete(&OneTimePrekey{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return &prekey, nil
+		}
+	}
+}
+
+func (s *gormStore) CreateGroup(group *Group, members []GroupMember) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(group).Error; err != nil {
+			return translateError(err)
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&members).Error
+	})
+}
+
+func (s *gormStore) FindGroup(uuid string) (*Group, error) {
+	var group Group
+	if err := s.db.Where("uuid = ?", uuid).First(&group).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &group, nil
+}
+
+func (s *gormStore) ListUserGroups(userUUID string) ([]Group, error) {
+	joined := s.db.Model(&GroupMember{}).
+		Select("group_uuid").
+		Where("user_uuid = ?", userUUID)
+
+	var groups []Group
+	if err := s.db.Where("uuid IN (?)", joined).Order("id ASC").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s *gormStore) FindGroupMember(groupUUID, userUUID string) (*GroupMember, error) {
+	var member GroupMember
+	if err := s.db.Where("group_uuid = ? AND user_uuid = ?", groupUUID, userUUID).First(&member).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &member, nil
+}
+
+func (s *gormStore) ListGroupMembers(groupUUID string) ([]GroupMember, error) {
+	var members []GroupMember
+	if err := s.db.Where("group_uuid = ?", groupUUID).Order("timestamp ASC").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (s *gormStore) AddGroupMember(member *GroupMember) error {
+	return translateError(s.db.Create(member).Error)
+}
+
+func (s *gormStore) RemoveGroupMember(groupUUID, userUUID string) error {
+	return s.db.Where("group_uuid = ? AND user_uuid = ?", groupUUID, userUUID).Delete(&GroupMember{}).Error
+}
+
+func (s *gormStore) CreateGroupReceipt(receipt *GroupReceipt) (bool, error) {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(receipt)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) CountGroupReceipts(messageID uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&GroupReceipt{}).Where("message_id = ?", messageID).Count(&count).Error
+	return count, err
+}
+
+func (s *gormStore) CreateAttachment(attachment *Attachment, recipients []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attachment).Error; err != nil {
+			return translateError(err)
+		}
+
+		rows := []AttachmentRecipient{}
+		for _, recipient := range recipients {
+			rows = append(rows, AttachmentRecipient{AttachmentUUID: attachment.UUID, Recipient: recipient})
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+	})
+}
+
+func (s *gormStore) FindAttachment(uuid string) (*Attachment, error) {
+	var attachment Attachment
+	if err := s.db.Where("uuid = ?", uuid).First(&attachment).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &attachment, nil
+}
+
+func (s *gormStore) ListAttachmentRecipients(uuid string) ([]string, error) {
+	var recipients []string
+	if err := s.db.Model(&AttachmentRecipient{}).
+		Where("attachment_uuid = ?", uuid).
+		Pluck("recipient", &recipients).Error; err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+func (s *gormStore) CompleteAttachment(uuid string) error {
+	return s.db.Model(&Attachment{}).Where("uuid = ?", uuid).Update("completed", true).Error
+}
+
+func (s *gormStore) SumAttachmentSize(owner string) (int64, error) {
+	var total int64
+	err := s.db.Model(&Attachment{}).
+		Select("COALESCE(SUM(size), 0)").
+		Where("owner = ?", owner).
+		Scan(&total).Error
+	return total, err
+}
+
+func (s *gormStore) CreateSession(session *Session) error {
+	return translateError(s.db.Create(session).Error)
+}
+
+func (s *gormStore) FindSession(uuid string) (*Session, error) {
+	var session Session
+	if err := s.db.Where("uuid = ?", uuid).First(&session).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &session, nil
+}
+
+func (s *gormStore) FindSessionByRefreshHash(hash string) (*Session, error) {
+	var session Session
+	if err := s.db.Where("refresh_hash = ? OR previous_hash = ?", hash, hash).First(&session).Error; err != nil {
+		return nil, translateError(err)
+	}
+	return &session, nil
+}
+
+func (s *gormStore) RotateSession(uuid, oldHash, newHash string, expiresAt int64) (bool, error) {
+	result := s.db.Model(&Session{}).
+		Where("uuid = ? AND refresh_hash = ? AND revoked = ?", uuid, oldHash, false).
+		Updates(map[string]any{
+			"refresh_hash":  newHash,
+			"previous_hash": oldHash,
+			"expires_at":    expiresAt,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) RevokeSession(uuid string) error {
+	return s.db.Model(&Session{}).Where("uuid = ?", uuid).Update("revoked", true).Error
+}
+
+func (s *gormStore) RevokeUserSessions(userUUID string) ([]string, error) {
+	var uuids []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Session{}).
+			Where("user_uuid = ? AND revoked = ?", userUUID, false).
+			Pluck("uuid", &uuids).Error; err != nil {
+			return err
+		}
+		if len(uuids) == 0 {
+			return nil
+		}
+		return tx.Model(&Session{}).Where("uuid IN ?", uuids).Update("revoked", true).Error
+	})
+	return uuids, err
+}
+
+func (s *gormStore) CreateRecoveryNonce(nonce *RecoveryNonce) error {
+	if err := s.db.Where("expires_at <= ?", nowMilli()).Delete(&RecoveryNonce{}).Error; err != nil {
+		return err
+	}
+	return translateError(s.db.Create(nonce).Error)
+}
+
+func (s *gormStore) ConsumeRecoveryNonce(hash, username string, now int64) (bool, error) {
+	result := s.db.Where("hash = ? AND username = ? AND expires_at > ?", hash, username, now).Delete(&RecoveryNonce{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *gormStore) CreateIdentityKey(key *IdentityKey) error {
+	return s.db.Create(key).Error
+}
+
+func (s *gormStore) RotateIdentityKey(key *IdentityKey) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("uuid = ?", key.UserUUID).Updates(map[string]any{
+			"public_key":    key.PublicKey,
+			"key_algorithm": key.KeyAlgorithm,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+}
+
+func (s *gormStore) ListIdentityKeys(userUUID string) ([]IdentityKey, error) {
+	var keys []IdentityKey
+	if err := s.db.Where("user_uuid = ?", userUUID).Order("id ASC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *gormStore) CreateAuditEvent(event *AuditEvent) error {
+	return translateError(s.db.Create(event).Error)
+}
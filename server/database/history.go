@@ -0,0 +1,90 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrHistoryCursor = errors.New("invalid history cursor")
+
+// NOTE: REST 与 websocket 历史接口共用的分页大小
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
+// HistoryCursor is a position in a conversation, ordered by timestamp and
+// then by message id for messages sent in the same millisecond.
+type HistoryCursor struct {
+	Timestamp int64
+	ID        uint
+}
+
+// ParseHistoryCursor accepts "<timestamp>-<id>" as returned by String, or a
+// bare "<timestamp>" to start from a point in time.
+func ParseHistoryCursor(value string) (*HistoryCursor, error) {
+	timestamp, id, hasID := strings.Cut(value, "-")
+
+	cursor := &HistoryCursor{}
+	var err error
+	if cursor.Timestamp, err = strconv.ParseInt(timestamp, 10, 64); err != nil || cursor.Timestamp < 0 {
+		return nil, ErrHistoryCursor
+	}
+	if !hasID {
+		return cursor, nil
+	}
+
+	parsed, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		return nil, ErrHistoryCursor
+	}
+	cursor.ID = uint(parsed)
+	return cursor, nil
+}
+
+func (c HistoryCursor) String() string {
+	return strconv.FormatInt(c.Timestamp, 10) + "-" + strconv.FormatUint(uint64(c.ID), 10)
+}
+
+func MessageCursor(msg *Message) HistoryCursor {
+	return HistoryCursor{Timestamp: msg.Timestamp, ID: msg.ID}
+}
+
+// HistoryQuery selects one page of the delivered messages between two users.
+// With Before the page is newest first, with After it is oldest first. A
+// bare timestamp cursor has ID 0, so Before excludes that millisecond and
+// After includes it.
+type HistoryQuery struct {
+	UserUUID   string
+	FriendUUID string
+	Types      []string
+	Before     *HistoryCursor
+	After      *HistoryCursor
+	Limit      int
+}
+
+func (q HistoryQuery) ascending() bool {
+	return q.After != nil && q.Before == nil
+}
+
+func (q HistoryQuery) matches(msg *Message) bool {
+	if q.Before != nil && (msg.Timestamp > q.Before.Timestamp || (msg.Timestamp == q.Before.Timestamp && msg.ID >= q.Before.ID)) {
+		return false
+	}
+	if q.After != nil && (msg.Timestamp < q.After.Timestamp || (msg.Timestamp == q.After.Timestamp && msg.ID <= q.After.ID)) {
+		return false
+	}
+	return true
+}
+
+func sortHistory(messages []Message, ascending bool) {
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if a.Timestamp != b.Timestamp {
+			return (a.Timestamp < b.Timestamp) == ascending
+		}
+		return (a.ID < b.ID) == ascending
+	})
+}
@@ -0,0 +1,1060 @@
+package database
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type friendKey struct {
+	userUUID   string
+	friendUUID string
+}
+
+type deviceKey struct {
+	userUUID string
+	deviceID string
+}
+
+type envelopeKey struct {
+	userUUID string
+	deviceID string
+	receiver string
+}
+
+type deliveryKey struct {
+	messageID uint
+	userUUID  string
+	deviceID  string
+}
+
+type memberKey struct {
+	groupUUID string
+	userUUID  string
+}
+
+type receiptKey struct {
+	messageID uint
+	userUUID  string
+}
+
+// memoryStore keeps everything in process memory, it is meant for local
+// development and tests where no database server is available.
+type memoryStore struct {
+	mutex sync.RWMutex
+
+	users      []*User
+	friends    map[friendKey]*Friend
+	messages   []*Message
+	devices    map[deviceKey]*Device
+	deliveries map[deliveryKey]*MessageDelivery
+	signed     map[string]*SignedPrekey
+	oneTime    []*OneTimePrekey
+	groups     []*Group
+	members    map[memberKey]*GroupMember
+	receipts   map[receiptKey]*GroupReceipt
+	blobs      map[string]*Attachment
+	recipients map[string][]string
+	sessions   []*Session
+	nonces     map[string]*RecoveryNonce
+	identities []*IdentityKey
+	keychains  map[friendKey][]KeychainVersion
+	streams    map[friendKey]*Conversation
+	audits     []*AuditEvent
+	envelopes  map[envelopeKey]int64
+
+	userID    uint
+	messageID uint
+	prekeyID  uint
+	groupID   uint
+	blobID    uint
+	sessionID uint
+	keyID     uint
+	auditID   uint
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		friends:    make(map[friendKey]*Friend),
+		devices:    make(map[deviceKey]*Device),
+		deliveries: make(map[deliveryKey]*MessageDelivery),
+		signed:     make(map[string]*SignedPrekey),
+		members:    make(map[memberKey]*GroupMember),
+		receipts:   make(map[receiptKey]*GroupReceipt),
+		blobs:      make(map[string]*Attachment),
+		recipients: make(map[string][]string),
+		nonces:     make(map[string]*RecoveryNonce),
+		keychains:  make(map[friendKey][]KeychainVersion),
+		streams:    make(map[friendKey]*Conversation),
+		envelopes:  make(map[envelopeKey]int64),
+	}
+}
+
+func nowMilli() int64 {
+	return time.Now().UnixMilli()
+}
+
+func (s *memoryStore) CreateUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.users {
+		if item.UUID == user.UUID || item.Username == user.Username {
+			return ErrDuplicated
+		}
+	}
+
+	s.userID++
+	user.ID = s.userID
+	stored := *user
+	s.users = append(s.users, &stored)
+	return nil
+}
+
+func (s *memoryStore) FindUserByUUID(uuid string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, user := range s.users {
+		if user.UUID == uuid {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) FindUserByUsername(username string) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) ListUsers() ([]User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, *user)
+	}
+	return users, nil
+}
+
+func (s *memoryStore) UpdateUserCredentials(uuid, password, privateIV, privateKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.UUID == uuid {
+			user.Password = password
+			user.PrivateIV = privateIV
+			user.PrivateKey = privateKey
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateUserPassword(uuid, password string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.UUID == uuid {
+			user.Password = password
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateUserAvatar(uuid, avatarUrl string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.UUID == uuid {
+			user.AvatarUrl = avatarUrl
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateUserKeyAlgorithm(uuid, algorithm string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.UUID == uuid {
+			user.KeyAlgorithm = algorithm
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateFriend(friend *Friend) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := friendKey{friend.UserUUID, friend.FriendUUID}
+	if _, ok := s.friends[key]; ok {
+		return ErrDuplicated
+	}
+
+	stored := *friend
+	s.friends[key] = &stored
+	return nil
+}
+
+func (s *memoryStore) ListFriends(userUUID string) ([]Friend, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	friends := []Friend{}
+	for _, friend := range s.friends {
+		if friend.UserUUID == userUUID {
+			friends = append(friends, *friend)
+		}
+	}
+	sort.Slice(friends, func(i, j int) bool { return friends[i].FriendUUID < friends[j].FriendUUID })
+	return friends, nil
+}
+
+func (s *memoryStore) FindFriend(userUUID, friendUUID string) (*Friend, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if friend, ok := s.friends[friendKey{userUUID, friendUUID}]; ok {
+		found := *friend
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) UpdateFriendVerifiedKey(userUUID, friendUUID, fingerprint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if friend, ok := s.friends[friendKey{userUUID, friendUUID}]; ok {
+		friend.VerifiedKey = fingerprint
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveFriendKeychain(userUUID, friendUUID string, expected uint64, chainIV, chainKey string, historyLimit int) (*Friend, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := friendKey{userUUID, friendUUID}
+	friend, ok := s.friends[key]
+	if !ok {
+		return nil, false, ErrRecordNotFound
+	}
+	if friend.ChainVersion != expected {
+		found := *friend
+		return &found, false, nil
+	}
+
+	friend.ChainIV = chainIV
+	friend.ChainKey = chainKey
+	friend.ChainVersion = expected + 1
+
+	versions := append(s.keychains[key], KeychainVersion{
+		UserUUID:   userUUID,
+		FriendUUID: friendUUID,
+		Version:    friend.ChainVersion,
+		ChainIV:    chainIV,
+		ChainKey:   chainKey,
+		CreatedAt:  nowMilli(),
+	})
+	if len(versions) > historyLimit {
+		versions = versions[len(versions)-historyLimit:]
+	}
+	s.keychains[key] = versions
+
+	found := *friend
+	return &found, true, nil
+}
+
+func (s *memoryStore) ListKeychainVersions(userUUID, friendUUID string) ([]KeychainVersion, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stored := s.keychains[friendKey{userUUID, friendUUID}]
+	versions := make([]KeychainVersion, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		versions = append(versions, stored[i])
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) CreateMessage(msg *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.createMessage(msg)
+	return nil
+}
+
+func (s *memoryStore) CreateSequencedMessage(msg *Message, xRatchet, yRatchet, maxSkip int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := friendKey{msg.Sender, msg.Receiver}
+	conversation, ok := s.streams[key]
+	if !ok {
+		conversation = &Conversation{Sender: msg.Sender, Receiver: msg.Receiver}
+	}
+
+	// NOTE: 先在副本上推进，超出窗口时不改变已保存的状态
+	advanced := *conversation
+	skipped, err := advanced.advance(xRatchet, yRatchet, maxSkip)
+	if err != nil {
+		return skipped, err
+	}
+	s.streams[key] = &advanced
+
+	msg.Sequence = advanced.Sequence
+	s.createMessage(msg)
+	return skipped, nil
+}
+
+func (s *memoryStore) ListSequencedMessages(sender, receiver string, sequences []uint64) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	wanted := make(map[uint64]bool, len(sequences))
+	for _, sequence := range sequences {
+		wanted[sequence] = true
+	}
+
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if msg.Sender == sender && msg.Receiver == receiver && wanted[msg.Sequence] {
+			messages = append(messages, *msg)
+		}
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) createMessage(msg *Message) {
+	s.messageID++
+	msg.ID = s.messageID
+	if msg.Status == "" {
+		msg.Status = MessageQueued
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = nowMilli()
+	}
+	if msg.CreatedAt == 0 {
+		msg.CreatedAt = nowMilli()
+	}
+
+	stored := *msg
+	s.messages = append(s.messages, &stored)
+}
+
+func (s *memoryStore) findMessage(id uint) *Message {
+	index, found := slices.BinarySearchFunc(s.messages, id, func(msg *Message, id uint) int {
+		return cmp.Compare(msg.ID, id)
+	})
+	if !found {
+		return nil
+	}
+	return s.messages[index]
+}
+
+func (s *memoryStore) FindMessage(id uint) (*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if msg := s.findMessage(id); msg != nil {
+		found := *msg
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) FindUndeliveredMessage(sender, receiver, msgType string) (*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, msg := range s.messages {
+		if msg.Sender == sender && msg.Receiver == receiver && msg.Type == msgType && !msg.IsDelivered {
+			found := *msg
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) FindLatestMessage(sender, receiver string, types []string) (*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		msg := s.messages[i]
+		if msg.Sender == sender && msg.Receiver == receiver && slices.Contains(types, msg.Type) {
+			found := *msg
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) AckUndeliveredMessages(sender, receiver, msgType string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, msg := range s.messages {
+		if msg.Sender == sender && msg.Receiver == receiver && msg.Type == msgType && !msg.IsDelivered {
+			msg.IsDelivered = true
+			msg.Status = MessageAcked
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListConversation(userUUID, friendUUID string, types []string, limit int) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if !msg.IsDelivered || !slices.Contains(types, msg.Type) {
+			continue
+		}
+		if (msg.Sender == userUUID && msg.Receiver == friendUUID) || (msg.Sender == friendUUID && msg.Receiver == userUUID) {
+			messages = append(messages, *msg)
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp > messages[j].Timestamp })
+	if limit >= 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) ListHistory(query HistoryQuery) ([]Message, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if !msg.IsDelivered || !slices.Contains(query.Types, msg.Type) || !query.matches(msg) {
+			continue
+		}
+		if (msg.Sender == query.UserUUID && msg.Receiver == query.FriendUUID) || (msg.Sender == query.FriendUUID && msg.Receiver == query.UserUUID) {
+			messages = append(messages, *msg)
+		}
+	}
+
+	sortHistory(messages, query.ascending())
+	if len(messages) > query.Limit {
+		return messages[:query.Limit], true, nil
+	}
+	return messages, false, nil
+}
+
+func (s *memoryStore) ListDeviceMessages(device *Device) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if msg.Status == MessageExpired {
+			continue
+		}
+		if _, ok := s.deliveries[deliveryKey{msg.ID, device.UserUUID, device.DeviceID}]; ok {
+			continue
+		}
+
+		delivered := msg.IsDelivered
+		if msg.Receiver != device.UserUUID {
+			// 群组消息以成员为单位确认
+			member, ok := s.members[memberKey{msg.Receiver, device.UserUUID}]
+			if !ok || msg.ID <= member.Cursor || msg.Sender == device.UserUUID {
+				continue
+			}
+			_, delivered = s.receipts[receiptKey{msg.ID, device.UserUUID}]
+		}
+		if delivered && msg.ID <= device.Cursor {
+			continue
+		}
+		messages = append(messages, *msg)
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp < messages[j].Timestamp })
+	return messages, nil
+}
+
+func (s *memoryStore) MaxMessageID() (uint, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.messageID, nil
+}
+
+func (s *memoryStore) MarkMessageSent(id uint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if msg := s.findMessage(id); msg != nil && msg.Status == MessageQueued {
+		msg.Status = MessageSent
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memoryStore) MarkMessageAcked(id uint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if msg := s.findMessage(id); msg != nil && msg.Status != MessageAcked {
+		msg.IsDelivered = true
+		msg.Status = MessageAcked
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memoryStore) ListExpiredMessages(before int64) ([]Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	messages := []Message{}
+	for _, msg := range s.messages {
+		if msg.IsDelivered || (msg.Status != MessageQueued && msg.Status != MessageSent) {
+			continue
+		}
+		if msg.CreatedAt > 0 && msg.CreatedAt < before {
+			messages = append(messages, *msg)
+		}
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) MarkMessageExpired(id uint) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if msg := s.findMessage(id); msg != nil && !msg.IsDelivered {
+		msg.Status = MessageExpired
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memoryStore) FindDevice(userUUID, deviceID string) (*Device, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if device, ok := s.devices[deviceKey{userUUID, deviceID}]; ok {
+		found := *device
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) CreateDevice(device *Device) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := deviceKey{device.UserUUID, device.DeviceID}
+	if _, ok := s.devices[key]; ok {
+		return nil
+	}
+
+	if device.Timestamp == 0 {
+		device.Timestamp = nowMilli()
+	}
+	stored := *device
+	s.devices[key] = &stored
+	return nil
+}
+
+func (s *memoryStore) AdvancePublickeyEnvelope(envelope *PublickeyEnvelope) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := envelopeKey{envelope.UserUUID, envelope.DeviceID, envelope.Receiver}
+	if last, ok := s.envelopes[key]; ok && envelope.Timestamp <= last {
+		return false, nil
+	}
+	s.envelopes[key] = envelope.Timestamp
+	return true, nil
+}
+
+func (s *memoryStore) CreateMessageDelivery(delivery *MessageDelivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := deliveryKey{delivery.MessageID, delivery.UserUUID, delivery.DeviceID}
+	if _, ok := s.deliveries[key]; ok {
+		return nil
+	}
+
+	if delivery.Timestamp == 0 {
+		delivery.Timestamp = nowMilli()
+	}
+	stored := *delivery
+	s.deliveries[key] = &stored
+	return nil
+}
+
+func (s *memoryStore) SaveSignedPrekey(prekey *SignedPrekey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prekey.Timestamp = nowMilli()
+	stored := *prekey
+	s.signed[prekey.UserUUID] = &stored
+	return nil
+}
+
+func (s *memoryStore) FindSignedPrekey(userUUID string) (*SignedPrekey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if prekey, ok := s.signed[userUUID]; ok {
+		found := *prekey
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) CountOneTimePrekeys(userUUID string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var count int64
+	for _, prekey := range s.oneTime {
+		if prekey.UserUUID == userUUID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CreateOneTimePrekeys(prekeys []OneTimePrekey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range prekeys {
+		duplicated := slices.ContainsFunc(s.oneTime, func(prekey *OneTimePrekey) bool {
+			return prekey.UserUUID == prekeys[i].UserUUID && prekey.KeyID == prekeys[i].KeyID
+		})
+		if duplicated {
+			continue
+		}
+
+		s.prekeyID++
+		prekeys[i].ID = s.prekeyID
+		stored := prekeys[i]
+		s.oneTime = append(s.oneTime, &stored)
+	}
+	return nil
+}
+
+func (s *memoryStore) ConsumeOneTimePrekey(userUUID string) (*OneTimePrekey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, prekey := range s.oneTime {
+		if prekey.UserUUID == userUUID {
+			s.oneTime = slices.Delete(s.oneTime, i, i+1)
+			return prekey, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) CreateGroup(group *Group, members []GroupMember) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.groups {
+		if item.UUID == group.UUID {
+			return ErrDuplicated
+		}
+	}
+
+	s.groupID++
+	group.ID = s.groupID
+	if group.Timestamp == 0 {
+		group.Timestamp = nowMilli()
+	}
+	stored := *group
+	s.groups = append(s.groups, &stored)
+
+	for i := range members {
+		key := memberKey{members[i].GroupUUID, members[i].UserUUID}
+		if _, ok := s.members[key]; ok {
+			continue
+		}
+		if members[i].Timestamp == 0 {
+			members[i].Timestamp = nowMilli()
+		}
+		member := members[i]
+		s.members[key] = &member
+	}
+	return nil
+}
+
+func (s *memoryStore) FindGroup(uuid string) (*Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, group := range s.groups {
+		if group.UUID == uuid {
+			found := *group
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) ListUserGroups(userUUID string) ([]Group, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := []Group{}
+	for _, group := range s.groups {
+		if _, ok := s.members[memberKey{group.UUID, userUUID}]; ok {
+			groups = append(groups, *group)
+		}
+	}
+	return groups, nil
+}
+
+func (s *memoryStore) FindGroupMember(groupUUID, userUUID string) (*GroupMember, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if member, ok := s.members[memberKey{groupUUID, userUUID}]; ok {
+		found := *member
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) ListGroupMembers(groupUUID string) ([]GroupMember, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	members := []GroupMember{}
+	for _, member := range s.members {
+		if member.GroupUUID == groupUUID {
+			members = append(members, *member)
+		}
+	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Timestamp < members[j].Timestamp })
+	return members, nil
+}
+
+func (s *memoryStore) AddGroupMember(member *GroupMember) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := memberKey{member.GroupUUID, member.UserUUID}
+	if _, ok := s.members[key]; ok {
+		return ErrDuplicated
+	}
+
+	if member.Timestamp == 0 {
+		member.Timestamp = nowMilli()
+	}
+	stored := *member
+	s.members[key] = &stored
+	return nil
+}
+
+func (s *memoryStore) RemoveGroupMember(groupUUID, userUUID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.members, memberKey{groupUUID, userUUID})
+	return nil
+}
+
+func (s *memoryStore) CreateGroupReceipt(receipt *GroupReceipt) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := receiptKey{receipt.MessageID, receipt.UserUUID}
+	if _, ok := s.receipts[key]; ok {
+		return false, nil
+	}
+
+	if receipt.Timestamp == 0 {
+		receipt.Timestamp = nowMilli()
+	}
+	stored := *receipt
+	s.receipts[key] = &stored
+	return true, nil
+}
+
+func (s *memoryStore) CountGroupReceipts(messageID uint) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var count int64
+	for key := range s.receipts {
+		if key.messageID == messageID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) CreateAttachment(attachment *Attachment, recipients []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.blobs[attachment.UUID]; ok {
+		return ErrDuplicated
+	}
+
+	s.blobID++
+	attachment.ID = s.blobID
+	if attachment.Timestamp == 0 {
+		attachment.Timestamp = nowMilli()
+	}
+	stored := *attachment
+	s.blobs[attachment.UUID] = &stored
+
+	unique := []string{}
+	for _, recipient := range recipients {
+		if !slices.Contains(unique, recipient) {
+			unique = append(unique, recipient)
+		}
+	}
+	s.recipients[attachment.UUID] = unique
+	return nil
+}
+
+func (s *memoryStore) FindAttachment(uuid string) (*Attachment, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if attachment, ok := s.blobs[uuid]; ok {
+		found := *attachment
+		return &found, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) ListAttachmentRecipients(uuid string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return slices.Clone(s.recipients[uuid]), nil
+}
+
+func (s *memoryStore) CompleteAttachment(uuid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if attachment, ok := s.blobs[uuid]; ok {
+		attachment.Completed = true
+	}
+	return nil
+}
+
+func (s *memoryStore) SumAttachmentSize(owner string) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var total int64
+	for _, attachment := range s.blobs {
+		if attachment.Owner == owner {
+			total += attachment.Size
+		}
+	}
+	return total, nil
+}
+
+func (s *memoryStore) CreateSession(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, item := range s.sessions {
+		if item.UUID == session.UUID || item.RefreshHash == session.RefreshHash {
+			return ErrDuplicated
+		}
+	}
+
+	s.sessionID++
+	session.ID = s.sessionID
+	if session.CreatedAt == 0 {
+		session.CreatedAt = nowMilli()
+	}
+	stored := *session
+	s.sessions = append(s.sessions, &stored)
+	return nil
+}
+
+func (s *memoryStore) FindSession(uuid string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, session := range s.sessions {
+		if session.UUID == uuid {
+			found := *session
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) FindSessionByRefreshHash(hash string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, session := range s.sessions {
+		if session.RefreshHash == hash || session.PreviousHash == hash {
+			found := *session
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (s *memoryStore) RotateSession(uuid, oldHash, newHash string, expiresAt int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.sessions {
+		if session.UUID == uuid && session.RefreshHash == oldHash && !session.Revoked {
+			session.PreviousHash = oldHash
+			session.RefreshHash = newHash
+			session.ExpiresAt = expiresAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) RevokeSession(uuid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.sessions {
+		if session.UUID == uuid {
+			session.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RevokeUserSessions(userUUID string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	uuids := []string{}
+	for _, session := range s.sessions {
+		if session.UserUUID == userUUID && !session.Revoked {
+			session.Revoked = true
+			uuids = append(uuids, session.UUID)
+		}
+	}
+	return uuids, nil
+}
+
+func (s *memoryStore) CreateRecoveryNonce(nonce *RecoveryNonce) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := nowMilli()
+	for hash, item := range s.nonces {
+		if item.ExpiresAt <= now {
+			delete(s.nonces, hash)
+		}
+	}
+
+	if _, ok := s.nonces[nonce.Hash]; ok {
+		return ErrDuplicated
+	}
+	stored := *nonce
+	s.nonces[nonce.Hash] = &stored
+	return nil
+}
+
+func (s *memoryStore) ConsumeRecoveryNonce(hash, username string, now int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nonce, ok := s.nonces[hash]
+	if !ok || nonce.Username != username {
+		return false, nil
+	}
+	delete(s.nonces, hash)
+	return nonce.ExpiresAt > now, nil
+}
+
+func (s *memoryStore) createIdentityKey(key *IdentityKey) {
+	s.keyID++
+	key.ID = s.keyID
+	if key.CreatedAt == 0 {
+		key.CreatedAt = nowMilli()
+	}
+	stored := *key
+	s.identities = append(s.identities, &stored)
+}
+
+func (s *memoryStore) CreateIdentityKey(key *IdentityKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.createIdentityKey(key)
+	return nil
+}
+
+func (s *memoryStore) RotateIdentityKey(key *IdentityKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, user := range s.users {
+		if user.UUID == key.UserUUID {
+			user.PublicKey = key.PublicKey
+			user.KeyAlgorithm = key.KeyAlgorithm
+		}
+	}
+	s.createIdentityKey(key)
+	return nil
+}
+
+func (s *memoryStore) ListIdentityKeys(userUUID string) ([]IdentityKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := []IdentityKey{}
+	for _, key := range s.identities {
+		if key.UserUUID == userUUID {
+			keys = append(keys, *key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) CreateAuditEvent(event *AuditEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.auditID++
+	event.ID = s.auditID
+	if event.CreatedAt == 0 {
+		event.CreatedAt = nowMilli()
+	}
+	stored := *event
+	s.audits = append(s.audits, &stored)
+	return nil
+}
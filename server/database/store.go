@@ -0,0 +1,186 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"double-ratchet-server/config"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrDuplicated     = errors.New("record already exists")
+	ErrSkipWindow     = errors.New("ratchet skip window exceeded")
+	ErrRatchetInvalid = errors.New("invalid ratchet position")
+)
+
+type UserStore interface {
+	CreateUser(user *User) error
+	FindUserByUUID(uuid string) (*User, error)
+	FindUserByUsername(username string) (*User, error)
+	ListUsers() ([]User, error)
+	UpdateUserCredentials(uuid, password, privateIV, privateKey string) error
+	UpdateUserPassword(uuid, password string) error
+	UpdateUserAvatar(uuid, avatarUrl string) error
+	// UpdateUserKeyAlgorithm records the identity key algorithm of users
+	// registered before it was stored.
+	UpdateUserKeyAlgorithm(uuid, algorithm string) error
+}
+
+type FriendStore interface {
+	CreateFriend(friend *Friend) error
+	ListFriends(userUUID string) ([]Friend, error)
+	FindFriend(userUUID, friendUUID string) (*Friend, error)
+	// SaveFriendKeychain writes the keychain as version expected+1 only if
+	// the stored version is still expected, otherwise it returns the current
+	// row and false. Only the newest historyLimit versions are kept.
+	SaveFriendKeychain(userUUID, friendUUID string, expected uint64, chainIV, chainKey string, historyLimit int) (*Friend, bool, error)
+	// ListKeychainVersions returns the kept versions, newest first.
+	ListKeychainVersions(userUUID, friendUUID string) ([]KeychainVersion, error)
+	UpdateFriendVerifiedKey(userUUID, friendUUID, fingerprint string) error
+}
+
+type MessageStore interface {
+	CreateMessage(msg *Message) error
+	// CreateSequencedMessage stores msg with the next sequence number of the
+	// conversation from its sender to its receiver. It returns ErrSkipWindow
+	// when the ratchet position skips more than maxSkip message keys,
+	// ErrRatchetInvalid for a negative position, and otherwise how many keys
+	// were skipped.
+	CreateSequencedMessage(msg *Message, xRatchet, yRatchet, maxSkip int64) (int64, error)
+	// ListSequencedMessages returns the messages of one conversation with the
+	// given sequence numbers.
+	ListSequencedMessages(sender, receiver string, sequences []uint64) ([]Message, error)
+	FindMessage(id uint) (*Message, error)
+	// FindUndeliveredMessage returns a pending request such as event_addfriend.
+	FindUndeliveredMessage(sender, receiver, msgType string) (*Message, error)
+	// AckUndeliveredMessages resolves pending requests once they are answered.
+	AckUndeliveredMessages(sender, receiver, msgType string) error
+	// FindLatestMessage returns the newest message of one of the types from
+	// sender to receiver, whatever its delivery status.
+	FindLatestMessage(sender, receiver string, types []string) (*Message, error)
+	// ListConversation returns delivered messages between two users, newest first.
+	ListConversation(userUUID, friendUUID string, types []string, limit int) ([]Message, error)
+	// ListHistory returns one page of a conversation and whether another page
+	// follows in the same direction.
+	ListHistory(query HistoryQuery) ([]Message, bool, error)
+	// ListDeviceMessages returns what a device still has to receive, including
+	// the messages of its groups, oldest first.
+	ListDeviceMessages(device *Device) ([]Message, error)
+	MaxMessageID() (uint, error)
+	// MarkMessageSent moves a message from queued to sent, reporting whether it moved.
+	MarkMessageSent(id uint) (bool, error)
+	// MarkMessageAcked flags a message delivered, reporting whether it was not yet acked.
+	MarkMessageAcked(id uint) (bool, error)
+	// ListExpiredMessages lists undelivered messages the server stored before
+	// before, the client supplied timestamp plays no part.
+	ListExpiredMessages(before int64) ([]Message, error)
+	MarkMessageExpired(id uint) (bool, error)
+}
+
+type DeviceStore interface {
+	FindDevice(userUUID, deviceID string) (*Device, error)
+	// CreateDevice keeps the existing row when the device is already known.
+	CreateDevice(device *Device) error
+	// CreateMessageDelivery ignores acks that were already recorded.
+	CreateMessageDelivery(delivery *MessageDelivery) error
+	// AdvancePublickeyEnvelope records the timestamp of a change_publickey
+	// envelope, false means it is not newer than the last one accepted.
+	AdvancePublickeyEnvelope(envelope *PublickeyEnvelope) (bool, error)
+}
+
+type PrekeyStore interface {
+	SaveSignedPrekey(prekey *SignedPrekey) error
+	FindSignedPrekey(userUUID string) (*SignedPrekey, error)
+	CountOneTimePrekeys(userUUID string) (int64, error)
+	// CreateOneTimePrekeys ignores key ids the user already uploaded.
+	CreateOneTimePrekeys(prekeys []OneTimePrekey) error
+	// ConsumeOneTimePrekey atomically removes and returns the oldest prekey,
+	// or nil when the pool is empty.
+	ConsumeOneTimePrekey(userUUID string) (*OneTimePrekey, error)
+}
+
+type GroupStore interface {
+	// CreateGroup stores the group together with its initial members.
+	CreateGroup(group *Group, members []GroupMember) error
+	FindGroup(uuid string) (*Group, error)
+	ListUserGroups(userUUID string) ([]Group, error)
+	FindGroupMember(groupUUID, userUUID string) (*GroupMember, error)
+	ListGroupMembers(groupUUID string) ([]GroupMember, error)
+	AddGroupMember(member *GroupMember) error
+	RemoveGroupMember(groupUUID, userUUID string) error
+	// CreateGroupReceipt reports whether this is the first ack of the member.
+	CreateGroupReceipt(receipt *GroupReceipt) (bool, error)
+	CountGroupReceipts(messageID uint) (int64, error)
+}
+
+type AttachmentStore interface {
+	CreateAttachment(attachment *Attachment, recipients []string) error
+	FindAttachment(uuid string) (*Attachment, error)
+	ListAttachmentRecipients(uuid string) ([]string, error)
+	CompleteAttachment(uuid string) error
+	// SumAttachmentSize returns the declared size of every blob the user owns.
+	SumAttachmentSize(owner string) (int64, error)
+}
+
+type SessionStore interface {
+	CreateSession(session *Session) error
+	FindSession(uuid string) (*Session, error)
+	// FindSessionByRefreshHash matches the current or the previous refresh token.
+	FindSessionByRefreshHash(hash string) (*Session, error)
+	// RotateSession swaps the refresh token only if oldHash is still current.
+	RotateSession(uuid, oldHash, newHash string, expiresAt int64) (bool, error)
+	RevokeSession(uuid string) error
+	// RevokeUserSessions revokes every live session and returns their uuids.
+	RevokeUserSessions(userUUID string) ([]string, error)
+}
+
+type IdentityKeyStore interface {
+	CreateIdentityKey(key *IdentityKey) error
+	// RotateIdentityKey replaces the public key of the user and appends it to
+	// the history in one step.
+	RotateIdentityKey(key *IdentityKey) error
+	// ListIdentityKeys returns the history of the user, oldest first.
+	ListIdentityKeys(userUUID string) ([]IdentityKey, error)
+}
+
+type RecoveryStore interface {
+	// CreateRecoveryNonce also purges every nonce that has expired.
+	CreateRecoveryNonce(nonce *RecoveryNonce) error
+	// ConsumeRecoveryNonce deletes the nonce and reports whether it was still
+	// valid for the username, so each nonce is accepted at most once.
+	ConsumeRecoveryNonce(hash, username string, now int64) (bool, error)
+}
+
+type AuditStore interface {
+	CreateAuditEvent(event *AuditEvent) error
+}
+
+type Store interface {
+	UserStore
+	FriendStore
+	MessageStore
+	DeviceStore
+	PrekeyStore
+	GroupStore
+	AttachmentStore
+	SessionStore
+	RecoveryStore
+	IdentityKeyStore
+	AuditStore
+}
+
+// Open creates the store selected by DATABASE_DRIVER.
+func Open() (Store, error) {
+	switch config.DATABASE_DRIVER {
+	case "mysql":
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local", config.MYSQL_USER, config.MYSQL_SECRET, config.MYSQL_HOST, config.MYSQL_PORT, config.MYSQL_DATABASE)
+		return OpenMySQL(dsn)
+	case "sqlite":
+		return OpenSQLite(config.SQLITE_PATH)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver: %s", config.DATABASE_DRIVER)
+	}
+}
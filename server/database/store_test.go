@@ -0,0 +1,226 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns every backend that runs without an external server.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	sqlite, err := OpenSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryStore(), "sqlite": sqlite}
+}
+
+func TestExpiryIgnoresClientTimestamp(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// NOTE: 客户端时间戳远早于过期时间，但消息刚刚存入，不能过期
+			backdated := Message{Type: "text", Sender: "alice", Receiver: "bob", Timestamp: 1}
+			if err := store.CreateMessage(&backdated); err != nil {
+				t.Fatal(err)
+			}
+
+			expired, err := store.ListExpiredMessages(time.Now().Add(-time.Minute).UnixMilli())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expired) != 0 {
+				t.Fatalf("backdated message expired on its client timestamp: %+v", expired)
+			}
+
+			expired, err = store.ListExpiredMessages(time.Now().Add(time.Minute).UnixMilli())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expired) != 1 || expired[0].ID != backdated.ID || expired[0].Timestamp != 1 {
+				t.Fatalf("expired = %+v, want message %d with its client timestamp", expired, backdated.ID)
+			}
+		})
+	}
+}
+
+func TestSaveFriendKeychainVersions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.CreateFriend(&Friend{UserUUID: "alice", FriendUUID: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+
+			friend, saved, err := store.SaveFriendKeychain("alice", "bob", 0, "iv1", "key1", 2)
+			if err != nil || !saved || friend.ChainVersion != 1 {
+				t.Fatalf("first write = %+v, %v, %v", friend, saved, err)
+			}
+
+			// a second device based its write on the same version
+			friend, saved, err = store.SaveFriendKeychain("alice", "bob", 0, "iv2", "key2", 2)
+			if err != nil || saved {
+				t.Fatalf("stale write = %v, %v, want a conflict", saved, err)
+			}
+			if friend.ChainVersion != 1 || friend.ChainKey != "key1" {
+				t.Fatalf("stale write returned version %d %q, want the stored version 1", friend.ChainVersion, friend.ChainKey)
+			}
+
+			for version := uint64(1); version < 4; version++ {
+				if _, saved, err := store.SaveFriendKeychain("alice", "bob", version, "iv", fmt.Sprintf("key%d", version+1), 2); err != nil || !saved {
+					t.Fatalf("write on version %d = %v, %v", version, saved, err)
+				}
+			}
+			versions, err := store.ListKeychainVersions("alice", "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 3 {
+				t.Fatalf("kept versions %+v, want 4 and 3", versions)
+			}
+		})
+	}
+}
+
+func TestSaveFriendKeychainConcurrent(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.CreateFriend(&Friend{UserUUID: "alice", FriendUUID: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			results := make(chan bool, 8)
+			for i := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, saved, err := store.SaveFriendKeychain("alice", "bob", 0, "iv", fmt.Sprintf("key%d", i), 10)
+					if err != nil {
+						t.Error(err)
+					}
+					results <- saved
+				}()
+			}
+			wg.Wait()
+			close(results)
+
+			writes := 0
+			for saved := range results {
+				if saved {
+					writes++
+				}
+			}
+			if writes != 1 {
+				t.Fatalf("%d writes based on version 0 succeeded, want 1", writes)
+			}
+			if friend, err := store.FindFriend("alice", "bob"); err != nil || friend.ChainVersion != 1 {
+				t.Fatalf("stored version = %+v, %v, want 1", friend, err)
+			}
+		})
+	}
+}
+
+func TestCreateSequencedMessageSkipWindow(t *testing.T) {
+	tests := []struct {
+		x, y    int64
+		skipped int64
+		err     error
+	}{
+		{0, 0, 0, nil},
+		{0, 1, 0, nil},
+		{0, 4, 2, nil},
+		{0, 11, 6, ErrSkipWindow},
+		{0, 10, 5, nil},
+		// a late message behind the newest position does not move it
+		{0, 3, 0, nil},
+		{0, -100, 0, ErrRatchetInvalid},
+		{-1, 0, 0, ErrRatchetInvalid},
+		// the rejected positions left the conversation at 0/10
+		{0, 11, 0, nil},
+		{1, 5, 5, nil},
+		{2, 6, 6, ErrSkipWindow},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			sequence := uint64(0)
+			for _, test := range tests {
+				msg := Message{Type: "text", Sender: "alice", Receiver: "bob"}
+				skipped, err := store.CreateSequencedMessage(&msg, test.x, test.y, 5)
+				if !errors.Is(err, test.err) || skipped != test.skipped {
+					t.Fatalf("position %d/%d = (%d, %v), want (%d, %v)", test.x, test.y, skipped, err, test.skipped, test.err)
+				}
+				if err != nil {
+					continue
+				}
+
+				sequence++
+				if msg.Sequence != sequence {
+					t.Fatalf("position %d/%d got sequence %d, want %d", test.x, test.y, msg.Sequence, sequence)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			session := Session{UUID: "session", UserUUID: "alice", RefreshHash: "first", ExpiresAt: time.Now().Add(time.Hour).UnixMilli()}
+			if err := store.CreateSession(&session); err != nil {
+				t.Fatal(err)
+			}
+
+			if rotated, err := store.RotateSession(session.UUID, "first", "second", session.ExpiresAt); err != nil || !rotated {
+				t.Fatalf("rotate = %v, %v", rotated, err)
+			}
+			// a concurrent refresh with the same token lost the race
+			if rotated, err := store.RotateSession(session.UUID, "first", "third", session.ExpiresAt); err != nil || rotated {
+				t.Fatalf("rotate with the previous token = %v, %v, want false", rotated, err)
+			}
+
+			// the previous token still finds the session, so its reuse is detected
+			found, err := store.FindSessionByRefreshHash("first")
+			if err != nil || found.UUID != session.UUID || found.RefreshHash != "second" {
+				t.Fatalf("find by previous hash = %+v, %v", found, err)
+			}
+			if _, err := store.FindSessionByRefreshHash("third"); !errors.Is(err, ErrRecordNotFound) {
+				t.Fatalf("find by unknown hash = %v, want ErrRecordNotFound", err)
+			}
+		})
+	}
+}
+
+func TestAdvancePublickeyEnvelope(t *testing.T) {
+	tests := []struct {
+		deviceID string
+		receiver string
+		time     int64
+		accepted bool
+	}{
+		{"laptop", "bob", 100, true},
+		{"laptop", "bob", 100, false},
+		{"laptop", "bob", 99, false},
+		{"laptop", "bob", 101, true},
+		// the last timestamp is kept per device and receiver
+		{"phone", "bob", 50, true},
+		{"laptop", "carol", 50, true},
+		{"laptop", "bob", 101, false},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, test := range tests {
+				envelope := PublickeyEnvelope{UserUUID: "alice", DeviceID: test.deviceID, Receiver: test.receiver, Timestamp: test.time}
+				accepted, err := store.AdvancePublickeyEnvelope(&envelope)
+				if err != nil || accepted != test.accepted {
+					t.Fatalf("%s to %s at %d = %v, %v, want %v", test.deviceID, test.receiver, test.time, accepted, err, test.accepted)
+				}
+			}
+		})
+	}
+}
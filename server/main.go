@@ -6,29 +6,56 @@ import (
 	"net/http"
 	"time"
 
+	"double-ratchet-server/blob"
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratelimit"
 	"double-ratchet-server/server"
+	"double-ratchet-server/utils"
 )
 
-func startServiceServer() {
+func startServiceServer(serviceServer *http.Server) {
 	log.Println("Service server is running...")
 
-	if err := server.ServiceServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := serviceServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Printf("Start Service Server Error: %s\n", err)
 	}
 }
 
-func stopServiceServer() {
+func stopServiceServer(serviceServer *http.Server) {
 	log.Println("Service server is stopping...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
-	if err := server.ServiceServer.Shutdown(ctx); err != nil {
+	if err := serviceServer.Shutdown(ctx); err != nil {
 		log.Printf("Stop Service Server Error: %s\n", err)
 	}
 }
 
 func main() {
-	defer stopServiceServer()
-	startServiceServer()
+	if err := config.Validate(); err != nil {
+		log.Fatalf("invalid config: %s\n", err)
+	}
+
+	keySet, err := utils.LoadKeySet()
+	if err != nil {
+		log.Fatalf("load jwt keyset error: %s\n", err)
+	}
+	go keySet.RunRotation(config.JWT_ROTATION_INTERVAL)
+
+	store, err := database.Open()
+	if err != nil {
+		log.Fatalf("open database error: %s\n", err)
+	}
+
+	blobs, err := blob.NewLocalStore(config.ATTACHMENT_PATH)
+	if err != nil {
+		log.Fatalf("open attachment storage error: %s\n", err)
+	}
+
+	serviceServer := server.NewServiceServer(store, blobs, ratelimit.NewMemoryBackend())
+
+	defer stopServiceServer(serviceServer)
+	startServiceServer(serviceServer)
 }
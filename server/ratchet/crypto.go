@@ -0,0 +1,175 @@
+package ratchet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// NOTE: 与客户端 WebCrypto 参数保持一致
+const (
+	chainKeySize = 32
+	contentIVLen = 16
+)
+
+var (
+	ErrInvalidPEM        = errors.New("ratchet: invalid pem encoded key")
+	ErrInvalidKeyType    = errors.New("ratchet: key is not an ECDH P-256 key")
+	ErrInvalidCiphertext = errors.New("ratchet: invalid ciphertext")
+)
+
+var pemLineRegexp = regexp.MustCompile(`.{1,64}`)
+
+// DeriveChainKey mirrors the client's deriveChainKey: HKDF-SHA256 with an
+// empty info, 64 bytes of output split into a left and a right half.
+func DeriveChainKey(key, salt []byte) ([]byte, []byte, error) {
+	derived, err := hkdf.Key(sha256.New, key, salt, "", 2*chainKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derived[:chainKeySize], derived[chainKeySize:], nil
+}
+
+// CalcSharedSecret mirrors the client's calcSharedSecret (ECDH P-256 deriveBits).
+func CalcSharedSecret(privateKey *ecdh.PrivateKey, publicKey *ecdh.PublicKey) ([]byte, error) {
+	return privateKey.ECDH(publicKey)
+}
+
+// CalcSecretKey mirrors the client's calcSecretKey, which protects the
+// identity key and the ratchet keychain stored on the server.
+func CalcSecretKey(username, password string) ([]byte, error) {
+	secretKey, _, err := DeriveChainKey([]byte(username), []byte(password))
+	return secretKey, err
+}
+
+func GenerateKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+func EncryptWithAESGCM(key, plaintext []byte) ([]byte, []byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := make([]byte, contentIVLen)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
+	}
+
+	return iv, aead.Seal(nil, iv, plaintext, nil), nil
+}
+
+func DecryptWithAESGCM(key, iv, ciphertext []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return aead.Open(nil, iv, ciphertext, nil)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, contentIVLen)
+}
+
+// ExportPublicKey encodes the key the way the client does: base64 over a
+// SPKI PEM document wrapped at 64 columns without a trailing newline.
+func ExportPublicKey(publicKey *ecdh.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(exportPem(der, false))), nil
+}
+
+func ExportPrivateKey(privateKey *ecdh.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(exportPem(der, true))), nil
+}
+
+func ImportPublicKey(encoded string) (*ecdh.PublicKey, error) {
+	der, err := importPem(encoded, false)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, ErrInvalidKeyType
+	}
+	return ecdsaKey.ECDH()
+}
+
+func ImportPrivateKey(encoded string) (*ecdh.PrivateKey, error) {
+	der, err := importPem(encoded, true)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecdsaKey.Curve != elliptic.P256() {
+		return nil, ErrInvalidKeyType
+	}
+	return ecdsaKey.ECDH()
+}
+
+func exportPem(der []byte, isPrivate bool) string {
+	pemHead := "PUBLIC"
+	if isPrivate {
+		pemHead = "PRIVATE"
+	}
+
+	formatted := strings.Join(pemLineRegexp.FindAllString(base64.StdEncoding.EncodeToString(der), -1), "\n")
+	return "-----BEGIN " + pemHead + " KEY-----\n" + formatted + "\n-----END " + pemHead + " KEY-----"
+}
+
+func importPem(encoded string, isPrivate bool) ([]byte, error) {
+	pemBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	pemType := "PUBLIC KEY"
+	if isPrivate {
+		pemType = "PRIVATE KEY"
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != pemType {
+		return nil, ErrInvalidPEM
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,244 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrInvalidRatchetIndex = errors.New("ratchet: invalid x_ratchet or y_ratchet")
+
+// MaxSkip bounds how many message keys Decrypt derives ahead of a receiving
+// chain, it matches the default MESSAGE_MAX_SKIP of the server.
+const MaxSkip = 1000
+
+// Payload has the same JSON layout as websocket.WSTextData.
+type Payload struct {
+	Content   string `json:"content"`
+	ContentIV string `json:"content_iv"`
+	XRatchet  int64  `json:"x_ratchet"`
+	YRatchet  int64  `json:"y_ratchet"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// NewState builds the initial state after the event_addfriend/event_allowfriend
+// exchange: both sides contribute a base key pair and a salt key pair.
+func NewState(localBase, localSalt *ecdh.PrivateKey, remoteBase, remoteSalt *ecdh.PublicKey) (*State, error) {
+	baseSecret, err := CalcSharedSecret(localBase, remoteBase)
+	if err != nil {
+		return nil, err
+	}
+
+	saltSecret, err := CalcSharedSecret(localSalt, remoteSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	outputKey, messageKey, err := DeriveChainKey(baseSecret, saltSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &State{
+		PublicKey:  remoteSalt,
+		PrivateKey: localSalt,
+		RootChain: []DerivationRecord{{
+			BaseKey:    hex.EncodeToString(baseSecret),
+			SaltKey:    hex.EncodeToString(saltSecret),
+			OutputKey:  hex.EncodeToString(outputKey),
+			MessageKey: hex.EncodeToString(messageKey),
+		}},
+		SendChain: [][]DerivationRecord{},
+		RecvChain: [][]DerivationRecord{},
+	}, nil
+}
+
+// SetRemotePublicKey applies a change_publickey frame from the peer.
+func (s *State) SetRemotePublicKey(publicKey *ecdh.PublicKey) {
+	s.PublicKey = publicKey
+}
+
+// Encrypt follows the client's handleSendMessage. When the DH ratchet turns
+// over, the new local public key is returned and must be sent to the peer as
+// a change_publickey frame before the text frame.
+func (s *State) Encrypt(plaintext []byte) (*Payload, *ecdh.PublicKey, error) {
+	next := s.clone()
+
+	var announced *ecdh.PublicKey
+	if next.Type == "" {
+		next.Type = TypeSender
+		next.SendChain = append(next.SendChain, []DerivationRecord{{BaseKey: next.rootRecord().MessageKey}})
+	}
+
+	if next.Type == TypeSender {
+		if len(next.SendChain) == len(next.RecvChain) {
+			if err := next.stepRoot(next.PrivateKey, &next.SendChain); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else if len(next.SendChain) != len(next.RecvChain) {
+		privateKey, err := GenerateKeyPair()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		next.PrivateKey = privateKey
+		announced = privateKey.PublicKey()
+
+		if err := next.stepRoot(next.PrivateKey, &next.SendChain); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	xIndex := len(next.SendChain) - 1
+	yIndex := len(next.SendChain[xIndex]) - 1
+
+	chain, err := stepChain(next.SendChain[xIndex])
+	if err != nil {
+		return nil, nil, err
+	}
+	next.SendChain[xIndex] = chain
+
+	messageKey, err := hex.DecodeString(chain[yIndex].MessageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv, ciphertext, err := EncryptWithAESGCM(messageKey, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	*s = *next
+	return &Payload{
+		Content:   base64.StdEncoding.EncodeToString(ciphertext),
+		ContentIV: base64.StdEncoding.EncodeToString(iv),
+		XRatchet:  int64(xIndex),
+		YRatchet:  int64(yIndex),
+		Timestamp: time.Now().UnixMilli(),
+	}, announced, nil
+}
+
+// Decrypt follows the client's handleRecvMessage. Like Encrypt, a non-nil
+// public key must be announced to the peer with a change_publickey frame.
+func (s *State) Decrypt(payload *Payload) ([]byte, *ecdh.PublicKey, error) {
+	next := s.clone()
+
+	var announced *ecdh.PublicKey
+	if next.Type == "" {
+		next.Type = TypeReceiver
+		next.RecvChain = append(next.RecvChain, []DerivationRecord{{BaseKey: next.rootRecord().MessageKey}})
+	}
+
+	if next.Type == TypeReceiver {
+		if len(next.SendChain) == len(next.RecvChain) {
+			if err := next.stepRoot(next.PrivateKey, &next.RecvChain); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else if len(next.SendChain) != len(next.RecvChain) {
+		if err := next.stepRoot(next.PrivateKey, &next.RecvChain); err != nil {
+			return nil, nil, err
+		}
+
+		privateKey, err := GenerateKeyPair()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		next.PrivateKey = privateKey
+		announced = privateKey.PublicKey()
+	}
+
+	if payload.XRatchet < 0 || payload.XRatchet >= int64(len(next.RecvChain)) || payload.YRatchet < 0 {
+		return nil, nil, ErrInvalidRatchetIndex
+	}
+
+	if payload.YRatchet-int64(len(next.RecvChain[payload.XRatchet])) > MaxSkip {
+		return nil, nil, ErrInvalidRatchetIndex
+	}
+
+	xIndex, yIndex := int(payload.XRatchet), int(payload.YRatchet)
+	for yIndex >= len(next.RecvChain[xIndex]) || next.RecvChain[xIndex][yIndex].MessageKey == "" {
+		chain, err := stepChain(next.RecvChain[xIndex])
+		if err != nil {
+			return nil, nil, err
+		}
+		next.RecvChain[xIndex] = chain
+	}
+
+	messageKey, err := hex.DecodeString(next.RecvChain[xIndex][yIndex].MessageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv, err := base64.StdEncoding.DecodeString(payload.ContentIV)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(payload.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := DecryptWithAESGCM(messageKey, iv, ciphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	*s = *next
+	return plaintext, announced, nil
+}
+
+func (s *State) rootRecord() DerivationRecord {
+	return s.RootChain[len(s.RootChain)-1]
+}
+
+// stepRoot advances the root chain with a fresh DH output and opens a new
+// sending or receiving chain seeded with the resulting message key.
+func (s *State) stepRoot(privateKey *ecdh.PrivateKey, chains *[][]DerivationRecord) error {
+	sharedSecret, err := CalcSharedSecret(privateKey, s.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	last := s.rootRecord()
+	baseKey, err := hex.DecodeString(last.OutputKey)
+	if err != nil {
+		return err
+	}
+
+	outputKey, messageKey, err := DeriveChainKey(baseKey, sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	s.RootChain = append(s.RootChain, DerivationRecord{
+		BaseKey:    last.OutputKey,
+		SaltKey:    hex.EncodeToString(sharedSecret),
+		OutputKey:  hex.EncodeToString(outputKey),
+		MessageKey: hex.EncodeToString(messageKey),
+	})
+	*chains = append(*chains, []DerivationRecord{{BaseKey: hex.EncodeToString(messageKey)}})
+	return nil
+}
+
+func stepChain(chain []DerivationRecord) ([]DerivationRecord, error) {
+	last := len(chain) - 1
+	baseKey, err := hex.DecodeString(chain[last].BaseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	outputKey, messageKey, err := DeriveChainKey(baseKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	chain[last].OutputKey = hex.EncodeToString(outputKey)
+	chain[last].MessageKey = hex.EncodeToString(messageKey)
+	return append(chain, DerivationRecord{BaseKey: hex.EncodeToString(outputKey)}), nil
+}
@@ -0,0 +1,263 @@
+package ratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"double-ratchet-server/signature"
+)
+
+// chainKeyVectors are known answers for the client's deriveChainKey. The
+// first one is RFC 5869 test case 3, which WebCrypto HKDF reproduces.
+var chainKeyVectors = []struct {
+	name     string
+	key      string
+	salt     string
+	leftKey  string
+	rightKey string
+}{
+	{
+		name:     "rfc5869 empty salt",
+		key:      "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+		salt:     "",
+		leftKey:  "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d",
+		rightKey: "9d201395faa4b61a96c8b2fb61057244b36c6ddd287f634795e7d80d5fe26bfc",
+	},
+	{
+		name:     "root chain from rfc5903 secret",
+		key:      "d6840f6b42f6edafd13116e0e12565202fef8e9ece7dce03812464d04b9442de",
+		salt:     "d6840f6b42f6edafd13116e0e12565202fef8e9ece7dce03812464d04b9442de",
+		leftKey:  "e7d0192339e2130dcb74ea689e3d6b4105e70ec3489e636b0427de4021719e79",
+		rightKey: "d0fd8327f5518c8888da4f68eb9b975f457b56d963ff098899cb4ef80d0ac437",
+	},
+	{
+		name:     "message chain step",
+		key:      "d0fd8327f5518c8888da4f68eb9b975f457b56d963ff098899cb4ef80d0ac437",
+		salt:     "",
+		leftKey:  "164d4fcb553e625422d1d0cbeb57d7ee71c8668610303273ccb834f30487aac3",
+		rightKey: "e74efb4272f2014b088fb03f46d48f9e1eb6cdcc2d416754b3bca3e49a16406d",
+	},
+	{
+		// calcSecretKey("alice", "password")
+		name:     "secret key",
+		key:      hex.EncodeToString([]byte("alice")),
+		salt:     hex.EncodeToString([]byte("password")),
+		leftKey:  "6e2ca3cce65204f66bf8134accae57b9972f0bfb7627d23d8beeb5ac3a995919",
+		rightKey: "",
+	},
+}
+
+// sharedSecretVectors are known answers for the client's calcSharedSecret,
+// taken from RFC 5903 section 8.1 (ECDH P-256).
+var sharedSecretVectors = []struct {
+	name         string
+	privateKey   string
+	publicKey    string
+	sharedSecret string
+}{
+	{
+		name:         "rfc5903 initiator",
+		privateKey:   "c88f01f510d9ac3f70a292daa2316de544e9aab8afe84049c62a9c57862d1433",
+		publicKey:    "04d12dfb5289c8d4f81208b70270398c342296970a0bccb74c736fc7554494bf6356fbf3ca366cc23e8157854c13c58d6aac23f046ada30f8353e74f33039872ab",
+		sharedSecret: "d6840f6b42f6edafd13116e0e12565202fef8e9ece7dce03812464d04b9442de",
+	},
+	{
+		name:         "rfc5903 responder",
+		privateKey:   "c6ef9c5d78ae012a011164acb397ce2088685d8f06bf9be0b283ab46476bee53",
+		publicKey:    "04dad0b65394221cf9b051e1feca5787d098dfe637fc90b9ef945d0c37725811805271a0461cdb8252d61f1c456fa3e59ab1f45b33accf5f58389e0577b8990bb3",
+		sharedSecret: "d6840f6b42f6edafd13116e0e12565202fef8e9ece7dce03812464d04b9442de",
+	},
+}
+
+func TestDeriveChainKeyVectors(t *testing.T) {
+	for _, vector := range chainKeyVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			leftKey, rightKey, err := DeriveChainKey(mustHex(t, vector.key), mustHex(t, vector.salt))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(leftKey, mustHex(t, vector.leftKey)) {
+				t.Errorf("left key = %x, want %s", leftKey, vector.leftKey)
+			}
+			if vector.rightKey != "" && !bytes.Equal(rightKey, mustHex(t, vector.rightKey)) {
+				t.Errorf("right key = %x, want %s", rightKey, vector.rightKey)
+			}
+		})
+	}
+}
+
+func TestCalcSharedSecretVectors(t *testing.T) {
+	for _, vector := range sharedSecretVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			privateKey, err := ecdh.P256().NewPrivateKey(mustHex(t, vector.privateKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			publicKey, err := ecdh.P256().NewPublicKey(mustHex(t, vector.publicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sharedSecret, err := CalcSharedSecret(privateKey, publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(sharedSecret, mustHex(t, vector.sharedSecret)) {
+				t.Errorf("shared secret = %x, want %s", sharedSecret, vector.sharedSecret)
+			}
+		})
+	}
+}
+
+func TestConversation(t *testing.T) {
+	alice, bob := newPair(t)
+
+	// Round trips in both directions, then a reordered pair of messages.
+	turns := []struct {
+		from, to *State
+		count    int
+	}{
+		{alice, bob, 2},
+		{bob, alice, 1},
+		{alice, bob, 1},
+		{bob, alice, 2},
+	}
+
+	for i, turn := range turns {
+		payloads := []*Payload{}
+		for j := 0; j < turn.count; j++ {
+			payload, announced, err := turn.from.Encrypt(fmt.Appendf(nil, "turn %d message %d", i, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if announced != nil {
+				turn.to.SetRemotePublicKey(announced)
+			}
+			payloads = append(payloads, payload)
+		}
+
+		for j := len(payloads) - 1; j >= 0; j-- {
+			plaintext, announced, err := turn.to.Decrypt(payloads[j])
+			if err != nil {
+				t.Fatalf("turn %d: %v", i, err)
+			}
+			if announced != nil {
+				turn.from.SetRemotePublicKey(announced)
+			}
+			if want := fmt.Sprintf("turn %d message %d", i, j); string(plaintext) != want {
+				t.Fatalf("turn %d: plaintext = %q, want %q", i, plaintext, want)
+			}
+		}
+	}
+
+	// The state must also survive the change_keychain round trip.
+	secretKey, err := CalcSecretKey("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainIV, chainKey, err := SealState(secretKey, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenState(secretKey, chainIV, chainKey); err != nil {
+		t.Fatalf("keychain round trip: %v", err)
+	}
+}
+
+func TestDecryptRejectsSkipBeyondMaxSkip(t *testing.T) {
+	alice, bob := newPair(t)
+
+	payload, announced, err := alice.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announced != nil {
+		bob.SetRemotePublicKey(announced)
+	}
+
+	payload.YRatchet = 1 << 62
+	if _, _, err := bob.Decrypt(payload); !errors.Is(err, ErrInvalidRatchetIndex) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidRatchetIndex)
+	}
+}
+
+func newPair(t *testing.T) (*State, *State) {
+	t.Helper()
+
+	keys := make([]*ecdh.PrivateKey, 4)
+	for i := range keys {
+		key, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	alice, err := NewState(keys[0], keys[1], keys[2].PublicKey(), keys[3].PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := NewState(keys[2], keys[3], keys[0].PublicKey(), keys[1].PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestEnvelopeBindsFrame(t *testing.T) {
+	identityKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := signature.FromPublicKey(&identityKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := SignEnvelope(identityKey, "change_publickey", "alice", "bob", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyEnvelope(publicKey, "change_publickey", "alice", "bob", envelope); err != nil {
+		t.Fatalf("valid envelope: %v", err)
+	}
+
+	replays := []struct {
+		name                        string
+		frameType, sender, receiver string
+	}{
+		{"other receiver", "change_publickey", "alice", "carol"},
+		{"other type", "event_addfriend", "alice", "bob"},
+		{"other sender", "change_publickey", "carol", "bob"},
+	}
+	for _, replay := range replays {
+		if err := VerifyEnvelope(publicKey, replay.frameType, replay.sender, replay.receiver, envelope); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: err = %v, want %v", replay.name, err, ErrInvalidSignature)
+		}
+	}
+}
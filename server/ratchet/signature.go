@@ -0,0 +1,71 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"double-ratchet-server/signature"
+)
+
+var ErrInvalidSignature = errors.New("ratchet: invalid signature")
+
+// Envelope is the client's InterfaceWSSignatureData, used by
+// event_addfriend, event_allowfriend and change_publickey frames.
+type Envelope struct {
+	Data      string `json:"data"`
+	Signature string `json:"signature"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// EnvelopeMessage is what the signature covers, the client's envelopeMessage.
+// Binding the frame type and both parties keeps a signed envelope from being
+// replayed to another receiver or as another frame type.
+func EnvelopeMessage(frameType, sender, receiver string, timestamp int64, data string) []byte {
+	return []byte(strings.Join([]string{frameType, sender, receiver, strconv.FormatInt(timestamp, 10), data}, "\n"))
+}
+
+// SignEnvelope signs data with the identity key, encoding the signature as
+// hex over the fixed-width r||s form produced by WebCrypto.
+func SignEnvelope(identityKey *ecdsa.PrivateKey, frameType, sender, receiver, data string) (*Envelope, error) {
+	timestamp := time.Now().UnixMilli()
+	hash := sha256.Sum256(EnvelopeMessage(frameType, sender, receiver, timestamp, data))
+	r, s, err := ecdsa.Sign(rand.Reader, identityKey, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := (identityKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	return &Envelope{Data: data, Signature: hex.EncodeToString(signature), Timestamp: timestamp}, nil
+}
+
+func VerifyEnvelope(identityKey *signature.PublicKey, frameType, sender, receiver string, envelope *Envelope) error {
+	sig, err := hex.DecodeString(envelope.Signature)
+	if err != nil {
+		return err
+	}
+
+	if !identityKey.Verify(EnvelopeMessage(frameType, sender, receiver, envelope.Timestamp, envelope.Data), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SignPublicKey prepares the data of a change_publickey frame.
+func SignPublicKey(identityKey *ecdsa.PrivateKey, sender, receiver string, publicKey *ecdh.PublicKey) (*Envelope, error) {
+	encoded, err := ExportPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return SignEnvelope(identityKey, "change_publickey", sender, receiver, encoded)
+}
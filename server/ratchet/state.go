@@ -0,0 +1,168 @@
+package ratchet
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+type RatchetType string
+
+const (
+	TypeSender   RatchetType = "sender"
+	TypeReceiver RatchetType = "receiver"
+)
+
+var ErrInvalidState = errors.New("ratchet: invalid ratchet state")
+
+// DerivationRecord is one step of a chain, keys are hex encoded like the
+// client's InterfaceDerivationRecord.
+type DerivationRecord struct {
+	BaseKey    string `json:"baseKey"`
+	SaltKey    string `json:"saltKey,omitempty"`
+	OutputKey  string `json:"outputKey"`
+	MessageKey string `json:"messageKey"`
+}
+
+// State is the Go counterpart of the client's InterfaceUserKeyChain. Its
+// JSON form is the plaintext of Friend.ChainKey.
+type State struct {
+	Type       RatchetType
+	PublicKey  *ecdh.PublicKey
+	PrivateKey *ecdh.PrivateKey
+	RootChain  []DerivationRecord
+	SendChain  [][]DerivationRecord
+	RecvChain  [][]DerivationRecord
+}
+
+type stateJSON struct {
+	Type       RatchetType          `json:"type,omitempty"`
+	PublicKey  string               `json:"public_key"`
+	PrivateKey string               `json:"private_key"`
+	RootChain  []DerivationRecord   `json:"rootchain"`
+	SendChain  [][]DerivationRecord `json:"sendchain"`
+	RecvChain  [][]DerivationRecord `json:"recvchain"`
+}
+
+func (s *State) MarshalJSON() ([]byte, error) {
+	if s.PublicKey == nil || s.PrivateKey == nil {
+		return nil, ErrInvalidState
+	}
+
+	publicKey, err := ExportPublicKey(s.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := ExportPrivateKey(s.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(stateJSON{
+		Type:       s.Type,
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		RootChain:  nonNil(s.RootChain),
+		SendChain:  nonNil(s.SendChain),
+		RecvChain:  nonNil(s.RecvChain),
+	})
+}
+
+func (s *State) UnmarshalJSON(data []byte) error {
+	var raw stateJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if len(raw.RootChain) == 0 {
+		return ErrInvalidState
+	}
+
+	publicKey, err := ImportPublicKey(raw.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := ImportPrivateKey(raw.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	*s = State{
+		Type:       raw.Type,
+		PublicKey:  publicKey,
+		PrivateKey: privateKey,
+		RootChain:  raw.RootChain,
+		SendChain:  raw.SendChain,
+		RecvChain:  raw.RecvChain,
+	}
+	return nil
+}
+
+// SealState encrypts the state with the user's secret key, producing the
+// chain_iv/chain_key pair sent in change_keychain frames.
+func SealState(secretKey []byte, state *State) (string, string, error) {
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return "", "", err
+	}
+
+	iv, ciphertext, err := EncryptWithAESGCM(secretKey, plaintext)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func OpenState(secretKey []byte, chainIV, chainKey string) (*State, error) {
+	iv, err := base64.StdEncoding.DecodeString(chainIV)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(chainKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := DecryptWithAESGCM(secretKey, iv, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(plaintext, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *State) clone() *State {
+	cloned := *s
+	cloned.RootChain = append([]DerivationRecord(nil), s.RootChain...)
+	cloned.SendChain = cloneChains(s.SendChain)
+	cloned.RecvChain = cloneChains(s.RecvChain)
+	return &cloned
+}
+
+func cloneChains(chains [][]DerivationRecord) [][]DerivationRecord {
+	if chains == nil {
+		return nil
+	}
+
+	cloned := make([][]DerivationRecord, len(chains))
+	for i, chain := range chains {
+		cloned[i] = append([]DerivationRecord(nil), chain...)
+	}
+	return cloned
+}
+
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type failureEntry struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type memoryBackend struct {
+	mutex    sync.Mutex
+	buckets  map[string]*Bucket
+	failures map[string]*failureEntry
+}
+
+// NewMemoryBackend keeps the state in process memory and evicts idle keys
+// once a minute.
+func NewMemoryBackend() Backend {
+	backend := &memoryBackend{
+		buckets:  make(map[string]*Bucket),
+		failures: make(map[string]*failureEntry),
+	}
+	go backend.run()
+	return backend
+}
+
+func (b *memoryBackend) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		b.evict(now)
+	}
+}
+
+func (b *memoryBackend) evict(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for key, bucket := range b.buckets {
+		if now.Sub(bucket.last) > bucket.limit.Interval {
+			delete(b.buckets, key)
+		}
+	}
+	for key, entry := range b.failures {
+		if now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > time.Hour {
+			delete(b.failures, key)
+		}
+	}
+}
+
+func (b *memoryBackend) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = NewBucket(limit)
+		b.buckets[key] = bucket
+	}
+
+	allowed, retryAfter := bucket.Take(now)
+	return allowed, retryAfter, nil
+}
+
+func (b *memoryBackend) Fail(key string, policy LockoutPolicy, now time.Time) (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry, ok := b.failures[key]
+	if !ok || now.Sub(entry.lastFailure) > policy.Window {
+		entry = &failureEntry{}
+		b.failures[key] = entry
+	}
+
+	entry.count++
+	entry.lastFailure = now
+	if locked := policy.duration(entry.count); locked > 0 {
+		entry.lockedUntil = now.Add(locked)
+	}
+	return max(entry.lockedUntil.Sub(now), 0), nil
+}
+
+func (b *memoryBackend) LockedFor(key string, now time.Time) (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if entry, ok := b.failures[key]; ok {
+		return max(entry.lockedUntil.Sub(now), 0), nil
+	}
+	return 0, nil
+}
+
+func (b *memoryBackend) Reset(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.failures, key)
+	return nil
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBackend() *memoryBackend {
+	return &memoryBackend{
+		buckets:  make(map[string]*Bucket),
+		failures: make(map[string]*failureEntry),
+	}
+}
+
+func TestMemoryBackendFailWindow(t *testing.T) {
+	backend := newTestBackend()
+	policy := LockoutPolicy{Threshold: 2, Window: time.Minute, Base: time.Minute, Max: time.Hour}
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{0, 0},
+		// within the window of the last failure, the second one locks
+		{50 * time.Second, time.Minute},
+		// the window restarts the count once it passed without a failure
+		{50*time.Second + 2*time.Minute, 0},
+		{50*time.Second + 2*time.Minute + 30*time.Second, time.Minute},
+	}
+	for i, test := range tests {
+		locked, err := backend.Fail("key", policy, start.Add(test.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != test.want {
+			t.Errorf("fail %d at %v locked for %v, want %v", i, test.at, locked, test.want)
+		}
+	}
+}
+
+func TestMemoryBackendEvict(t *testing.T) {
+	backend := newTestBackend()
+	limit := Limit{Burst: 1, Interval: time.Minute}
+	policy := LockoutPolicy{Threshold: 1, Window: time.Minute, Base: 2 * time.Hour, Max: 2 * time.Hour}
+	start := time.Unix(1_700_000_000, 0)
+
+	backend.Take("bucket", limit, start)
+	backend.Fail("failed", LockoutPolicy{Threshold: 5, Window: time.Minute}, start)
+	backend.Fail("locked", policy, start)
+
+	backend.evict(start.Add(30 * time.Second))
+	if _, ok := backend.buckets["bucket"]; !ok {
+		t.Error("bucket evicted within its interval")
+	}
+
+	backend.evict(start.Add(30 * time.Minute))
+	if _, ok := backend.buckets["bucket"]; ok {
+		t.Error("idle bucket not evicted")
+	}
+	if _, ok := backend.failures["failed"]; !ok {
+		t.Error("failure evicted within an hour")
+	}
+
+	backend.evict(start.Add(61 * time.Minute))
+	if _, ok := backend.failures["failed"]; ok {
+		t.Error("failure not evicted after an hour")
+	}
+	if _, ok := backend.failures["locked"]; !ok {
+		t.Error("failure evicted while the key is locked")
+	}
+	if locked, _ := backend.LockedFor("locked", start.Add(61*time.Minute)); locked != 59*time.Minute {
+		t.Errorf("locked for %v, want %v", locked, 59*time.Minute)
+	}
+
+	backend.evict(start.Add(3 * time.Hour))
+	if _, ok := backend.failures["locked"]; ok {
+		t.Error("failure not evicted after the lock ended")
+	}
+}
@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit allows Burst events at once, refilled evenly over Interval.
+type Limit struct {
+	Burst    int
+	Interval time.Duration
+}
+
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Interval.Seconds()
+}
+
+// LockoutPolicy locks a key after Threshold failures within Window, the lock
+// starts at Base and doubles with every further failure up to Max.
+type LockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	Base      time.Duration
+	Max       time.Duration
+}
+
+func (p LockoutPolicy) duration(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+	// NOTE: 逐次翻倍直到达到 Max，避免位移溢出成负数
+	locked := p.Base
+	for i := p.Threshold; i < failures && locked < p.Max; i++ {
+		locked *= 2
+	}
+	return min(locked, p.Max)
+}
+
+// Backend keeps the limiter state, the memory backend serves a single
+// instance and a shared backend (e.g. redis) can implement the same methods.
+type Backend interface {
+	// Take removes one token from the bucket of key, or reports how long to
+	// wait for the next token.
+	Take(key string, limit Limit, now time.Time) (bool, time.Duration, error)
+	// Fail records a failure and returns how long key is locked out now.
+	Fail(key string, policy LockoutPolicy, now time.Time) (time.Duration, error)
+	// LockedFor returns the remaining lockout of key.
+	LockedFor(key string, now time.Time) (time.Duration, error)
+	Reset(key string) error
+}
+
+// Bucket is a token bucket for state that is never shared, such as the
+// frames of one websocket connection.
+type Bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{limit: limit, tokens: float64(limit.Burst)}
+}
+
+func (b *Bucket) Take(now time.Time) (bool, time.Duration) {
+	if !b.last.IsZero() {
+		elapsed := now.Sub(b.last).Seconds()
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.rate())
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / b.limit.rate()
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Limiter applies one Limit to many keys, Name separates the keys of
+// different limiters that share a backend.
+type Limiter struct {
+	backend Backend
+	name    string
+	limit   Limit
+}
+
+func NewLimiter(backend Backend, name string, limit Limit) *Limiter {
+	return &Limiter{backend: backend, name: name, limit: limit}
+}
+
+// Allow fails open when the backend errors, so an outage of a shared
+// backend does not take the login down with it.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	allowed, retryAfter, err := l.backend.Take(l.name+":"+key, l.limit, time.Now())
+	if err != nil {
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+type Lockout struct {
+	backend Backend
+	name    string
+	policy  LockoutPolicy
+}
+
+func NewLockout(backend Backend, name string, policy LockoutPolicy) *Lockout {
+	return &Lockout{backend: backend, name: name, policy: policy}
+}
+
+func (l *Lockout) LockedFor(key string) time.Duration {
+	remaining, err := l.backend.LockedFor(l.name+":"+key, time.Now())
+	if err != nil {
+		return 0
+	}
+	return remaining
+}
+
+func (l *Lockout) Fail(key string) time.Duration {
+	locked, err := l.backend.Fail(l.name+":"+key, l.policy, time.Now())
+	if err != nil {
+		return 0
+	}
+	return locked
+}
+
+func (l *Lockout) Reset(key string) {
+	l.backend.Reset(l.name + ":" + key)
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	// 2 tokens refilled over 2s, one token per second
+	bucket := NewBucket(Limit{Burst: 2, Interval: 2 * time.Second})
+
+	tests := []struct {
+		at         time.Duration
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		{time.Second, true, 0},
+		{time.Second, false, time.Second},
+		// refill stops at Burst however long the bucket was idle
+		{time.Minute, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, false, time.Second},
+	}
+	for i, test := range tests {
+		allowed, retryAfter := bucket.Take(start.Add(test.at))
+		if allowed != test.allowed || retryAfter != test.retryAfter {
+			t.Errorf("take %d at %v = (%v, %v), want (%v, %v)", i, test.at, allowed, retryAfter, test.allowed, test.retryAfter)
+		}
+	}
+}
+
+func TestLockoutPolicyDuration(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, Window: time.Minute, Base: 30 * time.Second, Max: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 30 * time.Second},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{7, 8 * time.Minute},
+		{8, 10 * time.Minute},
+		{40, 10 * time.Minute},
+		{1_000_000, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := policy.duration(test.failures); got != test.want {
+			t.Errorf("duration(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// NOTE: 单个附件最多允许的接收者数量，群组按一个接收者计算
+const maxAttachmentRecipients = 256
+
+type AttachmentCreateRequest struct {
+	Size       int64    `json:"size" binding:"required,gt=0"`
+	Recipients []string `json:"recipients" binding:"required,min=1,dive,uuid"`
+}
+
+type AttachmentCreateData struct {
+	UUID      string `json:"uuid"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+type AttachmentCreateResponse struct {
+	Code    uint                 `json:"code"`
+	Message string               `json:"message"`
+	Data    AttachmentCreateData `json:"data"`
+}
+
+// canSendAttachment allows a friend of the owner, or a group the owner is a
+// member of, as recipient.
+func (h *Handler) canSendAttachment(owner, recipient string) (bool, error) {
+	if _, err := h.store.FindFriend(owner, recipient); err == nil {
+		return true, nil
+	} else if !errors.Is(err, database.ErrRecordNotFound) {
+		return false, err
+	}
+
+	if _, err := h.store.FindGroupMember(recipient, owner); err == nil {
+		return true, nil
+	} else if !errors.Is(err, database.ErrRecordNotFound) {
+		return false, err
+	}
+	return false, nil
+}
+
+func (h *Handler) HandleAttachmentCreate(ctx *gin.Context) {
+	var req AttachmentCreateRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || len(req.Recipients) > maxAttachmentRecipients {
+		ctx.JSON(http.StatusBadRequest, AttachmentCreateResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	owner := middleware.AuthUUID(ctx)
+
+	for _, recipient := range req.Recipients {
+		if allowed, err := h.canSendAttachment(owner, recipient); err != nil {
+			ctx.JSON(http.StatusInternalServerError, AttachmentCreateResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "server database error",
+			})
+			return
+		} else if !allowed {
+			ctx.JSON(http.StatusForbidden, AttachmentCreateResponse{
+				Code:    http.StatusForbidden,
+				Message: "recipient is not a friend or joined group",
+			})
+			return
+		}
+	}
+
+	if req.Size > int64(config.ATTACHMENT_MAX_SIZE) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, AttachmentCreateResponse{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: "attachment is too large",
+		})
+		return
+	}
+
+	used, err := h.store.SumAttachmentSize(owner)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AttachmentCreateResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	if used+req.Size > int64(config.ATTACHMENT_QUOTA) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, AttachmentCreateResponse{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: "attachment quota exceeded",
+		})
+		return
+	}
+
+	attachment := database.Attachment{
+		UUID:  uuid.NewString(),
+		Owner: owner,
+		Size:  req.Size,
+	}
+
+	if err := h.store.CreateAttachment(&attachment, req.Recipients); err != nil {
+		ctx.JSON(http.StatusInternalServerError, AttachmentCreateResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "create attachment failed",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AttachmentCreateResponse{
+		Code:    http.StatusOK,
+		Message: "create attachment successfully",
+		Data: AttachmentCreateData{
+			UUID:      attachment.UUID,
+			ChunkSize: config.ATTACHMENT_CHUNK_SIZE,
+		},
+	})
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// canAccessAttachment allows the owner, direct recipients and members of a
+// recipient group.
+func (h *Handler) canAccessAttachment(userUUID string, attachment *database.Attachment) bool {
+	if attachment.Owner == userUUID {
+		return true
+	}
+
+	recipients, err := h.store.ListAttachmentRecipients(attachment.UUID)
+	if err != nil {
+		return false
+	}
+
+	for _, recipient := range recipients {
+		if recipient == userUUID {
+			return true
+		}
+		if _, err := h.store.FindGroupMember(recipient, userUUID); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleAttachmentDownload serves the blob with Range support, so an
+// interrupted download continues from where it stopped. It sits behind the
+// Bearer middleware, so the token never ends up in a URL.
+func (h *Handler) HandleAttachmentDownload(ctx *gin.Context) {
+	attachment, err := h.store.FindAttachment(ctx.Param("uuid"))
+	if err != nil || !attachment.Completed || !h.canAccessAttachment(middleware.AuthUUID(ctx), attachment) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"message": "attachment not exist",
+		})
+		return
+	}
+
+	file, err := h.blobs.Open(attachment.UUID)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "read attachment failed",
+		})
+		return
+	}
+	defer file.Close()
+
+	ctx.Header("Content-Type", "application/octet-stream")
+	ctx.Header("Cache-Control", "private, no-store")
+	http.ServeContent(ctx.Writer, ctx.Request, attachment.UUID, time.UnixMilli(attachment.Timestamp), file)
+}
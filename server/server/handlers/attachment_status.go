@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AttachmentStatusResponse struct {
+	Code    uint                 `json:"code"`
+	Message string               `json:"message"`
+	Data    AttachmentUploadData `json:"data"`
+}
+
+func (h *Handler) HandleAttachmentStatus(ctx *gin.Context) {
+	attachment, err := h.store.FindAttachment(ctx.Param("uuid"))
+	if err != nil || !h.canAccessAttachment(middleware.AuthUUID(ctx), attachment) {
+		ctx.JSON(http.StatusNotFound, AttachmentStatusResponse{
+			Code:    http.StatusNotFound,
+			Message: "attachment not exist",
+		})
+		return
+	}
+
+	received, err := h.blobs.Size(attachment.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AttachmentStatusResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "read attachment failed",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AttachmentStatusResponse{
+		Code:    http.StatusOK,
+		Message: "fetch attachment status successfully",
+		Data: AttachmentUploadData{
+			UUID:      attachment.UUID,
+			Size:      attachment.Size,
+			Received:  received,
+			Completed: attachment.Completed,
+		},
+	})
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"double-ratchet-server/blob"
+	"double-ratchet-server/config"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AttachmentUploadData struct {
+	UUID      string `json:"uuid"`
+	Size      int64  `json:"size"`
+	Received  int64  `json:"received"`
+	Completed bool   `json:"completed"`
+}
+
+type AttachmentUploadResponse struct {
+	Code    uint                 `json:"code"`
+	Message string               `json:"message"`
+	Data    AttachmentUploadData `json:"data"`
+}
+
+// HandleAttachmentUpload appends one raw chunk to the blob. A chunk whose
+// offset does not match gets 409 with the stored size so the client resumes.
+func (h *Handler) HandleAttachmentUpload(ctx *gin.Context) {
+	offset, err := strconv.ParseInt(ctx.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, AttachmentUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal chunk offset",
+		})
+		return
+	}
+
+	attachment, err := h.store.FindAttachment(ctx.Param("uuid"))
+	if err != nil || attachment.Owner != middleware.AuthUUID(ctx) {
+		ctx.JSON(http.StatusNotFound, AttachmentUploadResponse{
+			Code:    http.StatusNotFound,
+			Message: "attachment not exist",
+		})
+		return
+	}
+
+	data := AttachmentUploadData{
+		UUID:      attachment.UUID,
+		Size:      attachment.Size,
+		Received:  attachment.Size,
+		Completed: attachment.Completed,
+	}
+
+	if attachment.Completed {
+		ctx.JSON(http.StatusConflict, AttachmentUploadResponse{
+			Code:    http.StatusConflict,
+			Message: "attachment already completed",
+			Data:    data,
+		})
+		return
+	}
+
+	// 分片不能超过单片上限，也不能超过声明的附件大小
+	limit := min(int64(config.ATTACHMENT_CHUNK_SIZE), attachment.Size-offset)
+	chunk := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, max(limit, 0))
+
+	received, err := h.blobs.Append(attachment.UUID, offset, chunk)
+	data.Received = received
+	if errors.Is(err, blob.ErrOffsetMismatch) {
+		ctx.JSON(http.StatusConflict, AttachmentUploadResponse{
+			Code:    http.StatusConflict,
+			Message: "chunk offset mismatch",
+			Data:    data,
+		})
+		return
+	} else if maxBytesErr := new(http.MaxBytesError); errors.As(err, &maxBytesErr) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, AttachmentUploadResponse{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: "chunk is too large",
+			Data:    data,
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AttachmentUploadResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "store chunk failed",
+			Data:    data,
+		})
+		return
+	}
+
+	if received == attachment.Size {
+		if err := h.store.CompleteAttachment(attachment.UUID); err != nil {
+			ctx.JSON(http.StatusInternalServerError, AttachmentUploadResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "server database error",
+				Data:    data,
+			})
+			return
+		}
+		data.Completed = true
+	}
+
+	ctx.JSON(http.StatusOK, AttachmentUploadResponse{
+		Code:    http.StatusOK,
+		Message: "upload chunk successfully",
+		Data:    data,
+	})
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuthChallengeRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type AuthChallengeData struct {
+	Nonce     string `json:"nonce"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+type AuthChallengeResponse struct {
+	Code    uint              `json:"code"`
+	Message string            `json:"message"`
+	Data    AuthChallengeData `json:"data"`
+}
+
+// HandleAuthChallenge issues the nonce that the next password recovery
+// request has to sign. A nonce is issued for unknown usernames as well, so
+// the endpoint does not reveal which accounts exist.
+func (h *Handler) HandleAuthChallenge(ctx *gin.Context) {
+	var req AuthChallengeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, AuthChallengeResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	if !h.guardAccount(ctx, req.Username) {
+		return
+	}
+
+	nonce, err := utils.GenerateRefreshToken()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthChallengeResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to generate nonce",
+		})
+		return
+	}
+
+	if err := h.store.CreateRecoveryNonce(&database.RecoveryNonce{
+		Hash:      utils.HashRefreshToken(nonce),
+		Username:  req.Username,
+		ExpiresAt: time.Now().Add(config.RECOVERY_NONCE_TTL).UnixMilli(),
+	}); err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthChallengeResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AuthChallengeResponse{
+		Code:    http.StatusOK,
+		Message: "challenge issued",
+		Data: AuthChallengeData{
+			Nonce:     nonce,
+			ExpiresIn: int64(config.RECOVERY_NONCE_TTL.Seconds()),
+		},
+	})
+}
@@ -1,17 +1,16 @@
 package handlers
 
 import (
-	"crypto/ecdsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
-	"math/big"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"double-ratchet-server/database"
+	"double-ratchet-server/config"
+	"double-ratchet-server/signature"
+	"double-ratchet-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,10 +18,13 @@ import (
 type AuthForgotRequest struct {
 	Username   string `json:"username" binding:"required"`
 	Password   string `json:"password" binding:"required"`
+	Nonce      string `json:"nonce" binding:"required"`
 	SignInfo   string `json:"signinfo" binding:"required"`
 	Timestamp  string `json:"timestamp" binding:"required"`
 	PrivateIV  string `json:"private_iv" binding:"required"`
 	PrivateKey string `json:"private_key" binding:"required"`
+	// PublicKey optionally rotates the identity key, it is signed by the old one
+	PublicKey string `json:"public_key"`
 }
 
 type AuthForgotResponse struct {
@@ -30,7 +32,17 @@ type AuthForgotResponse struct {
 	Message string `json:"message"`
 }
 
-func HandleAuthForgot(ctx *gin.Context) {
+// signedPayload binds the signature to the challenge and to the new password
+// and key material, so neither can be swapped or replayed.
+func (req AuthForgotRequest) signedPayload() []byte {
+	fields := []string{req.Username, req.Nonce, req.Timestamp, req.Password, req.PrivateIV, req.PrivateKey}
+	if req.PublicKey != "" {
+		fields = append(fields, req.PublicKey)
+	}
+	return []byte(strings.Join(fields, ":"))
+}
+
+func (h *Handler) HandleAuthForgot(ctx *gin.Context) {
 	var req AuthForgotRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, AuthForgotResponse{
@@ -40,8 +52,14 @@ func HandleAuthForgot(ctx *gin.Context) {
 		return
 	}
 
+	if !h.guardAccount(ctx, req.Username) {
+		return
+	}
+
+	// NOTE: 时间戳过早或过晚都拒绝，避免客户端时间超前的签名长期有效
 	clientTime, err := strconv.ParseInt(req.Timestamp, 10, 64)
-	if err != nil || time.Now().UnixMilli()-clientTime > 60*1000 {
+	skew := time.Since(time.UnixMilli(clientTime))
+	if err != nil || skew > config.RECOVERY_CLOCK_SKEW || skew < -config.RECOVERY_CLOCK_SKEW {
 		ctx.JSON(http.StatusUnauthorized, AuthForgotResponse{
 			Code:    http.StatusUnauthorized,
 			Message: "timestamp expires",
@@ -49,67 +67,54 @@ func HandleAuthForgot(ctx *gin.Context) {
 		return
 	}
 
-	var user database.User
-	if err := database.MDB.Where("username = ?", req.Username).First(&user).Error; err != nil {
-		ctx.JSON(http.StatusNotFound, AuthForgotResponse{
-			Code:    http.StatusNotFound,
-			Message: "user not exist",
-		})
-		return
-	}
-
-	pubBytes, err := base64.StdEncoding.DecodeString(user.PublicKey)
+	// NOTE: 无论签名是否有效，挑战都在此处被消耗，只能使用一次
+	consumed, err := h.store.ConsumeRecoveryNonce(utils.HashRefreshToken(req.Nonce), req.Username, time.Now().UnixMilli())
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
 			Code:    http.StatusInternalServerError,
-			Message: "incorrect encoding method for pubkey",
+			Message: "server database error",
 		})
 		return
-	}
-
-	block, _ := pem.Decode(pubBytes)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
-			Code:    http.StatusInternalServerError,
-			Message: "invalid stored pubkey format",
+	} else if !consumed {
+		h.failAccount(ctx, req.Username)
+		ctx.JSON(http.StatusUnauthorized, AuthForgotResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid or expired nonce",
 		})
 		return
 	}
 
-	pubKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	sigBytes, err := base64.StdEncoding.DecodeString(req.SignInfo)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
-			Code:    http.StatusInternalServerError,
-			Message: "failed to parse stored pubkey",
+		ctx.JSON(http.StatusBadRequest, AuthForgotResponse{
+			Code:    http.StatusBadRequest,
+			Message: "incorrect encoding method for signature",
 		})
 		return
 	}
 
-	pubKey, ok := pubKeyInterface.(*ecdsa.PublicKey)
-	if !ok || pubKey.Curve.Params().Name != "P-521" {
-		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
-			Code:    http.StatusInternalServerError,
-			Message: "stored pubkey is not a valid ECDSA P-521 key",
+	// NOTE: 用户不存在与签名无效返回相同的响应，避免通过该接口枚举用户名
+	user, err := h.store.FindUserByUsername(req.Username)
+	if err != nil {
+		h.failAccount(ctx, req.Username)
+		ctx.JSON(http.StatusUnauthorized, AuthForgotResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid private key file",
 		})
 		return
 	}
 
-	hash := sha256.Sum256([]byte(req.Username + ":" + req.Timestamp))
-
-	sigBytes, err := base64.StdEncoding.DecodeString(req.SignInfo)
+	pubKey, err := h.identityKey(user)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, AuthForgotResponse{
-			Code:    http.StatusBadRequest,
-			Message: "incorrect encoding method for signature",
+		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
 		})
 		return
 	}
 
-	half := len(sigBytes) / 2
-	rInt := new(big.Int).SetBytes(sigBytes[:half])
-	sInt := new(big.Int).SetBytes(sigBytes[half:])
-
-	if !ecdsa.Verify(pubKey, hash[:], rInt, sInt) {
+	if !pubKey.Verify(req.signedPayload(), sigBytes) {
+		h.failAccount(ctx, req.Username)
 		ctx.JSON(http.StatusUnauthorized, AuthForgotResponse{
 			Code:    http.StatusUnauthorized,
 			Message: "invalid private key file",
@@ -117,13 +122,27 @@ func HandleAuthForgot(ctx *gin.Context) {
 		return
 	}
 
-	err = database.MDB.Model(&user).Updates(map[string]any{
-		"password":    req.Password,
-		"private_iv":  req.PrivateIV,
-		"private_key": req.PrivateKey,
-	}).Error
+	var newKey *signature.PublicKey
+	if req.PublicKey != "" && req.PublicKey != user.PublicKey {
+		if newKey, err = signature.ParsePublicKey(req.PublicKey); err != nil {
+			ctx.JSON(http.StatusBadRequest, AuthForgotResponse{
+				Code:    http.StatusBadRequest,
+				Message: "invalid public key format",
+			})
+			return
+		}
+	}
 
+	hashed, err := utils.HashPassword(req.Password)
 	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to hash password",
+		})
+		return
+	}
+
+	if err := h.store.UpdateUserCredentials(user.UUID, hashed, req.PrivateIV, req.PrivateKey); err != nil {
 		ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
 			Code:    http.StatusInternalServerError,
 			Message: "update user record failed",
@@ -131,6 +150,21 @@ func HandleAuthForgot(ctx *gin.Context) {
 		return
 	}
 
+	if newKey != nil {
+		if err := h.rotateIdentityKey(user, req.PublicKey, newKey); err != nil {
+			ctx.JSON(http.StatusInternalServerError, AuthForgotResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "update identity key failed",
+			})
+			return
+		}
+	}
+
+	// NOTE: 重置密码后旧的登录状态全部失效
+	if err := h.revokeUserSessions(user.UUID); err != nil {
+		log.Println("failed to revoke sessions:", err)
+	}
+
 	ctx.JSON(http.StatusOK, AuthForgotResponse{
 		Code:    http.StatusOK,
 		Message: "update password success",
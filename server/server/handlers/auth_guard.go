@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"time"
+
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NOTE: 账号锁定以 (用户名, IP) 为键，他人无法通过错误密码锁定受害者的账号
+func accountKey(ctx *gin.Context, username string) string {
+	return "user:" + username + "@" + ctx.ClientIP()
+}
+
+// guardAccount rejects the request with 429 when the username is over its
+// rate limit, or the username from this client IP or the IP itself is
+// locked out.
+func (h *Handler) guardAccount(ctx *gin.Context, username string) bool {
+	// NOTE: 仅按用户名限流是有意为之：来自多个 IP 的分布式猜测仍受限于每个账号的速率。
+	// 代价是他人可以让受害者的登录暂时变慢，但只是限速，不会锁定账号
+	if allowed, retryAfter := h.accounts.Allow(username); !allowed {
+		middleware.AbortTooManyRequests(ctx, retryAfter)
+		return false
+	}
+
+	locked := max(h.lockout.LockedFor(accountKey(ctx, username)), h.lockout.LockedFor("ip:"+ctx.ClientIP()))
+	if locked > 0 {
+		middleware.AbortTooManyRequests(ctx, locked)
+		return false
+	}
+	return true
+}
+
+// failAccount counts a failed attempt against the username from this client
+// IP and against the IP, so guessing across many accounts is locked out as
+// well.
+func (h *Handler) failAccount(ctx *gin.Context, username string) time.Duration {
+	return max(h.lockout.Fail(accountKey(ctx, username)), h.lockout.Fail("ip:"+ctx.ClientIP()))
+}
+
+func (h *Handler) resetAccount(ctx *gin.Context, username string) {
+	h.lockout.Reset(accountKey(ctx, username))
+	h.lockout.Reset("ip:" + ctx.ClientIP())
+}
@@ -1,14 +1,16 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 
-	"double-ratchet-server/database"
 	"double-ratchet-server/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
+var dummyPasswordHash, _ = utils.HashPassword("double-ratchet")
+
 type AuthLoginRequest struct {
 	Remember bool   `json:"remember"`
 	Username string `json:"username" binding:"required"`
@@ -23,6 +25,8 @@ type AuthLoginData struct {
 	PrivateIV     string `json:"private_iv"`
 	PrivateKey    string `json:"private_key"`
 	Authorization string `json:"authorization"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int64  `json:"expires_in"`
 }
 
 type AuthLoginResponse struct {
@@ -31,7 +35,7 @@ type AuthLoginResponse struct {
 	Data    AuthLoginData `json:"data"`
 }
 
-func HandleAuthLogin(ctx *gin.Context) {
+func (h *Handler) HandleAuthLogin(ctx *gin.Context) {
 	var req AuthLoginRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, AuthLoginResponse{
@@ -41,8 +45,15 @@ func HandleAuthLogin(ctx *gin.Context) {
 		return
 	}
 
-	var user database.User
-	if err := database.MDB.Where("username = ? AND password = ?", req.Username, req.Password).First(&user).Error; err != nil {
+	if !h.guardAccount(ctx, req.Username) {
+		return
+	}
+
+	user, err := h.store.FindUserByUsername(req.Username)
+	if err != nil {
+		// NOTE: 用户不存在时同样计算一次哈希，避免通过响应时间枚举用户名
+		utils.VerifyPassword(dummyPasswordHash, req.Password)
+		h.failAccount(ctx, req.Username)
 		ctx.JSON(http.StatusUnauthorized, AuthLoginResponse{
 			Code:    http.StatusUnauthorized,
 			Message: "incorrect username or password",
@@ -50,7 +61,27 @@ func HandleAuthLogin(ctx *gin.Context) {
 		return
 	}
 
-	authorization, err := utils.GenerateJWT(user.UUID, user.Username, req.Remember)
+	ok, needsRehash := utils.VerifyPassword(user.Password, req.Password)
+	if !ok {
+		h.failAccount(ctx, req.Username)
+		ctx.JSON(http.StatusUnauthorized, AuthLoginResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "incorrect username or password",
+		})
+		return
+	}
+
+	h.resetAccount(ctx, req.Username)
+
+	if needsRehash {
+		if hashed, err := utils.HashPassword(req.Password); err != nil {
+			log.Println("failed to rehash password:", err)
+		} else if err := h.store.UpdateUserPassword(user.UUID, hashed); err != nil {
+			log.Println("failed to update password hash:", err)
+		}
+	}
+
+	tokens, err := h.createSession(user, req.Remember)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, AuthLoginResponse{
 			Code:    http.StatusInternalServerError,
@@ -69,7 +100,9 @@ func HandleAuthLogin(ctx *gin.Context) {
 			PublicKey:     user.PublicKey,
 			PrivateIV:     user.PrivateIV,
 			PrivateKey:    user.PrivateKey,
-			Authorization: authorization,
+			Authorization: tokens.Authorization,
+			RefreshToken:  tokens.RefreshToken,
+			ExpiresIn:     tokens.ExpiresIn,
 		},
 	})
 }
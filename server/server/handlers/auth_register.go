@@ -1,18 +1,18 @@
 package handlers
 
 import (
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 
 	"double-ratchet-server/config"
 	"double-ratchet-server/database"
+	"double-ratchet-server/signature"
+	"double-ratchet-server/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"gorm.io/gorm"
 )
 
 type AuthRegisterRequest struct {
@@ -28,7 +28,7 @@ type AuthRegisterResponse struct {
 	Message string `json:"message"`
 }
 
-func HandleAuthRegister(ctx *gin.Context) {
+func (h *Handler) HandleAuthRegister(ctx *gin.Context) {
 	var req AuthRegisterRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, AuthRegisterResponse{
@@ -38,14 +38,13 @@ func HandleAuthRegister(ctx *gin.Context) {
 		return
 	}
 
-	var existingUser database.User
-	if err := database.MDB.Where("username = ?", req.Username).First(&existingUser).Error; err == nil {
+	if _, err := h.store.FindUserByUsername(req.Username); err == nil {
 		ctx.JSON(http.StatusConflict, AuthRegisterResponse{
 			Code:    http.StatusConflict,
 			Message: "username already exists",
 		})
 		return
-	} else if err != gorm.ErrRecordNotFound {
+	} else if !errors.Is(err, database.ErrRecordNotFound) {
 		ctx.JSON(http.StatusInternalServerError, AuthRegisterResponse{
 			Code:    http.StatusInternalServerError,
 			Message: "server database error",
@@ -53,17 +52,20 @@ func HandleAuthRegister(ctx *gin.Context) {
 		return
 	}
 
-	pubBytes, err := base64.StdEncoding.DecodeString(req.PublicKey)
-	if err != nil {
+	identityKey, err := signature.ParsePublicKey(req.PublicKey)
+	if errors.Is(err, signature.ErrPubkeyEncoding) {
 		ctx.JSON(http.StatusBadRequest, AuthRegisterResponse{
 			Code:    http.StatusBadRequest,
 			Message: "incorrect encoding method",
 		})
 		return
-	}
-
-	block, _ := pem.Decode(pubBytes)
-	if block == nil || block.Type != "PUBLIC KEY" {
+	} else if errors.Is(err, signature.ErrUnsupportedKey) {
+		ctx.JSON(http.StatusBadRequest, AuthRegisterResponse{
+			Code:    http.StatusBadRequest,
+			Message: "unsupported public key algorithm",
+		})
+		return
+	} else if err != nil {
 		ctx.JSON(http.StatusBadRequest, AuthRegisterResponse{
 			Code:    http.StatusBadRequest,
 			Message: "invalid public key format",
@@ -71,26 +73,27 @@ func HandleAuthRegister(ctx *gin.Context) {
 		return
 	}
 
-	_, err = x509.ParsePKIXPublicKey(block.Bytes)
+	hashed, err := utils.HashPassword(req.Password)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, AuthRegisterResponse{
-			Code:    http.StatusBadRequest,
-			Message: "invalid public key format",
+		ctx.JSON(http.StatusInternalServerError, AuthRegisterResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to hash password",
 		})
 		return
 	}
 
 	user := database.User{
-		UUID:       uuid.NewString(),
-		Username:   req.Username,
-		Password:   req.Password,
-		AvatarUrl:  fmt.Sprintf("%suploads/avatars/default.png", config.ROOT_PATH),
-		PublicKey:  req.PublicKey,
-		PrivateIV:  req.PrivateIV,
-		PrivateKey: req.PrivateKey,
+		UUID:         uuid.NewString(),
+		Username:     req.Username,
+		Password:     hashed,
+		AvatarUrl:    fmt.Sprintf("%suploads/avatars/default.png", config.ROOT_PATH),
+		PublicKey:    req.PublicKey,
+		PrivateIV:    req.PrivateIV,
+		PrivateKey:   req.PrivateKey,
+		KeyAlgorithm: identityKey.Algorithm,
 	}
 
-	if err := database.MDB.Create(&user).Error; err != nil {
+	if err := h.store.CreateUser(&user); err != nil {
 		ctx.JSON(http.StatusInternalServerError, AuthRegisterResponse{
 			Code:    http.StatusInternalServerError,
 			Message: "create user failed",
@@ -98,6 +101,15 @@ func HandleAuthRegister(ctx *gin.Context) {
 		return
 	}
 
+	if err := h.store.CreateIdentityKey(&database.IdentityKey{
+		UserUUID:     user.UUID,
+		PublicKey:    user.PublicKey,
+		KeyAlgorithm: identityKey.Algorithm,
+		Fingerprint:  identityKey.Fingerprint(),
+	}); err != nil {
+		log.Println("failed to record identity key:", err)
+	}
+
 	ctx.JSON(http.StatusOK, AuthRegisterResponse{
 		Code:    http.StatusOK,
 		Message: "user registration successfully",
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+	"double-ratchet-server/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type AuthTokenData struct {
+	Authorization string `json:"authorization"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int64  `json:"expires_in"`
+}
+
+func refreshTokenTTL(remember bool) time.Duration {
+	if remember {
+		return config.REFRESH_TOKEN_REMEMBER_TTL
+	}
+	return config.REFRESH_TOKEN_TTL
+}
+
+// createSession starts a new session for the user and issues its first pair
+// of access and refresh tokens.
+func (h *Handler) createSession(user *database.User, remember bool) (AuthTokenData, error) {
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return AuthTokenData{}, err
+	}
+
+	session := database.Session{
+		UUID:        uuid.NewString(),
+		UserUUID:    user.UUID,
+		RefreshHash: utils.HashRefreshToken(refreshToken),
+		Remember:    remember,
+		ExpiresAt:   time.Now().Add(refreshTokenTTL(remember)).UnixMilli(),
+	}
+	if err := h.store.CreateSession(&session); err != nil {
+		return AuthTokenData{}, err
+	}
+
+	authorization, err := utils.GenerateJWT(user.UUID, user.Username, session.UUID)
+	if err != nil {
+		return AuthTokenData{}, err
+	}
+
+	return AuthTokenData{
+		Authorization: authorization,
+		RefreshToken:  refreshToken,
+		ExpiresIn:     int64(config.ACCESS_TOKEN_TTL.Seconds()),
+	}, nil
+}
+
+// revokeUserSessions logs the user out everywhere and closes live sockets.
+func (h *Handler) revokeUserSessions(userUUID string) error {
+	sessionIDs, err := h.store.RevokeUserSessions(userUUID)
+	if err != nil {
+		return err
+	}
+	h.notifier.DisconnectSessions(sessionIDs...)
+	return nil
+}
+
+type AuthRefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type AuthRefreshResponse struct {
+	Code    uint          `json:"code"`
+	Message string        `json:"message"`
+	Data    AuthTokenData `json:"data"`
+}
+
+// HandleAuthRefresh rotates the refresh token. Presenting a token that was
+// already rotated means it leaked, so the whole session is revoked.
+func (h *Handler) HandleAuthRefresh(ctx *gin.Context) {
+	var req AuthRefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, AuthRefreshResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	hash := utils.HashRefreshToken(req.RefreshToken)
+	session, err := h.store.FindSessionByRefreshHash(hash)
+	if errors.Is(err, database.ErrRecordNotFound) {
+		ctx.JSON(http.StatusUnauthorized, AuthRefreshResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid refresh token",
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthRefreshResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	if session.RefreshHash != hash && !session.Revoked {
+		log.Printf("refresh token reuse detected for session %s", session.UUID)
+		if err := h.store.RevokeSession(session.UUID); err != nil {
+			log.Println("failed to revoke session:", err)
+		}
+		h.notifier.DisconnectSessions(session.UUID)
+	}
+
+	if session.RefreshHash != hash || session.Revoked || session.ExpiresAt < time.Now().UnixMilli() {
+		ctx.JSON(http.StatusUnauthorized, AuthRefreshResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid refresh token",
+		})
+		return
+	}
+
+	user, err := h.store.FindUserByUUID(session.UserUUID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, AuthRefreshResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "user not found",
+		})
+		return
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthRefreshResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to generate refresh token",
+		})
+		return
+	}
+
+	expiresAt := time.Now().Add(refreshTokenTTL(session.Remember)).UnixMilli()
+	rotated, err := h.store.RotateSession(session.UUID, hash, utils.HashRefreshToken(refreshToken), expiresAt)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthRefreshResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	} else if !rotated {
+		ctx.JSON(http.StatusUnauthorized, AuthRefreshResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "invalid refresh token",
+		})
+		return
+	}
+
+	authorization, err := utils.GenerateJWT(user.UUID, user.Username, session.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthRefreshResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to generate authorization",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AuthRefreshResponse{
+		Code:    http.StatusOK,
+		Message: "refresh authorization successfully",
+		Data: AuthTokenData{
+			Authorization: authorization,
+			RefreshToken:  refreshToken,
+			ExpiresIn:     int64(config.ACCESS_TOKEN_TTL.Seconds()),
+		},
+	})
+}
+
+type AuthLogoutResponse struct {
+	Code    uint   `json:"code"`
+	Message string `json:"message"`
+}
+
+func (h *Handler) HandleAuthLogout(ctx *gin.Context) {
+	sessionID := middleware.AuthSessionID(ctx)
+	if err := h.store.RevokeSession(sessionID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthLogoutResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+	h.notifier.DisconnectSessions(sessionID)
+
+	ctx.JSON(http.StatusOK, AuthLogoutResponse{
+		Code:    http.StatusOK,
+		Message: "logout successfully",
+	})
+}
+
+func (h *Handler) HandleAuthLogoutAll(ctx *gin.Context) {
+	if err := h.revokeUserSessions(middleware.AuthUUID(ctx)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, AuthLogoutResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, AuthLogoutResponse{
+		Code:    http.StatusOK,
+		Message: "logout all devices successfully",
+	})
+}
@@ -4,9 +4,6 @@ import (
 	"net/http"
 	"time"
 
-	"double-ratchet-server/database"
-	"double-ratchet-server/utils"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -21,7 +18,7 @@ type AuthValidResponse struct {
 	Message string `json:"message"`
 }
 
-func HandleAuthValid(ctx *gin.Context) {
+func (h *Handler) HandleAuthValid(ctx *gin.Context) {
 	var req AuthValidRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, AuthValidResponse{
@@ -31,7 +28,7 @@ func HandleAuthValid(ctx *gin.Context) {
 		return
 	}
 
-	claims, err := utils.ParseJWT(req.Authorization)
+	claims, err := h.authenticate(req.Authorization)
 	if err != nil || claims.Username != req.Username || claims.UUID != req.UUID {
 		ctx.JSON(http.StatusUnauthorized, AuthValidResponse{
 			Code:    http.StatusUnauthorized,
@@ -40,8 +37,7 @@ func HandleAuthValid(ctx *gin.Context) {
 		return
 	}
 
-	var user database.User
-	if err := database.MDB.Where("username = ? AND uuid = ?", req.Username, req.UUID).First(&user).Error; err != nil {
+	if user, err := h.store.FindUserByUUID(req.UUID); err != nil || user.Username != req.Username {
 		ctx.JSON(http.StatusUnauthorized, AuthValidResponse{
 			Code:    http.StatusUnauthorized,
 			Message: "user not found",
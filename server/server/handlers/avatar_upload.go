@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/server/middleware"
+	"double-ratchet-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AvatarUploadData struct {
+	AvatarUrl string `json:"avatar_url"`
+}
+
+type AvatarUploadResponse struct {
+	Code    uint             `json:"code"`
+	Message string           `json:"message"`
+	Data    AvatarUploadData `json:"data"`
+}
+
+// HandleAvatarUpload takes a multipart form with an `avatar` image file.
+func (h *Handler) HandleAvatarUpload(ctx *gin.Context) {
+	// NOTE: 额外预留 64KB 给 multipart 表单的其它字段
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, int64(config.AVATAR_MAX_SIZE)+64<<10)
+
+	header, err := ctx.FormFile("avatar")
+	if err != nil || header.Size > int64(config.AVATAR_MAX_SIZE) {
+		ctx.JSON(http.StatusBadRequest, AvatarUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, AvatarUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(config.AVATAR_MAX_SIZE)))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, AvatarUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	outputs, err := utils.ProcessAvatar(data)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, AvatarUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	name, err := saveAvatar(outputs)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, AvatarUploadResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "save avatar failed",
+		})
+		return
+	}
+
+	avatarUrl := fmt.Sprintf("%sapi/avatars/%s", config.ROOT_PATH, name)
+	userUUID := middleware.AuthUUID(ctx)
+	if err := h.store.UpdateUserAvatar(userUUID, avatarUrl); err != nil {
+		ctx.JSON(http.StatusInternalServerError, AvatarUploadResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "update user record failed",
+		})
+		return
+	}
+
+	h.notifier.NotifyProfileChanged(userUUID)
+
+	ctx.JSON(http.StatusOK, AvatarUploadResponse{
+		Code:    http.StatusOK,
+		Message: "upload avatar successfully",
+		Data: AvatarUploadData{
+			AvatarUrl: avatarUrl,
+		},
+	})
+}
+
+// saveAvatar names the files after the digest of the default size, so an
+// identical avatar is stored once. Other sizes get a `_<size>` suffix.
+func saveAvatar(outputs map[int][]byte) (string, error) {
+	digest := sha256.Sum256(outputs[utils.AvatarSizes[0]])
+	hash := hex.EncodeToString(digest[:])
+
+	if err := os.MkdirAll(config.AVATAR_PATH, 0o750); err != nil {
+		return "", err
+	}
+
+	for index, size := range utils.AvatarSizes {
+		name := hash + ".png"
+		if index > 0 {
+			name = fmt.Sprintf("%s_%d.png", hash, size)
+		}
+
+		path := filepath.Join(config.AVATAR_PATH, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+
+		temp, err := os.CreateTemp(config.AVATAR_PATH, ".avatar-*")
+		if err != nil {
+			return "", err
+		}
+		if _, err := temp.Write(outputs[size]); err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			return "", err
+		}
+		if err := temp.Close(); err != nil {
+			os.Remove(temp.Name())
+			return "", err
+		}
+		if err := os.Chmod(temp.Name(), 0o644); err != nil {
+			os.Remove(temp.Name())
+			return "", err
+		}
+		if err := os.Rename(temp.Name(), path); err != nil {
+			os.Remove(temp.Name())
+			return "", err
+		}
+	}
+	return hash + ".png", nil
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"double-ratchet-server/blob"
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratelimit"
+	"double-ratchet-server/server/middleware"
+	"double-ratchet-server/utils"
+)
+
+// Notifier lets the REST handlers push changes to live websocket clients.
+type Notifier interface {
+	NotifyProfileChanged(uuid string)
+	NotifyIdentityKeyChanged(uuid string)
+	DisconnectSessions(sessionIDs ...string)
+}
+
+type Handler struct {
+	store    database.Store
+	blobs    blob.Store
+	notifier Notifier
+	accounts *ratelimit.Limiter
+	bundles  *ratelimit.Limiter
+	lockout  *ratelimit.Lockout
+}
+
+func NewHandler(store database.Store, blobs blob.Store, notifier Notifier, limits ratelimit.Backend) *Handler {
+	return &Handler{
+		store:    store,
+		blobs:    blobs,
+		notifier: notifier,
+		accounts: ratelimit.NewLimiter(limits, "account", ratelimit.Limit{
+			Burst:    config.RATE_LIMIT_ACCOUNT_BURST,
+			Interval: config.RATE_LIMIT_ACCOUNT_INTERVAL,
+		}),
+		bundles: ratelimit.NewLimiter(limits, "bundle", ratelimit.Limit{
+			Burst:    config.RATE_LIMIT_BUNDLE_BURST,
+			Interval: config.RATE_LIMIT_BUNDLE_INTERVAL,
+		}),
+		lockout: ratelimit.NewLockout(limits, "lockout", ratelimit.LockoutPolicy{
+			Threshold: config.LOCKOUT_THRESHOLD,
+			Window:    config.LOCKOUT_WINDOW,
+			Base:      config.LOCKOUT_BASE,
+			Max:       config.LOCKOUT_MAX,
+		}),
+	}
+}
+
+func (h *Handler) authenticate(token string) (*utils.Claims, error) {
+	return middleware.Authenticate(h.store, token)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"log"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/signature"
+)
+
+// identityKey parses the identity key of the user with its recorded
+// algorithm, and records the algorithm for users registered before it was.
+func (h *Handler) identityKey(user *database.User) (*signature.PublicKey, error) {
+	key, err := signature.ParseUserKey(user.PublicKey, user.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.KeyAlgorithm == "" {
+		if err := h.store.UpdateUserKeyAlgorithm(user.UUID, key.Algorithm); err != nil {
+			log.Println("failed to record identity key algorithm:", err)
+		}
+		user.KeyAlgorithm = key.Algorithm
+	}
+	return key, nil
+}
+
+// identityKeyHistory returns the key history of the user. Users registered
+// before the history was kept get their current key as the only entry.
+func (h *Handler) identityKeyHistory(user *database.User) ([]database.IdentityKey, error) {
+	keys, err := h.store.ListIdentityKeys(user.UUID)
+	if err != nil || len(keys) > 0 {
+		return keys, err
+	}
+
+	current, err := h.identityKey(user)
+	if err != nil {
+		return nil, err
+	}
+	return []database.IdentityKey{{
+		UserUUID:     user.UUID,
+		PublicKey:    user.PublicKey,
+		KeyAlgorithm: current.Algorithm,
+		Fingerprint:  current.Fingerprint(),
+	}}, nil
+}
+
+// rotateIdentityKey replaces the identity key of the user, keeps the old one
+// in the history and tells every friend about the change.
+func (h *Handler) rotateIdentityKey(user *database.User, encoded string, key *signature.PublicKey) error {
+	history, err := h.store.ListIdentityKeys(user.UUID)
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		if previous, err := h.identityKey(user); err == nil {
+			if err := h.store.CreateIdentityKey(&database.IdentityKey{
+				UserUUID:     user.UUID,
+				PublicKey:    user.PublicKey,
+				KeyAlgorithm: previous.Algorithm,
+				Fingerprint:  previous.Fingerprint(),
+			}); err != nil {
+				log.Println("failed to record previous identity key:", err)
+			}
+		}
+	}
+
+	if err := h.store.RotateIdentityKey(&database.IdentityKey{
+		UserUUID:     user.UUID,
+		PublicKey:    encoded,
+		KeyAlgorithm: key.Algorithm,
+		Fingerprint:  key.Fingerprint(),
+	}); err != nil {
+		return err
+	}
+
+	h.notifier.NotifyIdentityKeyChanged(user.UUID)
+	return nil
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"double-ratchet-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSResponse struct {
+	Keys []utils.JWK `json:"keys"`
+}
+
+// HandleJWKS publishes the verification keys so other services can check
+// our access tokens without sharing a secret.
+func (h *Handler) HandleJWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, JWKSResponse{Keys: utils.PublicKeys()})
+}
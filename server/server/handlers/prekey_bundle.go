@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PrekeyBundleData struct {
+	UUID          string             `json:"uuid"`
+	IdentityKey   string             `json:"identity_key"`
+	SignedPrekey  PrekeySignedItem   `json:"signed_prekey"`
+	OneTimePrekey *PrekeyOneTimeItem `json:"one_time_prekey,omitempty"`
+}
+
+type PrekeyBundleResponse struct {
+	Code    uint             `json:"code"`
+	Message string           `json:"message"`
+	Data    PrekeyBundleData `json:"data"`
+}
+
+func (h *Handler) HandlePrekeyBundle(ctx *gin.Context) {
+	user, err := h.store.FindUserByUUID(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, PrekeyBundleResponse{
+			Code:    http.StatusNotFound,
+			Message: "user not exist",
+		})
+		return
+	}
+
+	// NOTE: 每次拉取都会消耗目标的一次性预密钥，按 (请求者, 目标用户) 限流
+	if allowed, retryAfter := h.bundles.Allow(middleware.AuthUUID(ctx) + ":" + user.UUID); !allowed {
+		middleware.AbortTooManyRequests(ctx, retryAfter)
+		return
+	}
+
+	signedPrekey, err := h.store.FindSignedPrekey(user.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, PrekeyBundleResponse{
+			Code:    http.StatusNotFound,
+			Message: "prekey bundle not exist",
+		})
+		return
+	}
+
+	oneTimePrekey, err := h.store.ConsumeOneTimePrekey(user.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, PrekeyBundleResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	data := PrekeyBundleData{
+		UUID:        user.UUID,
+		IdentityKey: user.PublicKey,
+		SignedPrekey: PrekeySignedItem{
+			KeyID:     signedPrekey.KeyID,
+			PublicKey: signedPrekey.PublicKey,
+			Signature: signedPrekey.Signature,
+		},
+	}
+
+	// NOTE: 一次性预密钥耗尽时，只返回签名预密钥
+	if oneTimePrekey != nil {
+		data.OneTimePrekey = &PrekeyOneTimeItem{
+			KeyID:     oneTimePrekey.KeyID,
+			PublicKey: oneTimePrekey.PublicKey,
+		}
+	}
+
+	ctx.JSON(http.StatusOK, PrekeyBundleResponse{
+		Code:    http.StatusOK,
+		Message: "fetch prekey bundle successfully",
+		Data:    data,
+	})
+}
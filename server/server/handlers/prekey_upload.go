@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratchet"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NOTE: 每个用户最多保存的一次性预密钥数量
+const maxOneTimePrekeys = 100
+
+type PrekeySignedItem struct {
+	KeyID     uint   `json:"key_id"`
+	PublicKey string `json:"public_key" binding:"required"`
+	Signature string `json:"signature" binding:"required"`
+}
+
+type PrekeyOneTimeItem struct {
+	KeyID     uint   `json:"key_id"`
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+type PrekeyUploadRequest struct {
+	SignedPrekey   *PrekeySignedItem   `json:"signed_prekey"`
+	OneTimePrekeys []PrekeyOneTimeItem `json:"one_time_prekeys" binding:"dive"`
+}
+
+type PrekeyUploadData struct {
+	OneTimePrekeys int64 `json:"one_time_prekeys"`
+}
+
+type PrekeyUploadResponse struct {
+	Code    uint             `json:"code"`
+	Message string           `json:"message"`
+	Data    PrekeyUploadData `json:"data"`
+}
+
+func (h *Handler) HandlePrekeyUpload(ctx *gin.Context) {
+	var req PrekeyUploadRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, PrekeyUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	user, err := h.store.FindUserByUUID(middleware.AuthUUID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, PrekeyUploadResponse{
+			Code:    http.StatusUnauthorized,
+			Message: "user not found",
+		})
+		return
+	}
+
+	for _, prekey := range req.OneTimePrekeys {
+		if _, err := ratchet.ImportPublicKey(prekey.PublicKey); err != nil {
+			ctx.JSON(http.StatusBadRequest, PrekeyUploadResponse{
+				Code:    http.StatusBadRequest,
+				Message: "invalid one-time prekey format",
+			})
+			return
+		}
+	}
+
+	if req.SignedPrekey != nil {
+		if _, err := ratchet.ImportPublicKey(req.SignedPrekey.PublicKey); err != nil {
+			ctx.JSON(http.StatusBadRequest, PrekeyUploadResponse{
+				Code:    http.StatusBadRequest,
+				Message: "invalid signed prekey format",
+			})
+			return
+		}
+
+		pubKey, err := h.identityKey(user)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, PrekeyUploadResponse{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		sigBytes, err := base64.StdEncoding.DecodeString(req.SignedPrekey.Signature)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, PrekeyUploadResponse{
+				Code:    http.StatusBadRequest,
+				Message: "incorrect encoding method for signature",
+			})
+			return
+		}
+
+		if !pubKey.Verify([]byte(req.SignedPrekey.PublicKey), sigBytes) {
+			ctx.JSON(http.StatusUnauthorized, PrekeyUploadResponse{
+				Code:    http.StatusUnauthorized,
+				Message: "invalid signed prekey signature",
+			})
+			return
+		}
+	}
+
+	count, err := h.store.CountOneTimePrekeys(user.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, PrekeyUploadResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	if count+int64(len(req.OneTimePrekeys)) > maxOneTimePrekeys {
+		ctx.JSON(http.StatusBadRequest, PrekeyUploadResponse{
+			Code:    http.StatusBadRequest,
+			Message: "too many one-time prekeys",
+		})
+		return
+	}
+
+	if req.SignedPrekey != nil {
+		signedPrekey := database.SignedPrekey{
+			UserUUID:  user.UUID,
+			KeyID:     req.SignedPrekey.KeyID,
+			PublicKey: req.SignedPrekey.PublicKey,
+			Signature: req.SignedPrekey.Signature,
+		}
+
+		if err := h.store.SaveSignedPrekey(&signedPrekey); err != nil {
+			ctx.JSON(http.StatusInternalServerError, PrekeyUploadResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "update signed prekey failed",
+			})
+			return
+		}
+	}
+
+	if len(req.OneTimePrekeys) > 0 {
+		prekeys := []database.OneTimePrekey{}
+		for _, prekey := range req.OneTimePrekeys {
+			prekeys = append(prekeys, database.OneTimePrekey{
+				UserUUID:  user.UUID,
+				KeyID:     prekey.KeyID,
+				PublicKey: prekey.PublicKey,
+			})
+		}
+
+		// 重复上传的 key_id 直接忽略
+		if err := h.store.CreateOneTimePrekeys(prekeys); err != nil {
+			ctx.JSON(http.StatusInternalServerError, PrekeyUploadResponse{
+				Code:    http.StatusInternalServerError,
+				Message: "create one-time prekeys failed",
+			})
+			return
+		}
+	}
+
+	if count, err = h.store.CountOneTimePrekeys(user.UUID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, PrekeyUploadResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, PrekeyUploadResponse{
+		Code:    http.StatusOK,
+		Message: "upload prekeys successfully",
+		Data: PrekeyUploadData{
+			OneTimePrekeys: count,
+		},
+	})
+}
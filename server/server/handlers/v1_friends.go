@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type V1FriendsResponse struct {
+	Code    uint         `json:"code"`
+	Message string       `json:"message"`
+	Data    []V1UserItem `json:"data"`
+}
+
+func (h *Handler) HandleV1Friends(ctx *gin.Context) {
+	friends, err := h.store.ListFriends(middleware.AuthUUID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1FriendsResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	items := []V1UserItem{}
+	for _, friend := range friends {
+		user, err := h.store.FindUserByUUID(friend.FriendUUID)
+		if err != nil {
+			log.Printf("failed to fetch user info for friend %s: %v", friend.FriendUUID, err)
+			continue
+		}
+		items = append(items, newV1UserItem(user))
+	}
+
+	ctx.JSON(http.StatusOK, V1FriendsResponse{
+		Code:    http.StatusOK,
+		Message: "fetch friends successfully",
+		Data:    items,
+	})
+}
+
+// isFriend reports whether friendUUID is in the friend list of userUUID.
+func (h *Handler) isFriend(userUUID, friendUUID string) (bool, error) {
+	friends, err := h.store.ListFriends(userUUID)
+	if err != nil {
+		return false, err
+	}
+	for _, friend := range friends {
+		if friend.FriendUUID == friendUUID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+	"double-ratchet-server/signature"
+
+	"github.com/gin-gonic/gin"
+)
+
+type V1IdentityKeyItem struct {
+	PublicKey    string `json:"public_key"`
+	KeyAlgorithm string `json:"key_algorithm"`
+	Fingerprint  string `json:"fingerprint"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type V1IdentityKeysResponse struct {
+	Code    uint                `json:"code"`
+	Message string              `json:"message"`
+	Data    []V1IdentityKeyItem `json:"data"`
+}
+
+// HandleV1IdentityKeys returns the identity key history of a user, oldest
+// first, the last entry is the current key.
+func (h *Handler) HandleV1IdentityKeys(ctx *gin.Context) {
+	user, err := h.store.FindUserByUUID(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, V1IdentityKeysResponse{
+			Code:    http.StatusNotFound,
+			Message: "user not exist",
+		})
+		return
+	}
+
+	keys, err := h.identityKeyHistory(user)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1IdentityKeysResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	items := []V1IdentityKeyItem{}
+	for _, key := range keys {
+		items = append(items, V1IdentityKeyItem{
+			PublicKey:    key.PublicKey,
+			KeyAlgorithm: key.KeyAlgorithm,
+			Fingerprint:  key.Fingerprint,
+			CreatedAt:    key.CreatedAt,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, V1IdentityKeysResponse{
+		Code:    http.StatusOK,
+		Message: "fetch identity keys successfully",
+		Data:    items,
+	})
+}
+
+type V1SafetyNumberData struct {
+	SafetyNumber string `json:"safety_number"`
+	Fingerprint  string `json:"fingerprint"`
+	Verified     bool   `json:"verified"`
+}
+
+type V1SafetyNumberResponse struct {
+	Code    uint               `json:"code"`
+	Message string             `json:"message"`
+	Data    V1SafetyNumberData `json:"data"`
+}
+
+// safetyNumber computes the safety number between the caller and a friend,
+// and returns the friendship and the fingerprint of the friend's key with it.
+func (h *Handler) safetyNumber(uuid, friendUUID string) (*database.Friend, V1SafetyNumberData, error) {
+	friend, err := h.store.FindFriend(uuid, friendUUID)
+	if err != nil {
+		return nil, V1SafetyNumberData{}, err
+	}
+
+	user, err := h.store.FindUserByUUID(uuid)
+	if err != nil {
+		return nil, V1SafetyNumberData{}, err
+	}
+	friendUser, err := h.store.FindUserByUUID(friendUUID)
+	if err != nil {
+		return nil, V1SafetyNumberData{}, err
+	}
+
+	userKey, err := h.identityKey(user)
+	if err != nil {
+		return nil, V1SafetyNumberData{}, err
+	}
+	friendKey, err := h.identityKey(friendUser)
+	if err != nil {
+		return nil, V1SafetyNumberData{}, err
+	}
+
+	fingerprint := friendKey.Fingerprint()
+	return friend, V1SafetyNumberData{
+		SafetyNumber: signature.SafetyNumber(uuid, userKey, friendUUID, friendKey),
+		Fingerprint:  fingerprint,
+		Verified:     friend.VerifiedKey == fingerprint,
+	}, nil
+}
+
+func (h *Handler) HandleV1SafetyNumber(ctx *gin.Context) {
+	_, data, err := h.safetyNumber(middleware.AuthUUID(ctx), ctx.Param("uuid"))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		ctx.JSON(http.StatusNotFound, V1SafetyNumberResponse{
+			Code:    http.StatusNotFound,
+			Message: "friend not exist",
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1SafetyNumberResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to compute safety number",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, V1SafetyNumberResponse{
+		Code:    http.StatusOK,
+		Message: "fetch safety number successfully",
+		Data:    data,
+	})
+}
+
+type V1VerifyKeyRequest struct {
+	SafetyNumber string `json:"safety_number" binding:"required"`
+}
+
+// HandleV1VerifyKey marks the current key of a friend as verified. The caller
+// sends the safety number it compared, so a key that rotated in between is
+// not marked by accident.
+func (h *Handler) HandleV1VerifyKey(ctx *gin.Context) {
+	var req V1VerifyKeyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, V1SafetyNumberResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal form data",
+		})
+		return
+	}
+
+	uuid := middleware.AuthUUID(ctx)
+	friend, data, err := h.safetyNumber(uuid, ctx.Param("uuid"))
+	if errors.Is(err, database.ErrRecordNotFound) {
+		ctx.JSON(http.StatusNotFound, V1SafetyNumberResponse{
+			Code:    http.StatusNotFound,
+			Message: "friend not exist",
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1SafetyNumberResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "failed to compute safety number",
+		})
+		return
+	}
+
+	if req.SafetyNumber != data.SafetyNumber {
+		ctx.JSON(http.StatusConflict, V1SafetyNumberResponse{
+			Code:    http.StatusConflict,
+			Message: "safety number has changed",
+			Data:    data,
+		})
+		return
+	}
+
+	if err := h.store.UpdateFriendVerifiedKey(uuid, friend.FriendUUID, data.Fingerprint); err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1SafetyNumberResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	data.Verified = true
+	ctx.JSON(http.StatusOK, V1SafetyNumberResponse{
+		Code:    http.StatusOK,
+		Message: "identity key verified",
+		Data:    data,
+	})
+}
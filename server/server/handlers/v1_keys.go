@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type V1KeychainItem struct {
+	UUID     string `json:"uuid"`
+	ChainIV  string `json:"chain_iv"`
+	ChainKey string `json:"chain_key"`
+	Version  uint64 `json:"version"`
+}
+
+// V1KeysData is everything the client needs to restore its sessions, the
+// private key and keychains are encrypted with the client secret.
+type V1KeysData struct {
+	PublicKey      string            `json:"public_key"`
+	PrivateIV      string            `json:"private_iv"`
+	PrivateKey     string            `json:"private_key"`
+	SignedPrekey   *PrekeySignedItem `json:"signed_prekey,omitempty"`
+	OneTimePrekeys int64             `json:"one_time_prekeys"`
+	Keychains      []V1KeychainItem  `json:"keychains"`
+}
+
+type V1KeysResponse struct {
+	Code    uint       `json:"code"`
+	Message string     `json:"message"`
+	Data    V1KeysData `json:"data"`
+}
+
+func (h *Handler) HandleV1Keys(ctx *gin.Context) {
+	user, err := h.store.FindUserByUUID(middleware.AuthUUID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, V1KeysResponse{
+			Code:    http.StatusNotFound,
+			Message: "user not exist",
+		})
+		return
+	}
+
+	data := V1KeysData{
+		PublicKey:  user.PublicKey,
+		PrivateIV:  user.PrivateIV,
+		PrivateKey: user.PrivateKey,
+		Keychains:  []V1KeychainItem{},
+	}
+
+	signedPrekey, err := h.store.FindSignedPrekey(user.UUID)
+	if err == nil {
+		data.SignedPrekey = &PrekeySignedItem{
+			KeyID:     signedPrekey.KeyID,
+			PublicKey: signedPrekey.PublicKey,
+			Signature: signedPrekey.Signature,
+		}
+	} else if !errors.Is(err, database.ErrRecordNotFound) {
+		ctx.JSON(http.StatusInternalServerError, V1KeysResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	if data.OneTimePrekeys, err = h.store.CountOneTimePrekeys(user.UUID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1KeysResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	friends, err := h.store.ListFriends(user.UUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1KeysResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	for _, friend := range friends {
+		data.Keychains = append(data.Keychains, V1KeychainItem{
+			UUID:     friend.FriendUUID,
+			ChainIV:  friend.ChainIV,
+			ChainKey: friend.ChainKey,
+			Version:  friend.ChainVersion,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, V1KeysResponse{
+		Code:    http.StatusOK,
+		Message: "fetch key material successfully",
+		Data:    data,
+	})
+}
+
+type V1KeychainVersionItem struct {
+	Version   uint64 `json:"version"`
+	ChainIV   string `json:"chain_iv"`
+	ChainKey  string `json:"chain_key"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type V1KeychainVersionsResponse struct {
+	Code    uint                    `json:"code"`
+	Message string                  `json:"message"`
+	Data    []V1KeychainVersionItem `json:"data"`
+}
+
+// HandleV1KeychainVersions returns the kept keychain versions with a friend,
+// newest first, so a client can recover a ratchet state that was overwritten.
+func (h *Handler) HandleV1KeychainVersions(ctx *gin.Context) {
+	uuid := middleware.AuthUUID(ctx)
+	friendUUID := ctx.Param("uuid")
+
+	if ok, err := h.isFriend(uuid, friendUUID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1KeychainVersionsResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	} else if !ok {
+		ctx.JSON(http.StatusNotFound, V1KeychainVersionsResponse{
+			Code:    http.StatusNotFound,
+			Message: "friend not exist",
+		})
+		return
+	}
+
+	versions, err := h.store.ListKeychainVersions(uuid, friendUUID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1KeychainVersionsResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	items := []V1KeychainVersionItem{}
+	for _, version := range versions {
+		items = append(items, V1KeychainVersionItem{
+			Version:   version.Version,
+			ChainIV:   version.ChainIV,
+			ChainKey:  version.ChainKey,
+			CreatedAt: version.CreatedAt,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, V1KeychainVersionsResponse{
+		Code:    http.StatusOK,
+		Message: "fetch keychains successfully",
+		Data:    items,
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+	"double-ratchet-server/server/websocket"
+
+	"github.com/gin-gonic/gin"
+)
+
+type V1MessageItem struct {
+	ID        uint   `json:"id"`
+	Type      string `json:"type"`
+	Sender    string `json:"sender"`
+	Receiver  string `json:"receiver"`
+	Data      string `json:"data"`
+	Status    string `json:"status"`
+	Sequence  uint64 `json:"seq,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Cursor    string `json:"cursor"`
+}
+
+// V1MessagesResponse.NextCursor continues the page in the same direction and
+// is only set when HasMore is.
+type V1MessagesResponse struct {
+	Code       uint            `json:"code"`
+	Message    string          `json:"message"`
+	Data       []V1MessageItem `json:"data"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	HasMore    bool            `json:"has_more"`
+}
+
+// HandleV1Messages returns a page of the delivered history with a friend.
+// The page is newest first, or oldest first when only `after` is given, both
+// cursors take either a returned cursor or a millisecond timestamp.
+func (h *Handler) HandleV1Messages(ctx *gin.Context) {
+	uuid := middleware.AuthUUID(ctx)
+	friendUUID := ctx.Param("uuid")
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(database.DefaultHistoryLimit)))
+	if err != nil || limit <= 0 || limit > database.MaxHistoryLimit {
+		ctx.JSON(http.StatusBadRequest, V1MessagesResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal limit",
+		})
+		return
+	}
+
+	if ok, err := h.isFriend(uuid, friendUUID); err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1MessagesResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	} else if !ok {
+		ctx.JSON(http.StatusNotFound, V1MessagesResponse{
+			Code:    http.StatusNotFound,
+			Message: "friend not exist",
+		})
+		return
+	}
+
+	query := database.HistoryQuery{
+		UserUUID:   uuid,
+		FriendUUID: friendUUID,
+		Types:      []string{websocket.WSTypeTextMessage},
+		Limit:      limit,
+	}
+	if query.Before, err = parseHistoryCursor(ctx.Query("before")); err != nil {
+		ctx.JSON(http.StatusBadRequest, V1MessagesResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal cursor",
+		})
+		return
+	}
+	if query.After, err = parseHistoryCursor(ctx.Query("after")); err != nil {
+		ctx.JSON(http.StatusBadRequest, V1MessagesResponse{
+			Code:    http.StatusBadRequest,
+			Message: "illegal cursor",
+		})
+		return
+	}
+
+	messages, hasMore, err := h.store.ListHistory(query)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, V1MessagesResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "server database error",
+		})
+		return
+	}
+
+	items := []V1MessageItem{}
+	for _, msg := range messages {
+		items = append(items, V1MessageItem{
+			ID:        msg.ID,
+			Type:      msg.Type,
+			Sender:    msg.Sender,
+			Receiver:  msg.Receiver,
+			Data:      msg.Data,
+			Status:    msg.Status,
+			Sequence:  msg.Sequence,
+			Timestamp: msg.Timestamp,
+			Cursor:    database.MessageCursor(&msg).String(),
+		})
+	}
+
+	response := V1MessagesResponse{
+		Code:    http.StatusOK,
+		Message: "fetch messages successfully",
+		Data:    items,
+		HasMore: hasMore,
+	}
+	if hasMore {
+		response.NextCursor = items[len(items)-1].Cursor
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+func parseHistoryCursor(value string) (*database.HistoryCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+	return database.ParseHistoryCursor(value)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+type V1UserItem struct {
+	UUID         string `json:"uuid"`
+	Username     string `json:"username"`
+	AvatarUrl    string `json:"avatar_url"`
+	PublicKey    string `json:"public_key"`
+	KeyAlgorithm string `json:"key_algorithm"`
+}
+
+type V1UserResponse struct {
+	Code    uint       `json:"code"`
+	Message string     `json:"message"`
+	Data    V1UserItem `json:"data"`
+}
+
+func newV1UserItem(user *database.User) V1UserItem {
+	return V1UserItem{
+		UUID:         user.UUID,
+		Username:     user.Username,
+		AvatarUrl:    user.AvatarUrl,
+		PublicKey:    user.PublicKey,
+		KeyAlgorithm: user.KeyAlgorithm,
+	}
+}
+
+func (h *Handler) HandleV1Profile(ctx *gin.Context) {
+	user, err := h.store.FindUserByUUID(middleware.AuthUUID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, V1UserResponse{
+			Code:    http.StatusNotFound,
+			Message: "user not exist",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, V1UserResponse{
+		Code:    http.StatusOK,
+		Message: "fetch profile successfully",
+		Data:    newV1UserItem(user),
+	})
+}
+
+func (h *Handler) HandleV1User(ctx *gin.Context) {
+	user, err := h.store.FindUserByUUID(ctx.Param("uuid"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, V1UserResponse{
+			Code:    http.StatusNotFound,
+			Message: "user not exist",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, V1UserResponse{
+		Code:    http.StatusOK,
+		Message: "fetch user successfully",
+		Data:    newV1UserItem(user),
+	})
+}
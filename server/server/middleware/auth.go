@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ContextUUIDKey      = "auth_uuid"
+	ContextUsernameKey  = "auth_username"
+	ContextSessionIDKey = "auth_session"
+)
+
+var (
+	ErrInvalidToken   = errors.New("invalid authorization")
+	ErrSessionRevoked = errors.New("session revoked")
+)
+
+// Authenticate checks the access token and that its session is still live,
+// every entry point that accepts a token goes through here.
+func Authenticate(store database.SessionStore, token string) (*utils.Claims, error) {
+	if !utils.ValidateJWT(token) {
+		return nil, ErrInvalidToken
+	}
+
+	claims, err := utils.ParseJWT(token)
+	if err != nil || claims.SessionID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	session, err := store.FindSession(claims.SessionID)
+	if err != nil || session.Revoked || session.UserUUID != claims.UUID {
+		return nil, ErrSessionRevoked
+	}
+	return claims, nil
+}
+
+// Authorization rejects requests without a valid `Authorization: Bearer`
+// token and stores the identity of the caller in the gin context.
+func Authorization(store database.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		scheme, token, found := strings.Cut(ctx.GetHeader("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			abortUnauthorized(ctx, ErrInvalidToken)
+			return
+		}
+
+		claims, err := Authenticate(store, token)
+		if err != nil {
+			abortUnauthorized(ctx, err)
+			return
+		}
+
+		ctx.Set(ContextUUIDKey, claims.UUID)
+		ctx.Set(ContextUsernameKey, claims.Username)
+		ctx.Set(ContextSessionIDKey, claims.SessionID)
+		ctx.Next()
+	}
+}
+
+func abortUnauthorized(ctx *gin.Context, err error) {
+	ctx.Header("WWW-Authenticate", `Bearer realm="api"`)
+	ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"code":    http.StatusUnauthorized,
+		"message": err.Error(),
+	})
+}
+
+// AuthUUID returns the uuid of the caller set by Authorization.
+func AuthUUID(ctx *gin.Context) string {
+	return ctx.GetString(ContextUUIDKey)
+}
+
+// AuthUsername returns the username of the caller set by Authorization.
+func AuthUsername(ctx *gin.Context) string {
+	return ctx.GetString(ContextUsernameKey)
+}
+
+// AuthSessionID returns the session of the caller set by Authorization.
+func AuthSessionID(ctx *gin.Context) string {
+	return ctx.GetString(ContextSessionIDKey)
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"double-ratchet-server/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit limits the requests of every client IP with limiter.
+func RateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if allowed, retryAfter := limiter.Allow(ctx.ClientIP()); !allowed {
+			AbortTooManyRequests(ctx, retryAfter)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// AbortTooManyRequests responds 429 with Retry-After rounded up to seconds.
+func AbortTooManyRequests(ctx *gin.Context, retryAfter time.Duration) {
+	seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"code":    http.StatusTooManyRequests,
+		"message": "too many requests",
+	})
+}
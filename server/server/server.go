@@ -1,25 +1,34 @@
 package server
 
 import (
+	"expvar"
+	"log"
 	"net/http"
 
+	"double-ratchet-server/blob"
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratelimit"
 	"double-ratchet-server/server/handlers"
+	"double-ratchet-server/server/middleware"
 	"double-ratchet-server/server/websocket"
 
 	"github.com/gin-gonic/gin"
 )
 
-var ServiceServer *http.Server
-
-func init() {
+func NewServiceServer(store database.Store, blobs blob.Store, limits ratelimit.Backend) *http.Server {
 	gin.SetMode(gin.DebugMode)
 
 	router := gin.Default()
+	// NOTE: 限流和锁定都以 ClientIP 为键，只有可信代理转发的 X-Forwarded-For 才会被采用
+	if err := router.SetTrustedProxies(config.TRUSTED_PROXIES); err != nil {
+		log.Fatalf("invalid trusted proxies: %s\n", err)
+	}
 	router.Use(func(ctx *gin.Context) {
 		ctx.Writer.Header().Set("Access-Control-Max-Age", "86400")
 		ctx.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		ctx.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-		ctx.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type,Content-Length")
+		ctx.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,Content-Length,Range")
 		if ctx.Request.Method == http.MethodOptions {
 			ctx.Status(http.StatusNoContent)
 			return
@@ -27,17 +36,55 @@ func init() {
 		ctx.Next()
 	})
 
+	hub := websocket.NewHub(store)
+	handler := handlers.NewHandler(store, blobs, hub, limits)
+	ipLimit := middleware.RateLimit(ratelimit.NewLimiter(limits, "ip", ratelimit.Limit{
+		Burst:    config.RATE_LIMIT_IP_BURST,
+		Interval: config.RATE_LIMIT_IP_INTERVAL,
+	}))
+
+	router.GET("/.well-known/jwks.json", handler.HandleJWKS)
+	if config.METRICS_PATH != "" {
+		router.GET(config.METRICS_PATH, gin.WrapH(expvar.Handler()))
+	}
+
 	// Don't Need Authorization Header
 	routerGroup := router.Group("/api")
+	// NOTE: 浏览器的 WebSocket 无法设置请求头，所以 /websocket 仍用 ?token= 鉴权；
+	// /auth/valid 本身就是校验 token 的接口，token 放在请求体中。其余需要登录的接口都在 /v1 下
 	// Upgrade GET method to WebSocket Connect
-	routerGroup.GET("/websocket", websocket.HandleWebSocket)
+	routerGroup.GET("/websocket", hub.HandleWebSocket)
 	// Router methods below
-	routerGroup.POST("/auth/valid", handlers.HandleAuthValid)
-	routerGroup.POST("/auth/login", handlers.HandleAuthLogin)
-	routerGroup.POST("/auth/forgot", handlers.HandleAuthForgot)
-	routerGroup.POST("/auth/register", handlers.HandleAuthRegister)
+	routerGroup.POST("/auth/valid", ipLimit, handler.HandleAuthValid)
+	routerGroup.POST("/auth/login", ipLimit, handler.HandleAuthLogin)
+	routerGroup.POST("/auth/forgot", ipLimit, handler.HandleAuthForgot)
+	routerGroup.POST("/auth/challenge", ipLimit, handler.HandleAuthChallenge)
+	routerGroup.POST("/auth/register", ipLimit, handler.HandleAuthRegister)
+	routerGroup.POST("/auth/refresh", ipLimit, handler.HandleAuthRefresh)
+	routerGroup.Static("/avatars", config.AVATAR_PATH)
+
+	// Need Authorization: Bearer Header
+	v1Group := routerGroup.Group("/v1", middleware.Authorization(store))
+	v1Group.POST("/auth/logout", handler.HandleAuthLogout)
+	v1Group.POST("/auth/logout-all", handler.HandleAuthLogoutAll)
+	v1Group.GET("/profile", handler.HandleV1Profile)
+	v1Group.POST("/profile/avatar", handler.HandleAvatarUpload)
+	v1Group.GET("/users/:uuid", handler.HandleV1User)
+	v1Group.GET("/users/:uuid/identity-keys", handler.HandleV1IdentityKeys)
+	v1Group.POST("/users/:uuid/prekey-bundle", handler.HandlePrekeyBundle)
+	v1Group.GET("/friends", handler.HandleV1Friends)
+	v1Group.GET("/friends/:uuid/safety-number", handler.HandleV1SafetyNumber)
+	v1Group.POST("/friends/:uuid/verify", handler.HandleV1VerifyKey)
+	v1Group.GET("/friends/:uuid/keychains", handler.HandleV1KeychainVersions)
+	v1Group.GET("/messages/:uuid", handler.HandleV1Messages)
+	v1Group.GET("/keys", handler.HandleV1Keys)
+	v1Group.POST("/keys/prekeys", handler.HandlePrekeyUpload)
+	v1Group.POST("/attachments", handler.HandleAttachmentCreate)
+	v1Group.POST("/attachments/:uuid/chunks", handler.HandleAttachmentUpload)
+	v1Group.GET("/attachments/:uuid/status", handler.HandleAttachmentStatus)
+	v1Group.GET("/attachments/:uuid", handler.HandleAttachmentDownload)
 
-	ServiceServer = &http.Server{
+	return &http.Server{
 		Addr:    "0.0.0.0:8080",
 		Handler: router,
 	}
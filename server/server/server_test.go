@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"double-ratchet-server/blob"
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratelimit"
+	"double-ratchet-server/server/handlers"
+	"double-ratchet-server/utils"
+
+	"github.com/google/uuid"
+)
+
+func newTestServer(t *testing.T, store database.Store) http.Handler {
+	t.Helper()
+
+	blobs, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServiceServer(store, blobs, ratelimit.NewMemoryBackend()).Handler
+}
+
+func loadKeySet(t *testing.T) {
+	t.Helper()
+
+	config.JWT_KEYSET_PATH = filepath.Join(t.TempDir(), "jwks.json")
+	if _, err := utils.LoadKeySet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// issueToken opens a session for userUUID and returns its access token.
+func issueToken(t *testing.T, store database.Store, userUUID string) string {
+	t.Helper()
+
+	loadKeySet(t)
+
+	session := database.Session{
+		UUID:        uuid.NewString(),
+		UserUUID:    userUUID,
+		RefreshHash: uuid.NewString(),
+		ExpiresAt:   time.Now().Add(time.Hour).UnixMilli(),
+	}
+	if err := store.CreateSession(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := utils.GenerateJWT(userUUID, userUUID, session.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func serve(handler http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAttachmentRoutesRequireBearer(t *testing.T) {
+	store := database.NewMemoryStore()
+	handler := newTestServer(t, store)
+	owner := uuid.NewString()
+	token := issueToken(t, store, owner)
+
+	recorder := serve(handler, http.MethodPost, "/api/v1/attachments/"+uuid.NewString()+"/chunks?offset=0&token="+token, "", "chunk")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("query token: status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	recorder = serve(handler, http.MethodGet, "/api/v1/attachments/"+uuid.NewString()+"/status", token, "")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("unknown attachment: status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestAttachmentCreateChecksRecipients(t *testing.T) {
+	store := database.NewMemoryStore()
+	handler := newTestServer(t, store)
+	owner, friend, stranger := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	token := issueToken(t, store, owner)
+
+	if err := store.CreateFriend(&database.Friend{UserUUID: owner, FriendUUID: friend}); err != nil {
+		t.Fatal(err)
+	}
+	joined := database.Group{UUID: uuid.NewString(), Name: "joined", Owner: owner}
+	if err := store.CreateGroup(&joined, []database.GroupMember{{GroupUUID: joined.UUID, UserUUID: owner}}); err != nil {
+		t.Fatal(err)
+	}
+	foreign := database.Group{UUID: uuid.NewString(), Name: "foreign", Owner: stranger}
+	if err := store.CreateGroup(&foreign, []database.GroupMember{{GroupUUID: foreign.UUID, UserUUID: stranger}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recipients []string
+		want       int
+	}{
+		{"friend and joined group", []string{friend, joined.UUID}, http.StatusOK},
+		{"stranger", []string{friend, stranger}, http.StatusForbidden},
+		{"foreign group", []string{foreign.UUID}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{"size": 16, "recipients": test.recipients})
+			if recorder := serve(handler, http.MethodPost, "/api/v1/attachments", token, string(body)); recorder.Code != test.want {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.want, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestPrekeyAndAvatarRoutesRequireBearer(t *testing.T) {
+	handler := newTestServer(t, database.NewMemoryStore())
+
+	for _, target := range []string{
+		"/api/v1/keys/prekeys",
+		"/api/v1/users/" + uuid.NewString() + "/prekey-bundle",
+		"/api/v1/profile/avatar",
+	} {
+		if recorder := serve(handler, http.MethodPost, target, "", "{}"); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", target, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestForgotUnknownUserLooksLikeFailedProof(t *testing.T) {
+	handler := newTestServer(t, database.NewMemoryStore())
+
+	recorder := serve(handler, http.MethodPost, "/api/auth/challenge", "", `{"username":"ghost"}`)
+	var challenge struct {
+		Data struct {
+			Nonce string `json:"nonce"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &challenge); err != nil || challenge.Data.Nonce == "" {
+		t.Fatalf("challenge: %d %s", recorder.Code, recorder.Body)
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"username":    "ghost",
+		"password":    "password",
+		"nonce":       challenge.Data.Nonce,
+		"signinfo":    "c2lnbmF0dXJl",
+		"timestamp":   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		"private_iv":  "iv",
+		"private_key": "key",
+	})
+	recorder = serve(handler, http.MethodPost, "/api/auth/forgot", "", string(body))
+	if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "invalid private key file") {
+		t.Fatalf("forgot: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	store := database.NewMemoryStore()
+	handler := newTestServer(t, store)
+	loadKeySet(t)
+
+	user := database.User{UUID: uuid.NewString(), Username: "alice"}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	session := database.Session{
+		UUID:        uuid.NewString(),
+		UserUUID:    user.UUID,
+		RefreshHash: utils.HashRefreshToken("first"),
+		ExpiresAt:   time.Now().Add(time.Hour).UnixMilli(),
+	}
+	if err := store.CreateSession(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(token string) (int, handlers.AuthTokenData) {
+		var response struct {
+			Data handlers.AuthTokenData `json:"data"`
+		}
+		recorder := serve(handler, http.MethodPost, "/api/auth/refresh", "", `{"refresh_token":"`+token+`"}`)
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response.Data
+	}
+
+	code, rotated := refresh("first")
+	if code != http.StatusOK || rotated.RefreshToken == "" || rotated.RefreshToken == "first" {
+		t.Fatalf("refresh = %d %+v, want a new refresh token", code, rotated)
+	}
+	if recorder := serve(handler, http.MethodGet, "/api/v1/profile", rotated.Authorization, ""); recorder.Code != http.StatusOK {
+		t.Fatalf("profile with the refreshed token = %d", recorder.Code)
+	}
+
+	// the rotated token shows up again, somebody else holds a copy
+	if code, _ := refresh("first"); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if stored, err := store.FindSession(session.UUID); err != nil || !stored.Revoked {
+		t.Fatalf("session after reuse = %+v, %v, want revoked", stored, err)
+	}
+	if code, _ := refresh(rotated.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("current refresh token of the revoked session = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if recorder := serve(handler, http.MethodGet, "/api/v1/profile", rotated.Authorization, ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("access token of the revoked session = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSpoofedForwardedForDoesNotResetLockout(t *testing.T) {
+	handler := newTestServer(t, database.NewMemoryStore())
+
+	for attempt := 1; attempt <= config.LOCKOUT_THRESHOLD+1; attempt++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(`{"username":"alice","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", attempt))
+		req.RemoteAddr = "198.51.100.7:4000"
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		want := http.StatusUnauthorized
+		if attempt > config.LOCKOUT_THRESHOLD {
+			want = http.StatusTooManyRequests
+		}
+		if recorder.Code != want {
+			t.Fatalf("attempt %d: status = %d, want %d", attempt, recorder.Code, want)
+		}
+	}
+}
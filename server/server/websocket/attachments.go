@@ -0,0 +1,68 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+
+	"double-ratchet-server/database"
+)
+
+// WSAttachmentData references an uploaded blob, the decryption key and IV of
+// the blob travel inside the ratchet encrypted content.
+type WSAttachmentData struct {
+	Attachment string `json:"attachment"`
+	WSTextData
+}
+
+// handleAttachment relays an attachment to a friend, or to a group for
+// group_attachment, the policy has already checked the receiver.
+func (h *Hub) handleAttachment(client *Client, frame WSFrame, content WSAttachmentData) {
+	attachment, err := h.store.FindAttachment(content.Attachment)
+	if err != nil || attachment.Owner != frame.Sender || !attachment.Completed {
+		log.Printf("attachment %s is not available for %s", content.Attachment, frame.Sender)
+		sendError(client, frame, ErrCodeNotFound, "attachment is not available")
+		return
+	}
+
+	recipients, err := h.store.ListAttachmentRecipients(attachment.UUID)
+	if err != nil {
+		log.Println("failed to fetch attachment recipients:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch attachment recipients")
+		return
+	} else if !slices.Contains(recipients, frame.Receiver) {
+		log.Printf("%s is not a recipient of attachment %s", frame.Receiver, attachment.UUID)
+		sendError(client, frame, ErrCodeForbidden, "receiver is not a recipient of the attachment")
+		return
+	}
+
+	if frame.Type == WSTypeGroupAttachment {
+		h.handleGroupMessage(client, frame, content.WSTextData)
+		return
+	}
+
+	newMsg := database.Message{
+		Type:        frame.Type,
+		Sender:      frame.Sender,
+		Receiver:    frame.Receiver,
+		Data:        frame.Data,
+		IsDelivered: false,
+		Timestamp:   content.Timestamp,
+	}
+
+	if err := h.store.CreateMessage(&newMsg); err != nil {
+		log.Println("failed to store attachment message:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store attachment message")
+		return
+	}
+
+	updatedRaw, err := json.Marshal(frame.relay(newMsg.ID))
+	if err != nil {
+		log.Println("failed to marshal updated attachment message:", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay attachment message")
+		return
+	}
+
+	h.deliverMessage(&newMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID})
+}
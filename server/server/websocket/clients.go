@@ -3,47 +3,134 @@ package websocket
 import (
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/ratelimit"
 
 	"github.com/gorilla/websocket"
 )
 
+// NOTE: 未携带设备号的旧客户端统一视为同一个默认设备
+const DefaultDeviceID = "default"
+
 type Client struct {
-	UUID    string
-	Conn    *websocket.Conn
-	ConnMux sync.Mutex
+	UUID      string
+	DeviceID  string
+	SessionID string
+	Conn      *websocket.Conn
+	ConnMux   sync.Mutex
+
+	// NOTE: 令牌桶只属于当前连接，只在读循环中使用，不需要加锁
+	frames *ratelimit.Bucket
+	// lastSeen is the unix milli of the last frame or pong from the client
+	lastSeen atomic.Int64
+	queue    *sendQueue
 }
 
-var Clients = make(map[string]*Client)
-var ClientsMutex sync.RWMutex
+func (h *Hub) AddClient(uuid, deviceID, sessionID string, conn *websocket.Conn) *Client {
+	h.clientsMux.Lock()
+	defer h.clientsMux.Unlock()
+
+	client := &Client{
+		UUID:      uuid,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+		Conn:      conn,
+		frames: ratelimit.NewBucket(ratelimit.Limit{
+			Burst:    config.RATE_LIMIT_FRAME_BURST,
+			Interval: config.RATE_LIMIT_FRAME_INTERVAL,
+		}),
+		queue: newSendQueue(),
+	}
+	if _, ok := h.clients[uuid]; !ok {
+		h.clients[uuid] = make(map[*Client]struct{})
+	}
+	h.clients[uuid][client] = struct{}{}
+	client.touch(time.Now())
+	go client.runWriter()
 
-func AddClient(uuid string, conn *websocket.Conn) {
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
-	Clients[uuid] = &Client{UUID: uuid, Conn: conn}
+	log.Printf("Client [%s] device [%s] is connected", uuid, deviceID)
+	return client
+}
 
-	log.Printf("Client [%s] is connected", uuid)
+func (h *Hub) RemoveClient(client *Client) {
+	h.clientsMux.Lock()
+	defer h.clientsMux.Unlock()
+	if devices, ok := h.clients[client.UUID]; ok {
+		if _, ok := devices[client]; ok {
+			client.Conn.Close()
+			client.queue.close()
+			delete(devices, client)
+			h.outbox.drop(client)
+			log.Printf("client [%s] device [%s] is disconnected", client.UUID, client.DeviceID)
+		}
+		if len(devices) == 0 {
+			delete(h.clients, client.UUID)
+		}
+	}
 }
 
-func RemoveClient(uuid string) {
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
-	if client, ok := Clients[uuid]; ok {
-		client.Conn.Close()
-		delete(Clients, uuid)
+func (h *Hub) GetClients(uuid string) []*Client {
+	h.clientsMux.RLock()
+	defer h.clientsMux.RUnlock()
+	clients := make([]*Client, 0, len(h.clients[uuid]))
+	for client := range h.clients[uuid] {
+		clients = append(clients, client)
 	}
+	return clients
+}
 
-	log.Printf("client [%s] is disconnected", uuid)
+func (h *Hub) allClients() []*Client {
+	h.clientsMux.RLock()
+	defer h.clientsMux.RUnlock()
+	clients := []*Client{}
+	for _, devices := range h.clients {
+		for client := range devices {
+			clients = append(clients, client)
+		}
+	}
+	return clients
 }
 
-func GetClient(uuid string) (*Client, bool) {
-	ClientsMutex.RLock()
-	defer ClientsMutex.RUnlock()
-	client, exist := Clients[uuid]
-	return client, exist
+// DisconnectSessions closes every live connection opened with one of the
+// revoked sessions, the read loop then removes the client as usual.
+func (h *Hub) DisconnectSessions(sessionIDs ...string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+
+	revoked := make(map[string]struct{}, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		revoked[sessionID] = struct{}{}
+	}
+
+	for _, client := range h.allClients() {
+		if _, ok := revoked[client.SessionID]; !ok {
+			continue
+		}
+
+		client.ConnMux.Lock()
+		message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+		client.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		client.ConnMux.Unlock()
+
+		client.Conn.Close()
+		log.Printf("client [%s] device [%s] session is revoked", client.UUID, client.DeviceID)
+	}
 }
 
-func SafeWrite(client *Client, messageType int, data []byte) error {
-	client.ConnMux.Lock()
-	defer client.ConnMux.Unlock()
-	return client.Conn.WriteMessage(messageType, data)
+// SendToUser fans a frame out to every device of the user and returns how
+// many devices it was queued for.
+func (h *Hub) SendToUser(uuid string, data []byte) int {
+	sent := 0
+	for _, client := range h.GetClients(uuid) {
+		if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+			log.Printf("failed to write to %s device %s: %v", uuid, client.DeviceID, err)
+			continue
+		}
+		sent++
+	}
+	return sent
 }
@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"errors"
+
+	"double-ratchet-server/database"
+)
+
+const maxDeviceIDLength = 64
+
+func (h *Hub) registerDevice(uuid, deviceID string) error {
+	_, err := h.store.FindDevice(uuid, deviceID)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, database.ErrRecordNotFound) {
+		return err
+	}
+
+	cursor, err := h.store.MaxMessageID()
+	if err != nil {
+		return err
+	}
+
+	return h.store.CreateDevice(&database.Device{
+		UserUUID: uuid,
+		DeviceID: deviceID,
+		Cursor:   cursor,
+	})
+}
+
+// confirmDelivery records the ack of one device. IsDelivered keeps meaning
+// "acked by at least one device", which the friend list history relies on.
+func (h *Hub) confirmDelivery(client *Client, messageID uint) error {
+	delivery := database.MessageDelivery{
+		MessageID: messageID,
+		UserUUID:  client.UUID,
+		DeviceID:  client.DeviceID,
+	}
+	if err := h.store.CreateMessageDelivery(&delivery); err != nil {
+		return err
+	}
+	h.outbox.ack(client, messageID)
+
+	msg, err := h.store.FindMessage(messageID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Receiver != client.UUID {
+		if _, err := h.store.FindGroup(msg.Receiver); err == nil {
+			return h.confirmGroupDelivery(client, msg)
+		}
+	}
+
+	acked, err := h.store.MarkMessageAcked(messageID)
+	if err != nil || !acked {
+		return err
+	}
+	h.notifyDeliveryStatus(msg, database.MessageAcked)
+	return nil
+}
+
+// undeliveredMessages selects the messages a device has not acked yet:
+// anything no device has acked, plus everything newer than its registration.
+func (h *Hub) undeliveredMessages(client *Client) ([]database.Message, error) {
+	device, err := h.store.FindDevice(client.UUID, client.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	return h.store.ListDeviceMessages(device)
+}
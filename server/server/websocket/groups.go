@@ -0,0 +1,473 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+
+	"double-ratchet-server/database"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxGroupMembers    = 256
+	maxGroupNameLength = 64
+)
+
+// NOTE: group_update 中的事件类型
+const (
+	GroupEventCreate = "create"
+	GroupEventInvite = "invite"
+	GroupEventRemove = "remove"
+)
+
+type WSGroupMemberItem struct {
+	UUID      string `json:"uuid"`
+	Username  string `json:"username"`
+	AvatarUrl string `json:"avatar_url"`
+	PublicKey string `json:"public_key"`
+}
+
+type WSGroupListItem struct {
+	UUID    string              `json:"uuid"`
+	Name    string              `json:"name"`
+	Owner   string              `json:"owner"`
+	Members []WSGroupMemberItem `json:"members"`
+}
+
+type WSGroupCreateData struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type WSGroupMembersData struct {
+	Group   string   `json:"group"`
+	Members []string `json:"members"`
+}
+
+type WSGroupUpdateData struct {
+	Event   string          `json:"event"`
+	Members []string        `json:"members"`
+	Group   WSGroupListItem `json:"group"`
+}
+
+// WSGroupSenderKeyData carries a sender key distribution message, the
+// content is encrypted with the pairwise ratchet of sender and receiver.
+type WSGroupSenderKeyData struct {
+	Group string `json:"group"`
+	WSTextData
+}
+
+func (h *Hub) groupListItem(group *database.Group) (WSGroupListItem, error) {
+	members, err := h.store.ListGroupMembers(group.UUID)
+	if err != nil {
+		return WSGroupListItem{}, err
+	}
+
+	item := WSGroupListItem{
+		UUID:    group.UUID,
+		Name:    group.Name,
+		Owner:   group.Owner,
+		Members: []WSGroupMemberItem{},
+	}
+	for _, member := range members {
+		user, err := h.store.FindUserByUUID(member.UserUUID)
+		if err != nil {
+			log.Printf("failed to fetch user info for member %s: %v", member.UserUUID, err)
+			continue
+		}
+		item.Members = append(item.Members, WSGroupMemberItem{
+			UUID:      user.UUID,
+			Username:  user.Username,
+			AvatarUrl: user.AvatarUrl,
+			PublicKey: user.PublicKey,
+		})
+	}
+	return item, nil
+}
+
+func (h *Hub) pushGroupList(client *Client) {
+	groups, err := h.store.ListUserGroups(client.UUID)
+	if err != nil {
+		log.Println("failed to fetch group list:", err)
+		return
+	}
+
+	groupList := []WSGroupListItem{}
+	for _, group := range groups {
+		item, err := h.groupListItem(&group)
+		if err != nil {
+			log.Printf("failed to fetch members for group %s: %v", group.UUID, err)
+			continue
+		}
+		groupList = append(groupList, item)
+	}
+
+	content, err := json.Marshal(groupList)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	data, err := json.Marshal(WSFrame{
+		ID:       0,
+		Type:     WSTypeUpdateGrouplist,
+		Sender:   client.UUID,
+		Receiver: client.UUID,
+		Data:     string(content),
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send group list to %s: %v", client.UUID, err)
+	}
+}
+
+// sendGroupUpdate stores one group_update per receiver so members that are
+// offline learn about membership changes and can rotate their sender keys.
+func (h *Hub) sendGroupUpdate(sender string, group *database.Group, event string, members []string, receivers []string) {
+	item, err := h.groupListItem(group)
+	if err != nil {
+		log.Printf("failed to fetch members for group %s: %v", group.UUID, err)
+		return
+	}
+
+	content, err := json.Marshal(WSGroupUpdateData{Event: event, Members: members, Group: item})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	for _, receiver := range receivers {
+		newMsg := database.Message{
+			Type:        WSTypeGroupUpdate,
+			Sender:      sender,
+			Receiver:    receiver,
+			Data:        string(content),
+			IsDelivered: false,
+		}
+		if err := h.store.CreateMessage(&newMsg); err != nil {
+			log.Println("failed to store group update:", err)
+			continue
+		}
+
+		data, err := json.Marshal(WSFrame{
+			ID:       newMsg.ID,
+			Type:     newMsg.Type,
+			Sender:   newMsg.Sender,
+			Receiver: newMsg.Receiver,
+			Data:     newMsg.Data,
+		})
+		if err != nil {
+			log.Println("failed to marshal group update:", err)
+			continue
+		}
+
+		h.deliverMessage(&newMsg, data, h.GetClients(receiver))
+	}
+}
+
+// friendsOf filters candidates down to distinct friends of the user.
+func (h *Hub) friendsOf(userUUID string, candidates []string) ([]string, error) {
+	friends, err := h.store.ListFriends(userUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, candidate := range candidates {
+		if slices.Contains(result, candidate) {
+			continue
+		}
+		if slices.ContainsFunc(friends, func(friend database.Friend) bool { return friend.FriendUUID == candidate }) {
+			result = append(result, candidate)
+		}
+	}
+	return result, nil
+}
+
+func groupMemberUUIDs(members []database.GroupMember) []string {
+	uuids := make([]string, 0, len(members))
+	for _, member := range members {
+		uuids = append(uuids, member.UserUUID)
+	}
+	return uuids
+}
+
+func (h *Hub) handleGroupCreate(client *Client, frame WSFrame, content WSGroupCreateData) {
+	if content.Name == "" || len(content.Name) > maxGroupNameLength {
+		log.Printf("invalid group name from %s", frame.Sender)
+		sendError(client, frame, ErrCodeInvalidArgument, "invalid group name")
+		return
+	}
+
+	invitees, err := h.friendsOf(frame.Sender, content.Members)
+	if err != nil {
+		log.Println("failed to fetch friend list:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch friend list")
+		return
+	}
+	if len(invitees)+1 > maxGroupMembers {
+		log.Printf("too many group members from %s", frame.Sender)
+		sendError(client, frame, ErrCodeInvalidArgument, "too many group members")
+		return
+	}
+
+	cursor, err := h.store.MaxMessageID()
+	if err != nil {
+		log.Println("failed to fetch message cursor:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to create group")
+		return
+	}
+
+	group := database.Group{
+		UUID:  uuid.NewString(),
+		Name:  content.Name,
+		Owner: frame.Sender,
+	}
+
+	members := []database.GroupMember{{GroupUUID: group.UUID, UserUUID: frame.Sender, Cursor: cursor}}
+	for _, invitee := range invitees {
+		members = append(members, database.GroupMember{GroupUUID: group.UUID, UserUUID: invitee, Cursor: cursor})
+	}
+
+	if err := h.store.CreateGroup(&group, members); err != nil {
+		log.Println("failed to create group:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to create group")
+		return
+	}
+
+	h.sendGroupUpdate(frame.Sender, &group, GroupEventCreate, invitees, groupMemberUUIDs(members))
+	sendResponse(client, frame, WSResponseData{Group: group.UUID})
+}
+
+func (h *Hub) handleGroupInvite(client *Client, frame WSFrame, content WSGroupMembersData) {
+	group, err := h.store.FindGroup(content.Group)
+	if err != nil {
+		log.Printf("group %s not found: %v", content.Group, err)
+		sendError(client, frame, ErrCodeNotFound, "group not exist")
+		return
+	} else if group.Owner != frame.Sender {
+		log.Printf("%s is not allowed to invite members to %s", frame.Sender, group.UUID)
+		sendError(client, frame, ErrCodeForbidden, "only the owner can invite members")
+		return
+	}
+
+	members, err := h.store.ListGroupMembers(group.UUID)
+	if err != nil {
+		log.Println("failed to fetch group members:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch group members")
+		return
+	}
+
+	invitees, err := h.friendsOf(frame.Sender, content.Members)
+	if err != nil {
+		log.Println("failed to fetch friend list:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch friend list")
+		return
+	}
+	invitees = slices.DeleteFunc(invitees, func(invitee string) bool {
+		return slices.Contains(groupMemberUUIDs(members), invitee)
+	})
+	if len(invitees) == 0 {
+		sendResponse(client, frame, WSResponseData{Group: group.UUID})
+		return
+	} else if len(members)+len(invitees) > maxGroupMembers {
+		log.Printf("too many group members in %s", group.UUID)
+		sendError(client, frame, ErrCodeInvalidArgument, "too many group members")
+		return
+	}
+
+	cursor, err := h.store.MaxMessageID()
+	if err != nil {
+		log.Println("failed to fetch message cursor:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to invite members")
+		return
+	}
+
+	for _, invitee := range invitees {
+		member := database.GroupMember{GroupUUID: group.UUID, UserUUID: invitee, Cursor: cursor}
+		if err := h.store.AddGroupMember(&member); err != nil && !errors.Is(err, database.ErrDuplicated) {
+			log.Printf("failed to add %s to group %s: %v", invitee, group.UUID, err)
+		}
+	}
+
+	members, err = h.store.ListGroupMembers(group.UUID)
+	if err != nil {
+		log.Println("failed to fetch group members:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch group members")
+		return
+	}
+
+	h.sendGroupUpdate(frame.Sender, group, GroupEventInvite, invitees, groupMemberUUIDs(members))
+	sendResponse(client, frame, WSResponseData{Group: group.UUID})
+}
+
+// handleGroupRemove lets the owner remove members and any member leave, the
+// remaining members are told so they can rotate their sender keys.
+func (h *Hub) handleGroupRemove(client *Client, frame WSFrame, content WSGroupMembersData) {
+	group, err := h.store.FindGroup(content.Group)
+	if err != nil {
+		log.Printf("group %s not found: %v", content.Group, err)
+		sendError(client, frame, ErrCodeNotFound, "group not exist")
+		return
+	}
+
+	members, err := h.store.ListGroupMembers(group.UUID)
+	if err != nil {
+		log.Println("failed to fetch group members:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch group members")
+		return
+	}
+	receivers := groupMemberUUIDs(members)
+
+	removed := []string{}
+	for _, member := range content.Members {
+		if !slices.Contains(receivers, member) || slices.Contains(removed, member) {
+			continue
+		} else if member == group.Owner {
+			log.Printf("owner of group %s can not be removed", group.UUID)
+			continue
+		} else if frame.Sender != group.Owner && frame.Sender != member {
+			log.Printf("%s is not allowed to remove %s from %s", frame.Sender, member, group.UUID)
+			continue
+		}
+
+		if err := h.store.RemoveGroupMember(group.UUID, member); err != nil {
+			log.Printf("failed to remove %s from group %s: %v", member, group.UUID, err)
+			continue
+		}
+		removed = append(removed, member)
+	}
+
+	if len(removed) == 0 {
+		sendError(client, frame, ErrCodeForbidden, "no member was removed")
+		return
+	}
+
+	h.sendGroupUpdate(frame.Sender, group, GroupEventRemove, removed, receivers)
+	sendResponse(client, frame, WSResponseData{Group: group.UUID})
+}
+
+// handleGroupMessage stores the sender key ciphertext once and fans it out
+// to every device of every other member.
+func (h *Hub) handleGroupMessage(client *Client, frame WSFrame, content WSTextData) {
+	if _, err := h.store.FindGroupMember(frame.Receiver, frame.Sender); err != nil {
+		log.Printf("%s is not a member of group %s", frame.Sender, frame.Receiver)
+		sendError(client, frame, ErrCodeForbidden, "not a member of the group")
+		return
+	}
+
+	members, err := h.store.ListGroupMembers(frame.Receiver)
+	if err != nil {
+		log.Println("failed to fetch group members:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch group members")
+		return
+	}
+
+	newMsg := database.Message{
+		Type:        frame.Type,
+		Sender:      frame.Sender,
+		Receiver:    frame.Receiver,
+		Data:        frame.Data,
+		IsDelivered: false,
+		Timestamp:   content.Timestamp,
+	}
+
+	if err := h.store.CreateMessage(&newMsg); err != nil {
+		log.Println("failed to store group message:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store group message")
+		return
+	}
+
+	updatedRaw, err := json.Marshal(frame.relay(newMsg.ID))
+	if err != nil {
+		log.Println("failed to marshal updated group message:", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay group message")
+		return
+	}
+
+	clients := []*Client{}
+	for _, member := range members {
+		if member.UserUUID != frame.Sender {
+			clients = append(clients, h.GetClients(member.UserUUID)...)
+		}
+	}
+
+	h.deliverMessage(&newMsg, updatedRaw, clients)
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID})
+}
+
+func (h *Hub) handleGroupSenderKey(client *Client, frame WSFrame, content WSGroupSenderKeyData) {
+	for _, member := range []string{frame.Sender, frame.Receiver} {
+		if _, err := h.store.FindGroupMember(content.Group, member); err != nil {
+			log.Printf("%s is not a member of group %s", member, content.Group)
+			sendError(client, frame, ErrCodeForbidden, "not a member of the group")
+			return
+		}
+	}
+
+	newMsg := database.Message{
+		Type:        frame.Type,
+		Sender:      frame.Sender,
+		Receiver:    frame.Receiver,
+		Data:        frame.Data,
+		IsDelivered: false,
+		Timestamp:   content.Timestamp,
+	}
+
+	if err := h.store.CreateMessage(&newMsg); err != nil {
+		log.Println("failed to store sender key:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store sender key")
+		return
+	}
+
+	updatedRaw, err := json.Marshal(frame.relay(newMsg.ID))
+	if err != nil {
+		log.Println("failed to marshal updated sender key:", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay sender key")
+		return
+	}
+
+	h.deliverMessage(&newMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID})
+}
+
+// confirmGroupDelivery records the first ack of a member and reports it to
+// the sender, the message counts as acked once every other member has it.
+func (h *Hub) confirmGroupDelivery(client *Client, msg *database.Message) error {
+	if _, err := h.store.FindGroupMember(msg.Receiver, client.UUID); err != nil {
+		return err
+	}
+
+	first, err := h.store.CreateGroupReceipt(&database.GroupReceipt{MessageID: msg.ID, UserUUID: client.UUID})
+	if err != nil || !first {
+		return err
+	}
+	h.sendDeliveryStatus(msg, WSDeliveryStatusData{ID: msg.ID, Status: database.MessageAcked, Member: client.UUID})
+
+	members, err := h.store.ListGroupMembers(msg.Receiver)
+	if err != nil {
+		return err
+	}
+	received, err := h.store.CountGroupReceipts(msg.ID)
+	if err != nil {
+		return err
+	}
+	if received < int64(len(members)-1) {
+		return nil
+	}
+
+	acked, err := h.store.MarkMessageAcked(msg.ID)
+	if err != nil || !acked {
+		return err
+	}
+	h.notifyDeliveryStatus(msg, database.MessageAcked)
+	return nil
+}
@@ -2,9 +2,12 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 
+	"double-ratchet-server/config"
 	"double-ratchet-server/database"
+	"double-ratchet-server/ratchet"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,9 +19,9 @@ type WSUserListItem struct {
 	PublicKey string `json:"public_key"`
 }
 
-func pushUserList(uuid string) {
-	var users []database.User
-	if err := database.MDB.Find(&users).Error; err != nil {
+func (h *Hub) pushUserList(client *Client) {
+	users, err := h.store.ListUsers()
+	if err != nil {
 		log.Println("failed to fetch user list:", err)
 		return
 	}
@@ -42,8 +45,8 @@ func pushUserList(uuid string) {
 	result := WSFrame{
 		ID:       0,
 		Type:     WSTypeUpdateUserlist,
-		Sender:   uuid,
-		Receiver: uuid,
+		Sender:   client.UUID,
+		Receiver: client.UUID,
 		Data:     string(content),
 	}
 
@@ -53,13 +56,8 @@ func pushUserList(uuid string) {
 		return
 	}
 
-	if receiver, exist := GetClient(uuid); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, data); err != nil {
-			log.Printf("failed to send undelivered message to %s: %v", uuid, err)
-		}
-	} else {
-		log.Printf("user %s disconnected before delivery", uuid)
-		return
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send user list to %s: %v", client.UUID, err)
 	}
 }
 
@@ -71,39 +69,35 @@ type WSMessage struct {
 }
 
 type WSFriendListItem struct {
-	UUID      string      `json:"uuid"`
-	Username  string      `json:"username"`
-	AvatarUrl string      `json:"avatar_url"`
-	PublicKey string      `json:"public_key"`
-	ChainIV   string      `json:"chain_iv"`
-	ChainKey  string      `json:"chain_key"`
-	Messages  []WSMessage `json:"messages"`
+	UUID         string      `json:"uuid"`
+	Username     string      `json:"username"`
+	AvatarUrl    string      `json:"avatar_url"`
+	PublicKey    string      `json:"public_key"`
+	ChainIV      string      `json:"chain_iv"`
+	ChainKey     string      `json:"chain_key"`
+	ChainVersion uint64      `json:"chain_version"`
+	Messages     []WSMessage `json:"messages"`
 }
 
-func pushFriendList(uuid string) {
-	var friends []database.Friend
-	if err := database.MDB.Where("user_uuid = ?", uuid).Find(&friends).Error; err != nil {
+func (h *Hub) pushFriendList(client *Client) {
+	uuid := client.UUID
+
+	friends, err := h.store.ListFriends(uuid)
+	if err != nil {
 		log.Println("failed to fetch friend list:", err)
 		return
 	}
 
 	friendList := []WSFriendListItem{}
 	for _, friend := range friends {
-		var friendUser database.User
-		if err := database.MDB.Where("uuid = ?", friend.FriendUUID).First(&friendUser).Error; err != nil {
+		friendUser, err := h.store.FindUserByUUID(friend.FriendUUID)
+		if err != nil {
 			log.Printf("failed to fetch user info for friend %s: %v", friend.FriendUUID, err)
 			continue
 		}
 
-		var messages []database.Message
-		if err := database.MDB.
-			Where("is_delivered = ? AND ((sender = ? AND receiver = ?) OR (sender = ? AND receiver = ?)) AND type IN ?",
-				true, uuid, friend.FriendUUID, friend.FriendUUID, uuid,
-				[]string{WSTypeTextMessage},
-			).
-			Order("timestamp desc").
-			Limit(10).
-			Find(&messages).Error; err != nil {
+		messages, err := h.store.ListConversation(uuid, friend.FriendUUID, []string{WSTypeTextMessage}, 10)
+		if err != nil {
 			log.Printf("failed to fetch messages for friend %s: %v", friend.FriendUUID, err)
 		}
 
@@ -118,13 +112,14 @@ func pushFriendList(uuid string) {
 		}
 
 		friendList = append(friendList, WSFriendListItem{
-			UUID:      friendUser.UUID,
-			Username:  friendUser.Username,
-			AvatarUrl: friendUser.AvatarUrl,
-			PublicKey: friendUser.PublicKey,
-			ChainIV:   friend.ChainIV,
-			ChainKey:  friend.ChainKey,
-			Messages:  messageList,
+			UUID:         friendUser.UUID,
+			Username:     friendUser.Username,
+			AvatarUrl:    friendUser.AvatarUrl,
+			PublicKey:    friendUser.PublicKey,
+			ChainIV:      friend.ChainIV,
+			ChainKey:     friend.ChainKey,
+			ChainVersion: friend.ChainVersion,
+			Messages:     messageList,
 		})
 	}
 
@@ -148,23 +143,38 @@ func pushFriendList(uuid string) {
 		return
 	}
 
-	if receiver, exist := GetClient(uuid); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, data); err != nil {
-			log.Println("failed to forward friend_add:", err)
-		}
-	} else {
-		log.Printf("user %s disconnected before delivery", uuid)
-		return
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send friend list to %s: %v", uuid, err)
 	}
 }
 
-func pushUndeliveredMessages(uuid string) {
-	var messages []database.Message
+// NotifyProfileChanged refreshes the user list of everyone online and the
+// friend list of the user and its friends after a profile update.
+func (h *Hub) NotifyProfileChanged(uuid string) {
+	for _, client := range h.allClients() {
+		go h.pushUserList(client)
+	}
+
+	friends, err := h.store.ListFriends(uuid)
+	if err != nil {
+		log.Println("failed to fetch friend list:", err)
+		return
+	}
+
+	receivers := []string{uuid}
+	for _, friend := range friends {
+		receivers = append(receivers, friend.FriendUUID)
+	}
+	for _, receiver := range receivers {
+		for _, client := range h.GetClients(receiver) {
+			go h.pushFriendList(client)
+		}
+	}
+}
 
-	if err := database.MDB.
-		Where("receiver = ? AND is_delivered = ?", uuid, false).
-		Order("timestamp ASC").
-		Find(&messages).Error; err != nil {
+func (h *Hub) pushUndeliveredMessages(client *Client) {
+	messages, err := h.undeliveredMessages(client)
+	if err != nil {
 		log.Println("failed to fetch undelivered messages:", err)
 		return
 	}
@@ -176,18 +186,16 @@ func pushUndeliveredMessages(uuid string) {
 			Sender:   msg.Sender,
 			Receiver: msg.Receiver,
 			Data:     msg.Data,
+			Sequence: msg.Sequence,
 		})
 		if err != nil {
 			log.Println("failed to marshal undelivered message:", err)
 			continue
 		}
 
-		if receiver, exist := GetClient(uuid); exist {
-			if err := SafeWrite(receiver, websocket.TextMessage, data); err != nil {
-				log.Printf("failed to send undelivered message to %s: %v", uuid, err)
-			}
-		} else {
-			log.Printf("user %s disconnected before delivery", uuid)
+		h.outbox.track(client, msg.ID, data)
+		if err := replayMessage(client, msg.ID, data, h.markSent(&msg)); err != nil {
+			log.Printf("stopped replaying undelivered messages to %s: %v", client.UUID, err)
 			return
 		}
 	}
@@ -201,13 +209,7 @@ type WSTextData struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-func handleTextMessage(frame WSFrame) {
-	var content WSTextData
-	if err := json.Unmarshal([]byte(frame.Data), &content); err != nil {
-		log.Println("invalid message struct: ", err)
-		return
-	}
-
+func (h *Hub) handleTextMessage(client *Client, frame WSFrame, content WSTextData) {
 	newMsg := database.Message{
 		Type:        frame.Type,
 		Sender:      frame.Sender,
@@ -217,43 +219,56 @@ func handleTextMessage(frame WSFrame) {
 		Timestamp:   content.Timestamp,
 	}
 
-	if err := database.MDB.Create(&newMsg).Error; err != nil {
+	skipped, err := h.store.CreateSequencedMessage(&newMsg, content.XRatchet, content.YRatchet, int64(config.MESSAGE_MAX_SKIP))
+	if errors.Is(err, database.ErrSkipWindow) {
+		log.Printf("rejected message from %s to %s: skips %d message keys", frame.Sender, frame.Receiver, skipped)
+		sendError(client, frame, ErrCodeSkipWindow, "ratchet skip window exceeded")
+		return
+	} else if errors.Is(err, database.ErrRatchetInvalid) {
+		log.Printf("rejected message from %s to %s: ratchet position %d/%d", frame.Sender, frame.Receiver, content.XRatchet, content.YRatchet)
+		sendError(client, frame, ErrCodeInvalidArgument, "invalid ratchet position")
+		return
+	} else if err != nil {
 		log.Println("failed to store message:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store message")
 		return
 	}
 
-	frame.ID = newMsg.ID
+	// NOTE: 发送方跳过了消息密钥，说明中间有消息没有到达服务器
+	if skipped > 0 {
+		log.Printf("gap of %d message keys from %s to %s before sequence %d", skipped, frame.Sender, frame.Receiver, newMsg.Sequence)
+	}
+
+	relayed := frame.relay(newMsg.ID)
+	relayed.Sequence = newMsg.Sequence
 
-	updatedRaw, err := json.Marshal(frame)
+	updatedRaw, err := json.Marshal(relayed)
 	if err != nil {
 		log.Println("failed to marshal updated message:", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay message")
 		return
 	}
 
-	if receiver, exist := GetClient(frame.Receiver); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, updatedRaw); err != nil {
-			log.Println("failed to deliver text message:", err)
-		}
-	}
+	h.deliverMessage(&newMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID, Sequence: newMsg.Sequence})
 }
 
-func handleEventConfirm(frame WSFrame) {
+func (h *Hub) handleEventConfirm(client *Client, frame WSFrame) {
 	if frame.ID == 0 {
 		return
 	}
-	if err := database.MDB.Model(&database.Message{}).
-		Where("id = ?", frame.ID).
-		Update("is_delivered", true).Error; err != nil {
+	if err := h.confirmDelivery(client, frame.ID); err != nil {
 		log.Println("failed to update message read status:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to confirm delivery")
+		return
 	}
+	sendResponse(client, frame, WSResponseData{ID: frame.ID})
 }
 
-func handleEventAddFriend(frame WSFrame) {
-	var existing database.Message
-	if err := database.MDB.
-		Where("sender = ? AND receiver = ? AND type = ? AND is_delivered = ?", frame.Sender, frame.Receiver, frame.Type, false).
-		First(&existing).Error; err == nil {
+func (h *Hub) handleEventAddFriend(client *Client, frame WSFrame) {
+	if _, err := h.store.FindUndeliveredMessage(frame.Sender, frame.Receiver, frame.Type); err == nil {
 		log.Printf("duplicate request for add friend from %s to %s", frame.Sender, frame.Receiver)
+		sendError(client, frame, ErrCodeDuplicate, "friend request is already pending")
 		return
 	}
 
@@ -265,30 +280,25 @@ func handleEventAddFriend(frame WSFrame) {
 		IsDelivered: false,
 	}
 
-	if err := database.MDB.Create(&newMsg).Error; err != nil {
+	if err := h.store.CreateMessage(&newMsg); err != nil {
 		log.Println("failed to store add friend request: ", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store friend request")
 		return
 	}
 
-	frame.ID = newMsg.ID
-
-	updatedRaw, err := json.Marshal(frame)
+	updatedRaw, err := json.Marshal(frame.relay(newMsg.ID))
 	if err != nil {
 		log.Println("failed to marshal updated add friend request: ", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay friend request")
 		return
 	}
 
-	if receiver, exist := GetClient(frame.Receiver); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, updatedRaw); err != nil {
-			log.Println("failed to forward add friend request: ", err)
-		}
-	}
+	h.deliverMessage(&newMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID})
 }
 
-func handleEventDenyFriend(frame WSFrame) {
-	if err := database.MDB.Model(&database.Message{}).
-		Where("sender = ? AND receiver = ? AND type = ? AND is_delivered = ?", frame.Receiver, frame.Sender, WSTypeEventAddFriend, false).
-		Update("is_delivered", true).Error; err != nil {
+func (h *Hub) handleEventDenyFriend(client *Client, frame WSFrame) {
+	if err := h.store.AckUndeliveredMessages(frame.Receiver, frame.Sender, WSTypeEventAddFriend); err != nil {
 		log.Println("failed to update friend_add as delivered:", err)
 	}
 
@@ -299,41 +309,40 @@ func handleEventDenyFriend(frame WSFrame) {
 		Data:        frame.Data,
 		IsDelivered: false,
 	}
-	if err := database.MDB.Create(&denyMsg).Error; err != nil {
+	if err := h.store.CreateMessage(&denyMsg); err != nil {
 		log.Println("failed to store deny friend request: ", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store friend response")
 		return
 	}
 
-	frame.ID = denyMsg.ID
-
-	updatedRaw, err := json.Marshal(frame)
+	updatedRaw, err := json.Marshal(frame.relay(denyMsg.ID))
 	if err != nil {
 		log.Println("failed to marshal updated deny friend request: ", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay friend response")
 		return
 	}
 
-	if receiver, exist := GetClient(frame.Receiver); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, updatedRaw); err != nil {
-			log.Println("failed to notify denial: ", err)
-		}
-	}
+	h.deliverMessage(&denyMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: denyMsg.ID})
 }
 
-func handleEventAllowFriend(frame WSFrame) {
-	if err := database.MDB.Model(&database.Message{}).
-		Where("sender = ? AND receiver = ? AND type = ? AND is_delivered = ?", frame.Receiver, frame.Sender, WSTypeEventAddFriend, false).
-		Update("is_delivered", true).Error; err != nil {
+func (h *Hub) handleEventAllowFriend(client *Client, frame WSFrame) {
+	if err := h.store.AckUndeliveredMessages(frame.Receiver, frame.Sender, WSTypeEventAddFriend); err != nil {
 		log.Println("failed to update add friend request delivery status:", err)
 	}
 
 	friendItem1 := database.Friend{UserUUID: frame.Receiver, FriendUUID: frame.Sender}
 	friendItem2 := database.Friend{UserUUID: frame.Sender, FriendUUID: frame.Receiver}
 
-	if err := database.MDB.Create(&friendItem2).Error; err != nil {
+	if err := h.store.CreateFriend(&friendItem2); err != nil && !errors.Is(err, database.ErrDuplicated) {
 		log.Printf("failed to add friend for %v: %v\n", frame.Sender, err.Error())
+		sendError(client, frame, ErrCodeStorage, "failed to store friendship")
+		return
 	}
-	if err := database.MDB.Create(&friendItem1).Error; err != nil {
+	if err := h.store.CreateFriend(&friendItem1); err != nil && !errors.Is(err, database.ErrDuplicated) {
 		log.Printf("failed to add friend for %v: %v\n", frame.Receiver, err.Error())
+		sendError(client, frame, ErrCodeStorage, "failed to store friendship")
+		return
 	}
 
 	allowMsg := database.Message{
@@ -343,49 +352,143 @@ func handleEventAllowFriend(frame WSFrame) {
 		Data:        frame.Data,
 		IsDelivered: false,
 	}
-	if err := database.MDB.Create(&allowMsg).Error; err != nil {
+	if err := h.store.CreateMessage(&allowMsg); err != nil {
 		log.Println("failed to store allow friend request: ", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store friend response")
 		return
 	}
 
-	frame.ID = allowMsg.ID
-
-	updatedRaw, err := json.Marshal(frame)
+	updatedRaw, err := json.Marshal(frame.relay(allowMsg.ID))
 	if err != nil {
 		log.Println("failed to marshal updated allow friend request: ", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay friend response")
 		return
 	}
 
-	if receiver, exist := GetClient(frame.Receiver); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, updatedRaw); err != nil {
-			log.Println("failed to notify acceptance: ", err)
-		}
-	}
+	h.deliverMessage(&allowMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: allowMsg.ID})
 }
 
+// WSChangeKeyChainData.Version is the version the client based the write on,
+// writes without it are answered with a conflict like stale ones.
 type WSChangeKeyChainData struct {
-	ChainIV  string `json:"chain_iv"`
-	ChainKey string `json:"chain_key"`
+	ChainIV  string  `json:"chain_iv"`
+	ChainKey string  `json:"chain_key"`
+	Version  *uint64 `json:"version,omitempty"`
+}
+
+// WSKeychainConflictData returns the stored keychain to a client whose write
+// was based on a stale version, so it can merge and write again.
+type WSKeychainConflictData struct {
+	FriendUUID string `json:"friend_uuid"`
+	Rejected   uint64 `json:"rejected"`
+	Version    uint64 `json:"version"`
+	ChainIV    string `json:"chain_iv"`
+	ChainKey   string `json:"chain_key"`
 }
 
-func handleChangeKeychain(frame WSFrame) {
-	var content WSChangeKeyChainData
-	if err := json.Unmarshal([]byte(frame.Data), &content); err != nil {
-		log.Println("invalid message struct: ", err)
+func (h *Hub) handleChangeKeychain(client *Client, frame WSFrame, content WSChangeKeyChainData) {
+	// NOTE: 未携带版本号的写入无法判断是否基于最新状态，按冲突处理并返回当前状态
+	if content.Version == nil {
+		friend, err := h.store.FindFriend(frame.Sender, frame.Receiver)
+		if err != nil {
+			log.Println("failed to update key chain: ", err)
+			sendError(client, frame, ErrCodeStorage, "failed to update key chain")
+			return
+		}
+
+		log.Printf("rejected unversioned key chain of %s for %s: stored %d", frame.Sender, frame.Receiver, friend.ChainVersion)
+		sendError(client, frame, ErrCodeConflict, "key chain version is required")
+		h.sendKeychainConflict(client, WSKeychainConflictData{
+			FriendUUID: friend.FriendUUID,
+			Version:    friend.ChainVersion,
+			ChainIV:    friend.ChainIV,
+			ChainKey:   friend.ChainKey,
+		})
 		return
 	}
 
-	if err := database.MDB.Model(&database.Friend{}).
-		Where("user_uuid = ? AND friend_uuid = ?", frame.Sender, frame.Receiver).
-		Updates(map[string]any{
-			"chain_iv":  content.ChainIV,
-			"chain_key": content.ChainKey,
-		}).Error; err != nil {
+	expected := *content.Version
+	friend, saved, err := h.store.SaveFriendKeychain(frame.Sender, frame.Receiver, expected, content.ChainIV, content.ChainKey, config.KEYCHAIN_HISTORY_LIMIT)
+	if err != nil {
 		log.Println("failed to update key chain: ", err)
+		sendError(client, frame, ErrCodeStorage, "failed to update key chain")
+		return
+	} else if saved {
+		sendResponse(client, frame, WSResponseData{Version: friend.ChainVersion})
+		return
 	}
+
+	log.Printf("rejected stale key chain of %s for %s: version %d, stored %d", frame.Sender, frame.Receiver, expected, friend.ChainVersion)
+	sendError(client, frame, ErrCodeConflict, "key chain version is stale")
+	h.sendKeychainConflict(client, WSKeychainConflictData{
+		FriendUUID: friend.FriendUUID,
+		Rejected:   expected,
+		Version:    friend.ChainVersion,
+		ChainIV:    friend.ChainIV,
+		ChainKey:   friend.ChainKey,
+	})
 }
 
-func handleChangePublickey(frame WSFrame) {
+func (h *Hub) sendKeychainConflict(client *Client, conflict WSKeychainConflictData) {
+	content, err := json.Marshal(conflict)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	data, err := json.Marshal(WSFrame{
+		ID:       0,
+		Type:     WSTypeKeychainConflict,
+		Sender:   conflict.FriendUUID,
+		Receiver: client.UUID,
+		Data:     string(content),
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send key chain conflict to %s: %v", client.UUID, err)
+	}
+}
+
+func (h *Hub) handleChangePublickey(client *Client, frame WSFrame) {
+	envelope, err := h.verifyEnvelope(frame)
+	if err != nil {
+		log.Printf("rejected forged change_publickey from %s to %s: %v", frame.Sender, frame.Receiver, err)
+		sendVerifyFailed(client, frame, "invalid signature")
+		sendError(client, frame, ErrCodeInvalidSignature, "invalid signature")
+		return
+	}
+
+	if _, err := ratchet.ImportPublicKey(envelope.Data); err != nil {
+		log.Printf("rejected change_publickey from %s to %s: %v", frame.Sender, frame.Receiver, err)
+		sendVerifyFailed(client, frame, "invalid public key")
+		sendError(client, frame, ErrCodeInvalidArgument, "invalid public key")
+		return
+	}
+
+	// NOTE: 时间窗口内同一信封仍能通过签名校验，只接受比上次更新的时间戳
+	accepted, err := h.store.AdvancePublickeyEnvelope(&database.PublickeyEnvelope{
+		UserUUID:  client.UUID,
+		DeviceID:  client.DeviceID,
+		Receiver:  frame.Receiver,
+		Timestamp: envelope.Timestamp,
+	})
+	if err != nil {
+		log.Println("failed to record envelope:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store message")
+		return
+	}
+	if !accepted {
+		log.Printf("rejected replayed change_publickey from %s to %s", frame.Sender, frame.Receiver)
+		sendVerifyFailed(client, frame, "replayed envelope")
+		sendError(client, frame, ErrCodeInvalidSignature, "replayed envelope")
+		return
+	}
+
 	newMsg := database.Message{
 		Type:        frame.Type,
 		Sender:      frame.Sender,
@@ -394,22 +497,19 @@ func handleChangePublickey(frame WSFrame) {
 		IsDelivered: false,
 	}
 
-	if err := database.MDB.Create(&newMsg).Error; err != nil {
+	if err := h.store.CreateMessage(&newMsg); err != nil {
 		log.Println("failed to store message:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to store message")
 		return
 	}
 
-	frame.ID = newMsg.ID
-
-	updatedRaw, err := json.Marshal(frame)
+	updatedRaw, err := json.Marshal(frame.relay(newMsg.ID))
 	if err != nil {
 		log.Println("failed to marshal updated message:", err)
+		sendError(client, frame, ErrCodeInternal, "failed to relay message")
 		return
 	}
 
-	if receiver, exist := GetClient(frame.Receiver); exist {
-		if err := SafeWrite(receiver, websocket.TextMessage, updatedRaw); err != nil {
-			log.Println("failed to deliver text message:", err)
-		}
-	}
+	h.deliverMessage(&newMsg, updatedRaw, h.GetClients(frame.Receiver))
+	sendResponse(client, frame, WSResponseData{ID: newMsg.ID})
 }
@@ -0,0 +1,158 @@
+package websocket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+	"double-ratchet-server/ratchet"
+
+	"github.com/google/uuid"
+)
+
+func TestChangeKeychainConflict(t *testing.T) {
+	h, store := newTestHub(t)
+	alice, bob := uuid.NewString(), uuid.NewString()
+	befriend(t, store, alice, bob)
+
+	// two devices of alice both start from version 0
+	laptop := &Client{UUID: alice, DeviceID: "laptop", queue: newSendQueue()}
+	phone := &Client{UUID: alice, DeviceID: "phone", queue: newSendQueue()}
+	version := uint64(0)
+	frame := WSFrame{Type: WSTypeChangeKeychain, Sender: alice, Receiver: bob, RequestID: "1"}
+
+	h.handleChangeKeychain(laptop, frame, WSChangeKeyChainData{ChainIV: "iv", ChainKey: "laptop", Version: &version})
+	if response := frameData[WSResponseData](t, laptop, WSTypeResponse); response.Version != 1 {
+		t.Fatalf("laptop write got version %d, want 1", response.Version)
+	}
+
+	h.handleChangeKeychain(phone, frame, WSChangeKeyChainData{ChainIV: "iv", ChainKey: "phone", Version: &version})
+	if failure := frameData[WSErrorData](t, phone, WSTypeError); failure.Code != ErrCodeConflict {
+		t.Errorf("phone write failed with %q, want %q", failure.Code, ErrCodeConflict)
+	}
+	conflict := frameData[WSKeychainConflictData](t, phone, WSTypeKeychainConflict)
+	if conflict.Rejected != 0 || conflict.Version != 1 || conflict.ChainKey != "laptop" || conflict.FriendUUID != bob {
+		t.Errorf("conflict = %+v, want the laptop write as version 1", conflict)
+	}
+
+	if friend, err := store.FindFriend(alice, bob); err != nil || friend.ChainKey != "laptop" || friend.ChainVersion != 1 {
+		t.Fatalf("stored keychain = %+v, %v, want the laptop write", friend, err)
+	}
+
+	// a write without a version is answered like a stale one
+	h.handleChangeKeychain(laptop, frame, WSChangeKeyChainData{ChainIV: "iv", ChainKey: "unversioned"})
+	if conflict := frameData[WSKeychainConflictData](t, laptop, WSTypeKeychainConflict); conflict.Version != 1 || conflict.ChainKey != "laptop" {
+		t.Errorf("unversioned conflict = %+v, want the stored version 1", conflict)
+	}
+}
+
+func TestTextMessageRatchetPosition(t *testing.T) {
+	h, store := newTestHub(t)
+	alice, bob := uuid.NewString(), uuid.NewString()
+	befriend(t, store, alice, bob)
+
+	tests := []struct {
+		name    string
+		content WSTextData
+		want    string
+	}{
+		{"negative jump", WSTextData{XRatchet: 0, YRatchet: -5}, ErrCodeInvalidArgument},
+		{"beyond the window", WSTextData{XRatchet: 0, YRatchet: int64(config.MESSAGE_MAX_SKIP) + 1}, ErrCodeSkipWindow},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{UUID: alice, queue: newSendQueue()}
+			h.handleTextMessage(client, WSFrame{Type: WSTypeTextMessage, Sender: alice, Receiver: bob}, test.content)
+			if failure := frameData[WSErrorData](t, client, WSTypeError); failure.Code != test.want {
+				t.Errorf("error code = %q, want %q", failure.Code, test.want)
+			}
+		})
+	}
+
+	messages, err := store.ListConversation(alice, bob, []string{WSTypeTextMessage}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("%d rejected messages were stored", len(messages))
+	}
+}
+
+// createSigningUser registers a user with a fresh P-256 identity key.
+func createSigningUser(t *testing.T, store database.Store) (string, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	identityKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&identityKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := database.User{
+		UUID:      uuid.NewString(),
+		Username:  uuid.NewString(),
+		PublicKey: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+	if err := store.CreateUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user.UUID, identityKey
+}
+
+func TestChangePublickeyReplay(t *testing.T) {
+	h, store := newTestHub(t)
+	alice, identityKey := createSigningUser(t, store)
+	bob := uuid.NewString()
+	befriend(t, store, alice, bob)
+
+	sign := func() string {
+		t.Helper()
+
+		key, err := ratchet.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := ratchet.SignPublicKey(identityKey, alice, bob, key.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	send := func(data string) *Client {
+		client := &Client{UUID: alice, DeviceID: "laptop", queue: newSendQueue()}
+		h.handleChangePublickey(client, WSFrame{Type: WSTypeChangePublickey, Sender: alice, Receiver: bob, Data: data, RequestID: "1"})
+		return client
+	}
+
+	first := sign()
+	frameData[WSResponseData](t, send(first), WSTypeResponse)
+
+	// the same envelope is still inside ENVELOPE_CLOCK_SKEW
+	replayed := send(first)
+	if failure := frameData[WSErrorData](t, replayed, WSTypeError); failure.Code != ErrCodeInvalidSignature {
+		t.Errorf("replay failed with %q, want %q", failure.Code, ErrCodeInvalidSignature)
+	}
+	frameData[WSVerifyFailedData](t, replayed, WSTypeVerifyFailed)
+
+	time.Sleep(2 * time.Millisecond)
+	frameData[WSResponseData](t, send(sign()), WSTypeResponse)
+
+	if stored, err := store.MaxMessageID(); err != nil || stored != 2 {
+		t.Errorf("%d messages stored, %v, want 2", stored, err)
+	}
+}
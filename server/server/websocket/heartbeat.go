@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"log"
+	"time"
+
+	"double-ratchet-server/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// touch records that the client is alive and moves the read deadline, so a
+// half-open connection fails its read once the pong timeout passes.
+func (c *Client) touch(now time.Time) error {
+	c.lastSeen.Store(now.UnixMilli())
+	return c.Conn.SetReadDeadline(now.Add(config.WS_PONG_TIMEOUT))
+}
+
+func (c *Client) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.UnixMilli(c.lastSeen.Load()))
+}
+
+// keepAlive pings the client until done is closed, the pong handler set in
+// the read loop keeps the read deadline moving.
+func (h *Hub) keepAlive(client *Client, done <-chan struct{}) {
+	ticker := time.NewTicker(config.WS_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			client.ConnMux.Lock()
+			err := client.Conn.WriteControl(websocket.PingMessage, nil, now.Add(config.WS_WRITE_TIMEOUT))
+			client.ConnMux.Unlock()
+
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					log.Printf("failed to ping %s device %s: %v", client.UUID, client.DeviceID, err)
+					client.Conn.Close()
+				}
+				return
+			}
+		}
+	}
+}
+
+// runReaper removes clients that stayed silent past the pong timeout, even
+// when their read loop is stuck and never sees the expired deadline.
+func (h *Hub) runReaper() {
+	ticker := time.NewTicker(config.WS_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, client := range h.allClients() {
+			if client.idleSince(now) <= config.WS_PONG_TIMEOUT {
+				continue
+			}
+
+			log.Printf("client [%s] device [%s] timed out, marked offline", client.UUID, client.DeviceID)
+			h.RemoveClient(client)
+		}
+	}
+}
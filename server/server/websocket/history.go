@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+
+	"double-ratchet-server/database"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	WSTypeHistoryRequest  = "history_request"
+	WSTypeHistoryResponse = "history_response"
+)
+
+// WSHistoryRequestData asks for a page of the conversation with the frame
+// receiver. The response frame echoes the RequestID of the request frame.
+type WSHistoryRequestData struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+	Limit  int    `json:"limit"`
+}
+
+type WSHistoryResponseData struct {
+	Messages   []WSFrame `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	HasMore    bool      `json:"has_more"`
+}
+
+func (h *Hub) handleHistoryRequest(client *Client, frame WSFrame, content WSHistoryRequestData) {
+	if content.Limit == 0 {
+		content.Limit = database.DefaultHistoryLimit
+	}
+	if content.Limit < 0 || content.Limit > database.MaxHistoryLimit {
+		sendError(client, frame, ErrCodeInvalidArgument, "illegal limit")
+		return
+	}
+
+	query := database.HistoryQuery{
+		UserUUID:   client.UUID,
+		FriendUUID: frame.Receiver,
+		Types:      []string{WSTypeTextMessage},
+		Limit:      content.Limit,
+	}
+
+	var err error
+	if content.Before != "" {
+		if query.Before, err = database.ParseHistoryCursor(content.Before); err != nil {
+			sendError(client, frame, ErrCodeInvalidArgument, "illegal cursor")
+			return
+		}
+	}
+	if content.After != "" {
+		if query.After, err = database.ParseHistoryCursor(content.After); err != nil {
+			sendError(client, frame, ErrCodeInvalidArgument, "illegal cursor")
+			return
+		}
+	}
+
+	messages, hasMore, err := h.store.ListHistory(query)
+	if err != nil {
+		log.Println("failed to fetch history:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch history")
+		return
+	}
+
+	response := WSHistoryResponseData{
+		Messages: []WSFrame{},
+		HasMore:  hasMore,
+	}
+	for _, msg := range messages {
+		response.Messages = append(response.Messages, WSFrame{
+			ID:       msg.ID,
+			Type:     msg.Type,
+			Sender:   msg.Sender,
+			Receiver: msg.Receiver,
+			Data:     msg.Data,
+			Sequence: msg.Sequence,
+		})
+	}
+	if hasMore {
+		response.NextCursor = database.MessageCursor(&messages[len(messages)-1]).String()
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	// NOTE: 响应帧 ID 为 0，客户端不会为其回复确认
+	data, err := json.Marshal(WSFrame{
+		ID:        0,
+		Type:      WSTypeHistoryResponse,
+		Sender:    frame.Receiver,
+		Receiver:  client.UUID,
+		Data:      string(payload),
+		RequestID: frame.RequestID,
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send history to %s: %v", client.UUID, err)
+	}
+}
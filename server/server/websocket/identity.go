@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"double-ratchet-server/database"
+	"double-ratchet-server/signature"
+)
+
+// WSKeyChangedData carries the new identity key of Sender and the safety
+// number the receiver has to compare again.
+type WSKeyChangedData struct {
+	UUID         string `json:"uuid"`
+	PublicKey    string `json:"public_key"`
+	KeyAlgorithm string `json:"key_algorithm"`
+	Fingerprint  string `json:"fingerprint"`
+	SafetyNumber string `json:"safety_number"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// NotifyIdentityKeyChanged stores a key_changed frame for every friend of the
+// user, so friends that are offline get it on their next connection.
+func (h *Hub) NotifyIdentityKeyChanged(uuid string) {
+	user, err := h.store.FindUserByUUID(uuid)
+	if err != nil {
+		log.Println("failed to fetch user info:", err)
+		return
+	}
+
+	key, err := signature.ParseUserKey(user.PublicKey, user.KeyAlgorithm)
+	if err != nil {
+		log.Printf("failed to parse identity key of %s: %v", uuid, err)
+		return
+	}
+
+	friends, err := h.store.ListFriends(uuid)
+	if err != nil {
+		log.Println("failed to fetch friend list:", err)
+		return
+	}
+
+	timestamp := time.Now().UnixMilli()
+	for _, friend := range friends {
+		friendUser, err := h.store.FindUserByUUID(friend.FriendUUID)
+		if err != nil {
+			log.Printf("failed to fetch user info for friend %s: %v", friend.FriendUUID, err)
+			continue
+		}
+
+		friendKey, err := signature.ParseUserKey(friendUser.PublicKey, friendUser.KeyAlgorithm)
+		if err != nil {
+			log.Printf("failed to parse identity key of %s: %v", friend.FriendUUID, err)
+			continue
+		}
+
+		content, err := json.Marshal(WSKeyChangedData{
+			UUID:         uuid,
+			PublicKey:    user.PublicKey,
+			KeyAlgorithm: key.Algorithm,
+			Fingerprint:  key.Fingerprint(),
+			SafetyNumber: signature.SafetyNumber(friend.FriendUUID, friendKey, uuid, key),
+			Timestamp:    timestamp,
+		})
+		if err != nil {
+			log.Println("json marshal error:", err)
+			continue
+		}
+
+		newMsg := database.Message{
+			Type:        WSTypeKeyChanged,
+			Sender:      uuid,
+			Receiver:    friend.FriendUUID,
+			Data:        string(content),
+			IsDelivered: false,
+			Timestamp:   timestamp,
+		}
+		if err := h.store.CreateMessage(&newMsg); err != nil {
+			log.Println("failed to store key change:", err)
+			continue
+		}
+
+		data, err := json.Marshal(WSFrame{
+			ID:       newMsg.ID,
+			Type:     newMsg.Type,
+			Sender:   newMsg.Sender,
+			Receiver: newMsg.Receiver,
+			Data:     newMsg.Data,
+		})
+		if err != nil {
+			log.Println("json marshal error:", err)
+			continue
+		}
+
+		h.deliverMessage(&newMsg, data, h.GetClients(friend.FriendUUID))
+	}
+
+	// NOTE: 好友列表中携带公钥，需要一并刷新
+	h.NotifyProfileChanged(uuid)
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"double-ratchet-server/database"
+)
+
+// NOTE: 通过 /debug/vars 暴露，键为已注册的帧类型，其余类型统一计入 unknown
+var (
+	frameCount    = expvar.NewMap("websocket_frames")
+	frameMicros   = expvar.NewMap("websocket_frame_micros")
+	framePanics   = expvar.NewMap("websocket_frame_panics")
+	framesDropped = expvar.NewMap("websocket_frames_dropped")
+)
+
+// Recovery keeps a panicking handler from taking the read loop, and with it
+// the connection, down.
+func Recovery(router *Router) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(client *Client, frame WSFrame) {
+			defer func() {
+				if err := recover(); err != nil {
+					framePanics.Add(router.metricKey(frame.Type), 1)
+					log.Printf("[%s] - panic while handling %s frame: %v\n%s", client.UUID, frame.Type, err, debug.Stack())
+					sendError(client, frame, ErrCodeInternal, "internal server error")
+				}
+			}()
+			next(client, frame)
+		}
+	}
+}
+
+// Metrics counts the frames of every type and the time spent handling them.
+func Metrics(router *Router) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(client *Client, frame WSFrame) {
+			start := time.Now()
+			defer func() {
+				key := router.metricKey(frame.Type)
+				frameCount.Add(key, 1)
+				frameMicros.Add(key, time.Since(start).Microseconds())
+			}()
+			next(client, frame)
+		}
+	}
+}
+
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(client *Client, frame WSFrame) {
+			start := time.Now()
+			next(client, frame)
+			log.Printf("[WS] %s | %s | %-18s | %v\n", client.UUID, client.DeviceID, frame.Type, time.Since(start))
+		}
+	}
+}
+
+// RateLimit drops frames beyond the token bucket of the connection.
+func RateLimit() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(client *Client, frame WSFrame) {
+			if allowed, _ := client.frames.Take(time.Now()); !allowed {
+				framesDropped.Add("rate_limit", 1)
+				log.Printf("[%s] - frame rate limit exceeded, frame dropped\n", client.UUID)
+				sendError(client, frame, ErrCodeRateLimited, "too many frames")
+				return
+			}
+			next(client, frame)
+		}
+	}
+}
+
+// Authorize applies the frame policies before the handler runs.
+func (h *Hub) Authorize() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(client *Client, frame WSFrame) {
+			if denial, err := h.authorizeFrame(client, frame); errors.Is(err, database.ErrRecordNotFound) {
+				sendError(client, frame, ErrCodeNotFound, "message not exist")
+				return
+			} else if err != nil {
+				log.Printf("[%s] - failed to authorize %s frame: %v\n", client.UUID, frame.Type, err)
+				sendError(client, frame, ErrCodeStorage, "failed to authorize frame")
+				return
+			} else if denial != nil {
+				framesDropped.Add("unauthorized", 1)
+				h.rejectFrame(client, frame, denial)
+				return
+			}
+			next(client, frame)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+)
+
+// WSDeliveryStatusData.Member is set when a single member of a group acked.
+type WSDeliveryStatusData struct {
+	ID     uint   `json:"id"`
+	Status string `json:"status"`
+	Member string `json:"member,omitempty"`
+}
+
+type outboxEntry struct {
+	data      []byte
+	attempts  int
+	nextRetry time.Time
+}
+
+// Outbox remembers every stored frame written to a connection until that
+// connection acks it, and writes it again on an exponential backoff.
+type Outbox struct {
+	mutex   sync.Mutex
+	entries map[*Client]map[uint]*outboxEntry
+}
+
+func newOutbox() *Outbox {
+	return &Outbox{entries: make(map[*Client]map[uint]*outboxEntry)}
+}
+
+func (o *Outbox) track(client *Client, messageID uint, data []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if _, ok := o.entries[client]; !ok {
+		o.entries[client] = make(map[uint]*outboxEntry)
+	}
+	o.entries[client][messageID] = &outboxEntry{
+		data:      data,
+		attempts:  1,
+		nextRetry: time.Now().Add(config.OUTBOX_RETRY_INTERVAL),
+	}
+}
+
+func (o *Outbox) ack(client *Client, messageID uint) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if entries, ok := o.entries[client]; ok {
+		delete(entries, messageID)
+	}
+}
+
+func (o *Outbox) drop(client *Client) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.entries, client)
+}
+
+type retransmission struct {
+	client    *Client
+	messageID uint
+	data      []byte
+}
+
+func (o *Outbox) due(now time.Time) []retransmission {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	pending := []retransmission{}
+	for client, entries := range o.entries {
+		for messageID, entry := range entries {
+			if now.Before(entry.nextRetry) {
+				continue
+			}
+
+			// NOTE: 超过重试次数后放弃，等待客户端重连时重新推送
+			if entry.attempts >= config.OUTBOX_RETRY_LIMIT {
+				delete(entries, messageID)
+				continue
+			}
+
+			backoff := config.OUTBOX_RETRY_INTERVAL << entry.attempts
+			if backoff <= 0 || backoff > config.OUTBOX_RETRY_MAX {
+				backoff = config.OUTBOX_RETRY_MAX
+			}
+
+			entry.attempts++
+			entry.nextRetry = now.Add(backoff)
+			pending = append(pending, retransmission{client, messageID, entry.data})
+		}
+	}
+	return pending
+}
+
+func (h *Hub) runOutbox() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastSweep := time.Time{}
+	for now := range ticker.C {
+		for _, item := range h.outbox.due(now) {
+			if err := retransmitMessage(item.client, item.messageID, item.data); err != nil {
+				log.Printf("failed to retransmit message %d to %s: %v", item.messageID, item.client.UUID, err)
+			}
+		}
+
+		if now.Sub(lastSweep) >= time.Minute {
+			lastSweep = now
+			h.expireMessages(now)
+		}
+	}
+}
+
+// deliverMessage queues a stored frame for the given connections and tracks
+// it for retransmission, the message moves from queued to sent once one of
+// the connections has written it.
+func (h *Hub) deliverMessage(msg *database.Message, data []byte, clients []*Client) {
+	written := h.markSent(msg)
+	for _, client := range clients {
+		// 写入失败的连接也进入重试队列，由 outbox 继续尝试
+		h.outbox.track(client, msg.ID, data)
+		if err := writeMessage(client, msg.ID, data, written); err != nil {
+			log.Printf("failed to deliver message %d to %s: %v", msg.ID, client.UUID, err)
+		}
+	}
+}
+
+// markSent returns the callback the writer runs after the frame of msg was
+// written, only the first write moves the message and notifies the sender.
+func (h *Hub) markSent(msg *database.Message) func() {
+	message := *msg
+	return func() {
+		if moved, err := h.store.MarkMessageSent(message.ID); err != nil {
+			log.Println("failed to update message status:", err)
+		} else if moved {
+			h.notifyDeliveryStatus(&message, database.MessageSent)
+		}
+	}
+}
+
+func (h *Hub) notifyDeliveryStatus(msg *database.Message, status string) {
+	h.sendDeliveryStatus(msg, WSDeliveryStatusData{ID: msg.ID, Status: status})
+}
+
+func (h *Hub) sendDeliveryStatus(msg *database.Message, status WSDeliveryStatusData) {
+	content, err := json.Marshal(status)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	// NOTE: ID 为 0，避免发送方的自动确认把这条通知当成消息确认
+	data, err := json.Marshal(WSFrame{
+		ID:       0,
+		Type:     WSTypeDeliveryStatus,
+		Sender:   msg.Receiver,
+		Receiver: msg.Sender,
+		Data:     string(content),
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	h.SendToUser(msg.Sender, data)
+}
+
+func (h *Hub) expireMessages(now time.Time) {
+	messages, err := h.store.ListExpiredMessages(now.Add(-config.MESSAGE_EXPIRATION).UnixMilli())
+	if err != nil {
+		log.Println("failed to fetch expired messages:", err)
+		return
+	}
+
+	for _, msg := range messages {
+		expired, err := h.store.MarkMessageExpired(msg.ID)
+		if err != nil {
+			log.Println("failed to expire message:", err)
+			continue
+		}
+		if expired {
+			h.notifyDeliveryStatus(&msg, database.MessageExpired)
+		}
+	}
+}
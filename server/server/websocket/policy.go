@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"errors"
+	"log"
+	"unicode/utf8"
+
+	"double-ratchet-server/database"
+)
+
+// framePolicy is what a frame of one type has to satisfy before its handler
+// runs, the handlers still check what depends on the frame data.
+type framePolicy struct {
+	// senderIsClient requires frame.Sender to be the authenticated user.
+	senderIsClient bool
+	// receiverIsFriend requires frame.Receiver to be a friend of the user.
+	receiverIsFriend bool
+	// receiverIsGroup requires frame.Receiver to be a group the user is a
+	// member of.
+	receiverIsGroup bool
+	// acksOwnMessage requires frame.ID to be a message addressed to the user
+	// or to one of the groups of the user.
+	acksOwnMessage bool
+	// answersFriendRequest requires an event_addfriend from frame.Receiver to
+	// the user that the user has not answered yet.
+	answersFriendRequest bool
+}
+
+// NOTE: 未列出的类型使用 defaultFramePolicy，确认帧的 sender 是原消息的接收方，可能是群组
+var (
+	defaultFramePolicy = framePolicy{senderIsClient: true}
+
+	framePolicies = map[string]framePolicy{
+		WSTypeTextMessage:      {senderIsClient: true, receiverIsFriend: true},
+		WSTypeChangePublickey:  {senderIsClient: true, receiverIsFriend: true},
+		WSTypeChangeKeychain:   {senderIsClient: true, receiverIsFriend: true},
+		WSTypeRetransmit:       {senderIsClient: true, receiverIsFriend: true},
+		WSTypeHistoryRequest:   {senderIsClient: true, receiverIsFriend: true},
+		WSTypeAttachment:       {senderIsClient: true, receiverIsFriend: true},
+		WSTypeGroupAttachment:  {senderIsClient: true, receiverIsGroup: true},
+		WSTypeEventConfirm:     {acksOwnMessage: true},
+		WSTypeEventAllowFriend: {senderIsClient: true, answersFriendRequest: true},
+		WSTypeEventDenyFriend:  {senderIsClient: true, answersFriendRequest: true},
+	}
+)
+
+func policyFor(frameType string) framePolicy {
+	if policy, ok := framePolicies[frameType]; ok {
+		return policy
+	}
+	return defaultFramePolicy
+}
+
+// authorizeFrame returns why the client may not send the frame, or nil when
+// it may. An error means the policy could not be evaluated.
+func (h *Hub) authorizeFrame(client *Client, frame WSFrame) (*FrameError, error) {
+	policy := policyFor(frame.Type)
+
+	if policy.senderIsClient && frame.Sender != client.UUID {
+		return &FrameError{ErrCodeUnauthorized, "sender does not match the authenticated user"}, nil
+	}
+
+	if policy.receiverIsFriend {
+		if _, err := h.store.FindFriend(client.UUID, frame.Receiver); errors.Is(err, database.ErrRecordNotFound) {
+			return &FrameError{ErrCodeNotFriend, "receiver is not a friend"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.receiverIsGroup {
+		if _, err := h.store.FindGroupMember(frame.Receiver, client.UUID); errors.Is(err, database.ErrRecordNotFound) {
+			return &FrameError{ErrCodeForbidden, "not a member of the group"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.answersFriendRequest {
+		if pending, err := h.hasPendingFriendRequest(frame.Receiver, client.UUID); err != nil {
+			return nil, err
+		} else if !pending {
+			return &FrameError{ErrCodeForbidden, "no pending friend request"}, nil
+		}
+	}
+
+	if policy.acksOwnMessage && frame.ID != 0 {
+		msg, err := h.store.FindMessage(frame.ID)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Receiver == client.UUID {
+			return nil, nil
+		}
+		if _, err := h.store.FindGroupMember(msg.Receiver, client.UUID); errors.Is(err, database.ErrRecordNotFound) {
+			return &FrameError{ErrCodeUnauthorized, "message is not addressed to the user"}, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// hasPendingFriendRequest reports whether the latest event_addfriend from
+// requester to user is neither expired nor answered by a later allow or deny.
+// NOTE: 客户端收到好友请求后立即确认，因此不能只看请求是否已投递
+func (h *Hub) hasPendingFriendRequest(requester, user string) (bool, error) {
+	request, err := h.store.FindLatestMessage(requester, user, []string{WSTypeEventAddFriend})
+	if errors.Is(err, database.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if request.Status == database.MessageExpired {
+		return false, nil
+	}
+
+	answer, err := h.store.FindLatestMessage(user, requester, []string{WSTypeEventAllowFriend, WSTypeEventDenyFriend})
+	if errors.Is(err, database.ErrRecordNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return answer.ID < request.ID, nil
+}
+
+// rejectFrame answers a frame that broke its policy with an error frame and
+// keeps an audit entry of the attempt.
+func (h *Hub) rejectFrame(client *Client, frame WSFrame, denial *FrameError) {
+	log.Printf("[%s] - unauthorized %s frame from %s to %s: %s\n", client.UUID, frame.Type, frame.Sender, frame.Receiver, denial.Message)
+
+	if err := h.store.CreateAuditEvent(&database.AuditEvent{
+		UserUUID:  client.UUID,
+		DeviceID:  client.DeviceID,
+		FrameType: truncate(frame.Type, 32),
+		Sender:    truncate(frame.Sender, 36),
+		Receiver:  truncate(frame.Receiver, 36),
+		Reason:    denial.Message,
+	}); err != nil {
+		log.Println("failed to store audit event:", err)
+	}
+
+	sendError(client, frame, denial.Code, denial.Message)
+}
+
+// truncate keeps client supplied values within their column size, cutting on
+// a rune boundary so the audit record stays valid UTF-8.
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	for size > 0 && !utf8.RuneStart(value[size]) {
+		size--
+	}
+	return value[:size]
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"double-ratchet-server/database"
+
+	"github.com/google/uuid"
+)
+
+func befriend(t *testing.T, store database.Store, user, friend string) {
+	t.Helper()
+
+	for _, pair := range [][2]string{{user, friend}, {friend, user}} {
+		if err := store.CreateFriend(&database.Friend{UserUUID: pair[0], FriendUUID: pair[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func createGroup(t *testing.T, store database.Store, owner string) string {
+	t.Helper()
+
+	group := database.Group{UUID: uuid.NewString(), Name: "group", Owner: owner}
+	if err := store.CreateGroup(&group, []database.GroupMember{{GroupUUID: group.UUID, UserUUID: owner}}); err != nil {
+		t.Fatal(err)
+	}
+	return group.UUID
+}
+
+func authorize(t *testing.T, h *Hub, client *Client, frame WSFrame) string {
+	t.Helper()
+
+	denial, err := h.authorizeFrame(client, frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denial == nil {
+		return ""
+	}
+	return denial.Code
+}
+
+func TestAttachmentPolicy(t *testing.T) {
+	h, store := newTestHub(t)
+	alice := &Client{UUID: uuid.NewString()}
+	friend, stranger := uuid.NewString(), uuid.NewString()
+	befriend(t, store, alice.UUID, friend)
+	joined := createGroup(t, store, alice.UUID)
+	foreign := createGroup(t, store, stranger)
+
+	tests := []struct {
+		name  string
+		frame WSFrame
+		want  string
+	}{
+		{"friend", WSFrame{Type: WSTypeAttachment, Sender: alice.UUID, Receiver: friend}, ""},
+		{"stranger", WSFrame{Type: WSTypeAttachment, Sender: alice.UUID, Receiver: stranger}, ErrCodeNotFriend},
+		{"group as direct receiver", WSFrame{Type: WSTypeAttachment, Sender: alice.UUID, Receiver: joined}, ErrCodeNotFriend},
+		{"spoofed sender", WSFrame{Type: WSTypeAttachment, Sender: friend, Receiver: friend}, ErrCodeUnauthorized},
+		{"joined group", WSFrame{Type: WSTypeGroupAttachment, Sender: alice.UUID, Receiver: joined}, ""},
+		{"foreign group", WSFrame{Type: WSTypeGroupAttachment, Sender: alice.UUID, Receiver: foreign}, ErrCodeForbidden},
+		{"friend as group", WSFrame{Type: WSTypeGroupAttachment, Sender: alice.UUID, Receiver: friend}, ErrCodeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := authorize(t, h, alice, test.frame); got != test.want {
+				t.Errorf("denial = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAnswerFriendRequestPolicy(t *testing.T) {
+	h, store := newTestHub(t)
+	alice := &Client{UUID: uuid.NewString()}
+	bob := uuid.NewString()
+
+	send := func(frameType, sender, receiver string) uint {
+		msg := database.Message{Type: frameType, Sender: sender, Receiver: receiver, Data: "{}"}
+		if err := store.CreateMessage(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.ID
+	}
+	allow := WSFrame{Type: WSTypeEventAllowFriend, Sender: alice.UUID, Receiver: bob}
+	deny := WSFrame{Type: WSTypeEventDenyFriend, Sender: alice.UUID, Receiver: bob}
+
+	if got := authorize(t, h, alice, allow); got != ErrCodeForbidden {
+		t.Errorf("allow without a request: denial = %q, want %q", got, ErrCodeForbidden)
+	}
+
+	send(WSTypeEventAddFriend, bob, alice.UUID)
+	if got := authorize(t, h, alice, allow); got != "" {
+		t.Errorf("allow a pending request: denial = %q", got)
+	}
+
+	send(WSTypeEventAllowFriend, alice.UUID, bob)
+	for _, frame := range []WSFrame{allow, deny} {
+		if got := authorize(t, h, alice, frame); got != ErrCodeForbidden {
+			t.Errorf("%s after an allow: denial = %q, want %q", frame.Type, got, ErrCodeForbidden)
+		}
+	}
+
+	send(WSTypeEventAddFriend, bob, alice.UUID)
+	send(WSTypeEventDenyFriend, alice.UUID, bob)
+	for _, frame := range []WSFrame{allow, deny} {
+		if got := authorize(t, h, alice, frame); got != ErrCodeForbidden {
+			t.Errorf("%s after a deny: denial = %q, want %q", frame.Type, got, ErrCodeForbidden)
+		}
+	}
+
+	expired := send(WSTypeEventAddFriend, bob, alice.UUID)
+	if _, err := store.MarkMessageExpired(expired); err != nil {
+		t.Fatal(err)
+	}
+	if got := authorize(t, h, alice, allow); got != ErrCodeForbidden {
+		t.Errorf("allow an expired request: denial = %q, want %q", got, ErrCodeForbidden)
+	}
+
+	if got := authorize(t, h, alice, WSFrame{Type: WSTypeEventAllowFriend, Sender: alice.UUID, Receiver: uuid.NewString()}); got != ErrCodeForbidden {
+		t.Errorf("allow a request of someone else: denial = %q, want %q", got, ErrCodeForbidden)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int
+		want  string
+	}{
+		{"short", 32, "short"},
+		{"exactly", 7, "exactly"},
+		{"abcdef", 3, "abc"},
+		// 你 and 好 are three bytes each, the cut may not split a rune
+		{"你好", 4, "你"},
+		{"你好", 5, "你"},
+		{"你好", 6, "你好"},
+		{"a你", 2, "a"},
+		{"你", 2, ""},
+		{"🙂🙂", 7, "🙂"},
+	}
+	for _, test := range tests {
+		got := truncate(test.value, test.size)
+		if got != test.want || !utf8.ValidString(got) || len(got) > test.size {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.value, test.size, got, test.want)
+		}
+	}
+}
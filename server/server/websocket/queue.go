@@ -0,0 +1,229 @@
+package websocket
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"double-ratchet-server/config"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrQueueClosed   = errors.New("send queue is closed")
+	ErrQueueOverflow = errors.New("send queue is full")
+)
+
+// Overflow policies of a full send queue, selected by WS_QUEUE_OVERFLOW.
+const (
+	// OverflowDropOldest discards the oldest queued frame to make room.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDisconnect closes the connection, the client gets its stored
+	// messages again when it reconnects.
+	OverflowDisconnect = "disconnect"
+	// OverflowSpill leaves frames of stored messages in the undelivered
+	// store, where the outbox and the next connection pick them up, and
+	// makes room for other frames by dropping the oldest.
+	OverflowSpill = "spill"
+)
+
+// NOTE: 队列深度为所有连接排队帧数之和，溢出次数按策略统计
+var (
+	queueDepth    = expvar.NewInt("websocket_queue_depth")
+	queueOverflow = expvar.NewMap("websocket_queue_overflow")
+)
+
+type outboundFrame struct {
+	messageType int
+	data        []byte
+	// messageID is set for frames of stored messages
+	messageID uint
+	// written runs on the writer goroutine once the frame reached the socket
+	written func()
+}
+
+// sendQueue is the bounded outbound queue of one connection, it is drained
+// by the writer goroutine of the client.
+type sendQueue struct {
+	mutex  sync.Mutex
+	frames []outboundFrame
+	ready  chan struct{}
+	space  chan struct{}
+	closed bool
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{ready: make(chan struct{}, 1), space: make(chan struct{}, 1)}
+}
+
+// push queues the frame according to the overflow policy, it returns
+// ErrQueueOverflow when the frame was not queued.
+func (q *sendQueue) push(frame outboundFrame, policy string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if len(q.frames) >= config.WS_QUEUE_SIZE {
+		queueOverflow.Add(policy, 1)
+		switch {
+		case policy == OverflowDisconnect:
+			return ErrQueueOverflow
+		case policy == OverflowSpill && frame.messageID != 0:
+			return ErrQueueOverflow
+		default:
+			q.frames = q.frames[1:]
+			queueDepth.Add(-1)
+		}
+	}
+
+	q.frames = append(q.frames, frame)
+	queueDepth.Add(1)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pushWait queues the frame once the writer made room, it never applies the
+// overflow policy. The stored backlog is replayed this way, so a long backlog
+// drains at the pace of the connection instead of overflowing.
+func (q *sendQueue) pushWait(frame outboundFrame) error {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return ErrQueueClosed
+		}
+		if len(q.frames) < config.WS_QUEUE_SIZE {
+			q.frames = append(q.frames, frame)
+			queueDepth.Add(1)
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+			q.mutex.Unlock()
+			return nil
+		}
+		q.mutex.Unlock()
+
+		<-q.space
+	}
+}
+
+// pop waits for the next frame, it reports false once the queue is closed.
+func (q *sendQueue) pop() (outboundFrame, bool) {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return outboundFrame{}, false
+		}
+		if len(q.frames) > 0 {
+			frame := q.frames[0]
+			q.frames = q.frames[1:]
+			queueDepth.Add(-1)
+			select {
+			case q.space <- struct{}{}:
+			default:
+			}
+			q.mutex.Unlock()
+			return frame, true
+		}
+		q.mutex.Unlock()
+
+		<-q.ready
+	}
+}
+
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	queueDepth.Add(-int64(len(q.frames)))
+	q.frames = nil
+	close(q.ready)
+	close(q.space)
+}
+
+func (q *sendQueue) depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.frames)
+}
+
+// runWriter is the only goroutine that writes data frames to the connection,
+// a failed write closes the connection and its read loop removes the client.
+func (c *Client) runWriter() {
+	for {
+		frame, ok := c.queue.pop()
+		if !ok {
+			return
+		}
+
+		c.ConnMux.Lock()
+		c.Conn.SetWriteDeadline(time.Now().Add(config.WS_WRITE_TIMEOUT))
+		err := c.Conn.WriteMessage(frame.messageType, frame.data)
+		c.ConnMux.Unlock()
+
+		if err != nil {
+			log.Printf("failed to write to %s device %s: %v", c.UUID, c.DeviceID, err)
+			c.Conn.Close()
+			c.queue.close()
+			return
+		}
+		if frame.written != nil {
+			frame.written()
+		}
+	}
+}
+
+func (c *Client) enqueue(frame outboundFrame) error {
+	err := c.queue.push(frame, config.WS_QUEUE_OVERFLOW)
+	if errors.Is(err, ErrQueueOverflow) && config.WS_QUEUE_OVERFLOW == OverflowDisconnect {
+		log.Printf("send queue of %s device %s overflowed, disconnecting", c.UUID, c.DeviceID)
+		c.Conn.Close()
+	}
+	return err
+}
+
+// QueueDepth returns how many frames wait to be written to the client.
+func (c *Client) QueueDepth() int {
+	return c.queue.depth()
+}
+
+// SafeWrite queues a frame for the client without waiting for the write, it
+// fails when the queue overflowed or the connection is gone.
+func SafeWrite(client *Client, messageType int, data []byte) error {
+	return client.enqueue(outboundFrame{messageType: messageType, data: data})
+}
+
+// writeMessage queues the frame of a stored message, which the spill policy
+// may leave in the undelivered store. written runs once the frame is written.
+func writeMessage(client *Client, messageID uint, data []byte, written func()) error {
+	return client.enqueue(outboundFrame{messageType: websocket.TextMessage, data: data, messageID: messageID, written: written})
+}
+
+// retransmitMessage queues a frame again for the outbox. A full queue leaves
+// the frame to the next retry whatever the policy, so retransmissions never
+// disconnect a client that is still draining its backlog.
+func retransmitMessage(client *Client, messageID uint, data []byte) error {
+	return client.queue.push(outboundFrame{messageType: websocket.TextMessage, data: data, messageID: messageID}, OverflowSpill)
+}
+
+// replayMessage queues a frame of the stored backlog, waiting for the writer
+// instead of applying the overflow policy.
+func replayMessage(client *Client, messageID uint, data []byte, written func()) error {
+	return client.queue.pushWait(outboundFrame{messageType: websocket.TextMessage, data: data, messageID: messageID, written: written})
+}
@@ -0,0 +1,229 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/database"
+
+	"github.com/google/uuid"
+)
+
+func setQueue(t *testing.T, size int, policy string) {
+	t.Helper()
+
+	size, config.WS_QUEUE_SIZE = config.WS_QUEUE_SIZE, size
+	policy, config.WS_QUEUE_OVERFLOW = config.WS_QUEUE_OVERFLOW, policy
+	t.Cleanup(func() {
+		config.WS_QUEUE_SIZE = size
+		config.WS_QUEUE_OVERFLOW = policy
+	})
+}
+
+func queuedIDs(q *sendQueue) []uint {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	ids := []uint{}
+	for _, frame := range q.frames {
+		ids = append(ids, frame.messageID)
+	}
+	return ids
+}
+
+func messageSent(store database.Store, id uint) bool {
+	stored, err := store.FindMessage(id)
+	return err == nil && stored.Status == database.MessageSent
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy string
+		// messageID of the frame pushed into the full queue, 0 for a frame
+		// that is not a stored message
+		messageID uint
+		err       error
+		want      []uint
+	}{
+		{OverflowDropOldest, 3, nil, []uint{2, 3}},
+		{OverflowDropOldest, 0, nil, []uint{2, 0}},
+		{OverflowDisconnect, 3, ErrQueueOverflow, []uint{1, 2}},
+		{OverflowDisconnect, 0, ErrQueueOverflow, []uint{1, 2}},
+		{OverflowSpill, 3, ErrQueueOverflow, []uint{1, 2}},
+		{OverflowSpill, 0, nil, []uint{2, 0}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%d", test.policy, test.messageID), func(t *testing.T) {
+			setQueue(t, 2, test.policy)
+			queue := newSendQueue()
+			for id := uint(1); id <= 2; id++ {
+				if err := queue.push(outboundFrame{messageID: id}, test.policy); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := queue.push(outboundFrame{messageID: test.messageID}, test.policy); !errors.Is(err, test.err) {
+				t.Fatalf("push into full queue = %v, want %v", err, test.err)
+			}
+			if got := queuedIDs(queue); !slices.Equal(got, test.want) {
+				t.Errorf("queued %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestOverflowLeavesMessagesUndelivered delivers three messages to a client
+// whose queue holds one frame, only the frames that reach the socket may
+// move their message to sent.
+func TestOverflowLeavesMessagesUndelivered(t *testing.T) {
+	tests := []struct {
+		policy  string
+		written []int
+	}{
+		{OverflowDropOldest, []int{2}},
+		{OverflowSpill, []int{0}},
+		{OverflowDisconnect, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			setQueue(t, 1, test.policy)
+			h, store := newTestHub(t)
+			client, peer := newTestClient(t, uuid.NewString())
+			if err := h.registerDevice(client.UUID, client.DeviceID); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := make([]database.Message, 3)
+			for i := range messages {
+				messages[i] = database.Message{Type: WSTypeTextMessage, Sender: uuid.NewString(), Receiver: client.UUID, Data: "{}"}
+				if err := store.CreateMessage(&messages[i]); err != nil {
+					t.Fatal(err)
+				}
+				h.deliverMessage(&messages[i], []byte(fmt.Sprintf(`{"id":%d,"type":"text"}`, messages[i].ID)), []*Client{client})
+			}
+
+			go client.runWriter()
+			for _, i := range test.written {
+				if frame := readFrame(t, peer, WSTypeTextMessage); frame.ID != messages[i].ID {
+					t.Fatalf("read message %d, want %d", frame.ID, messages[i].ID)
+				}
+			}
+
+			// NOTE: 未写出的帧从未留在队列中，等写出的消息变为 sent 后其余消息的状态就不会再变
+			for _, i := range test.written {
+				if !eventually(t, func() bool { return messageSent(store, messages[i].ID) }) {
+					t.Errorf("written message %d not marked sent", i)
+				}
+			}
+			for i, msg := range messages {
+				if !slices.Contains(test.written, i) && messageSent(store, msg.ID) {
+					t.Errorf("message %d marked sent without being written", i)
+				}
+			}
+
+			undelivered, err := h.undeliveredMessages(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(undelivered) != len(messages) {
+				t.Errorf("%d undelivered messages, want %d until they are acked", len(undelivered), len(messages))
+			}
+		})
+	}
+}
+
+func TestMessageSentAfterWrite(t *testing.T) {
+	h, store := newTestHub(t)
+	client, peer := newTestClient(t, uuid.NewString())
+
+	msg := database.Message{Type: WSTypeTextMessage, Sender: uuid.NewString(), Receiver: client.UUID, Data: "{}"}
+	if err := store.CreateMessage(&msg); err != nil {
+		t.Fatal(err)
+	}
+	h.deliverMessage(&msg, []byte(fmt.Sprintf(`{"id":%d,"type":"text"}`, msg.ID)), []*Client{client})
+
+	// NOTE: 帧只是进入队列，还没有写出，消息必须保持 queued
+	if stored, err := store.FindMessage(msg.ID); err != nil || stored.Status != database.MessageQueued {
+		t.Fatalf("status before the write = %v (%v), want %s", stored, err, database.MessageQueued)
+	}
+
+	go client.runWriter()
+	readFrame(t, peer, WSTypeTextMessage)
+	if !eventually(t, func() bool { return messageSent(store, msg.ID) }) {
+		t.Fatal("message not marked sent after the write")
+	}
+}
+
+func TestReplayWaitsForRoom(t *testing.T) {
+	setQueue(t, 1, OverflowDisconnect)
+	queue := newSendQueue()
+	defer queue.close()
+
+	if err := queue.push(outboundFrame{messageID: 1}, OverflowDisconnect); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- queue.pushWait(outboundFrame{messageID: 2})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("pushWait returned %v with a full queue", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if frame, ok := queue.pop(); !ok || frame.messageID != 1 {
+		t.Fatalf("pop = %d, %v", frame.messageID, ok)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pushWait did not return once the writer made room")
+	}
+	if got := queuedIDs(queue); !slices.Equal(got, []uint{2}) {
+		t.Errorf("queued %v, want [2]", got)
+	}
+}
+
+// TestReplayBacklogLongerThanQueue replays a backlog five times the queue
+// size under the disconnect policy, the connection has to stay up and
+// every message is written in order.
+func TestReplayBacklogLongerThanQueue(t *testing.T) {
+	setQueue(t, 2, OverflowDisconnect)
+	h, store := newTestHub(t)
+	client, peer := newTestClient(t, uuid.NewString())
+	if err := h.registerDevice(client.UUID, client.DeviceID); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make([]database.Message, 10)
+	for i := range messages {
+		messages[i] = database.Message{Type: WSTypeTextMessage, Sender: uuid.NewString(), Receiver: client.UUID, Data: "{}"}
+		if err := store.CreateMessage(&messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go client.runWriter()
+	go h.pushUndeliveredMessages(client)
+
+	for _, msg := range messages {
+		if frame := readFrame(t, peer, WSTypeTextMessage); frame.ID != msg.ID {
+			t.Fatalf("read message %d, want %d", frame.ID, msg.ID)
+		}
+	}
+	for _, msg := range messages {
+		if !eventually(t, func() bool { return messageSent(store, msg.ID) }) {
+			t.Errorf("message %d not marked sent", msg.ID)
+		}
+	}
+}
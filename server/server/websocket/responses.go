@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// NOTE: 错误码供客户端程序判断，message 只用于展示和排查
+const (
+	ErrCodeMalformed        = "malformed_frame"
+	ErrCodeUnknownType      = "unknown_type"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeNotFriend        = "not_friend"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeInvalidArgument  = "invalid_argument"
+	ErrCodeDuplicate        = "duplicate"
+	ErrCodeConflict         = "conflict"
+	ErrCodeInvalidSignature = "invalid_signature"
+	ErrCodeSkipWindow       = "skip_window_exceeded"
+	ErrCodeStorage          = "storage_error"
+	ErrCodeInternal         = "internal_error"
+)
+
+// FrameError is a failure that is reported to the client as an error frame.
+type FrameError struct {
+	Code    string
+	Message string
+}
+
+func (e *FrameError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WSErrorData answers a frame that failed, Type and Receiver are copied from
+// the failed frame for clients that do not set a request id.
+type WSErrorData struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Type     string `json:"type"`
+	Receiver string `json:"receiver"`
+}
+
+// WSResponseData answers a frame that succeeded, only the fields that the
+// operation produced are set.
+type WSResponseData struct {
+	Type     string `json:"type"`
+	ID       uint   `json:"id,omitempty"`
+	Sequence uint64 `json:"seq,omitempty"`
+	Version  uint64 `json:"version,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// sendError is sent for every failed frame, the frame is then dropped.
+func sendError(client *Client, frame WSFrame, code, message string) {
+	content, err := json.Marshal(WSErrorData{
+		Code:     code,
+		Message:  message,
+		Type:     frame.Type,
+		Receiver: frame.Receiver,
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	writeReply(client, frame, WSTypeError, content)
+}
+
+// sendResponse confirms a frame that succeeded. It is only sent when the
+// frame carries a request id, older clients do not expect it.
+func sendResponse(client *Client, frame WSFrame, response WSResponseData) {
+	if frame.RequestID == "" {
+		return
+	}
+
+	response.Type = frame.Type
+	content, err := json.Marshal(response)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	writeReply(client, frame, WSTypeResponse, content)
+}
+
+func writeReply(client *Client, frame WSFrame, replyType string, content []byte) {
+	data, err := json.Marshal(WSFrame{
+		ID:        0,
+		Type:      replyType,
+		Sender:    client.UUID,
+		Receiver:  client.UUID,
+		Data:      string(content),
+		RequestID: frame.RequestID,
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send %s to %s: %v", replyType, client.UUID, err)
+	}
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// HandlerFunc handles one frame read from a client.
+type HandlerFunc func(client *Client, frame WSFrame)
+
+// Middleware wraps a handler, it runs for every frame type.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router dispatches frames to the handler registered for their type, through
+// the middleware chain in the order it was added.
+type Router struct {
+	mutex      sync.RWMutex
+	handlers   map[string]HandlerFunc
+	middleware []Middleware
+	notFound   HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]HandlerFunc),
+		notFound: func(client *Client, frame WSFrame) {
+			log.Printf("[%s] - unknown message type: %s\n", client.UUID, frame.Type)
+			sendError(client, frame, ErrCodeUnknownType, "unknown frame type")
+		},
+	}
+}
+
+// Use appends middleware, the first one added is the outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers the handler of a frame type, replacing any earlier one.
+func (r *Router) Handle(frameType string, handler HandlerFunc) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handlers[frameType] = handler
+}
+
+// NotFound sets the handler of frame types nobody registered.
+func (r *Router) NotFound(handler HandlerFunc) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.notFound = handler
+}
+
+// metricKey is the frame type when it has a handler, so clients cannot grow
+// the expvar maps with made up types.
+func (r *Router) metricKey(frameType string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if _, ok := r.handlers[frameType]; ok {
+		return frameType
+	}
+	return "unknown"
+}
+
+func (r *Router) Dispatch(client *Client, frame WSFrame) {
+	r.mutex.RLock()
+	handler, ok := r.handlers[frame.Type]
+	if !ok {
+		handler = r.notFound
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	r.mutex.RUnlock()
+
+	handler(client, frame)
+}
+
+// Typed decodes the frame data as T before calling handler, frames whose
+// data does not decode are answered with an error frame.
+func Typed[T any](handler func(client *Client, frame WSFrame, content T)) HandlerFunc {
+	return func(client *Client, frame WSFrame) {
+		var content T
+		if err := json.Unmarshal([]byte(frame.Data), &content); err != nil {
+			log.Println("invalid message struct: ", err)
+			sendError(client, frame, ErrCodeMalformed, "invalid frame data")
+			return
+		}
+		handler(client, frame, content)
+	}
+}
+
+// Router exposes the frame router, so frame types can be added without
+// touching the read loop.
+func (h *Hub) Router() *Router {
+	return h.router
+}
+
+// respondAfter adapts a push that only needs the client, the response tells
+// the client the push is complete.
+func respondAfter(push func(client *Client)) HandlerFunc {
+	return func(client *Client, frame WSFrame) {
+		push(client)
+		sendResponse(client, frame, WSResponseData{})
+	}
+}
+
+func (h *Hub) registerRoutes() {
+	h.router.Use(Recovery(h.router), Metrics(h.router), Logging(), RateLimit(), h.Authorize())
+
+	h.router.Handle(WSTypeTextMessage, Typed(h.handleTextMessage))
+	h.router.Handle(WSTypeEventConfirm, h.handleEventConfirm)
+	h.router.Handle(WSTypeEventAddFriend, h.handleEventAddFriend)
+	h.router.Handle(WSTypeEventDenyFriend, h.handleEventDenyFriend)
+	h.router.Handle(WSTypeEventAllowFriend, h.handleEventAllowFriend)
+	h.router.Handle(WSTypeRetransmit, Typed(h.handleRetransmit))
+	h.router.Handle(WSTypeHistoryRequest, Typed(h.handleHistoryRequest))
+	h.router.Handle(WSTypeChangeKeychain, Typed(h.handleChangeKeychain))
+	h.router.Handle(WSTypeChangePublickey, h.handleChangePublickey)
+	h.router.Handle(WSTypeUpdateUserlist, respondAfter(h.pushUserList))
+	h.router.Handle(WSTypeUpdateFriendlist, respondAfter(h.pushFriendList))
+	h.router.Handle(WSTypeUpdateGrouplist, respondAfter(h.pushGroupList))
+	h.router.Handle(WSTypeGroupCreate, Typed(h.handleGroupCreate))
+	h.router.Handle(WSTypeGroupInvite, Typed(h.handleGroupInvite))
+	h.router.Handle(WSTypeGroupRemove, Typed(h.handleGroupRemove))
+	h.router.Handle(WSTypeGroupMessage, Typed(h.handleGroupMessage))
+	h.router.Handle(WSTypeGroupSenderKey, Typed(h.handleGroupSenderKey))
+	h.router.Handle(WSTypeAttachment, Typed(h.handleAttachment))
+	h.router.Handle(WSTypeGroupAttachment, Typed(h.handleAttachment))
+}
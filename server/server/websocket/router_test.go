@@ -0,0 +1,50 @@
+package websocket
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+)
+
+func counter(m *expvar.Map, key string) int64 {
+	if value, ok := m.Get(key).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
+
+func TestMetricsKeyUnknownTypes(t *testing.T) {
+	router := NewRouter()
+	router.Use(Metrics(router))
+	router.Handle("metrics_test", func(client *Client, frame WSFrame) {})
+	client := &Client{UUID: "alice", queue: newSendQueue()}
+	defer client.queue.close()
+
+	known, unknown := counter(frameCount, "metrics_test"), counter(frameCount, "unknown")
+	keys := 0
+	frameCount.Do(func(expvar.KeyValue) { keys++ })
+
+	router.Dispatch(client, WSFrame{Type: "metrics_test"})
+	for i := range 5 {
+		router.Dispatch(client, WSFrame{Type: fmt.Sprintf("made_up_%d", i)})
+	}
+
+	if got := counter(frameCount, "metrics_test"); got != known+1 {
+		t.Errorf("metrics_test frames = %d, want %d", got, known+1)
+	}
+	if got := counter(frameCount, "unknown"); got != unknown+5 {
+		t.Errorf("unknown frames = %d, want %d", got, unknown+5)
+	}
+	for i := range 5 {
+		if frameCount.Get(fmt.Sprintf("made_up_%d", i)) != nil || frameMicros.Get(fmt.Sprintf("made_up_%d", i)) != nil {
+			t.Errorf("made_up_%d got its own expvar key", i)
+		}
+	}
+
+	grown := 0
+	frameCount.Do(func(expvar.KeyValue) { grown++ })
+	// at most metrics_test and unknown are new
+	if grown > keys+2 {
+		t.Errorf("frame metrics grew from %d to %d keys", keys, grown)
+	}
+}
@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// NOTE: 单次重传请求最多包含的序号数量
+const maxRetransmitSequences = 100
+
+// WSRetransmitData lists the sequence numbers of text frames from Receiver
+// to Sender that the requesting client is missing.
+type WSRetransmitData struct {
+	Sequences []uint64 `json:"sequences"`
+}
+
+// WSSequenceGapData answers a retransmission with the numbers the server
+// never stored, the client has to skip them.
+type WSSequenceGapData struct {
+	Peer    string   `json:"peer"`
+	Missing []uint64 `json:"missing"`
+}
+
+func (h *Hub) handleRetransmit(client *Client, frame WSFrame, content WSRetransmitData) {
+	if len(content.Sequences) == 0 || len(content.Sequences) > maxRetransmitSequences {
+		sendError(client, frame, ErrCodeInvalidArgument, "illegal sequence list")
+		return
+	}
+
+	peer := frame.Receiver
+	messages, err := h.store.ListSequencedMessages(peer, client.UUID, content.Sequences)
+	if err != nil {
+		log.Println("failed to fetch messages for retransmission:", err)
+		sendError(client, frame, ErrCodeStorage, "failed to fetch messages")
+		return
+	}
+
+	found := map[uint64]bool{}
+	for _, msg := range messages {
+		found[msg.Sequence] = true
+
+		data, err := json.Marshal(WSFrame{
+			ID:       msg.ID,
+			Type:     msg.Type,
+			Sender:   msg.Sender,
+			Receiver: msg.Receiver,
+			Data:     msg.Data,
+			Sequence: msg.Sequence,
+		})
+		if err != nil {
+			log.Println("failed to marshal retransmitted message:", err)
+			continue
+		}
+		h.deliverMessage(&msg, data, []*Client{client})
+	}
+
+	missing := []uint64{}
+	for _, sequence := range content.Sequences {
+		if !found[sequence] && !slices.Contains(missing, sequence) {
+			missing = append(missing, sequence)
+		}
+	}
+	if len(missing) > 0 {
+		h.sendSequenceGap(client, WSSequenceGapData{Peer: peer, Missing: missing})
+	}
+	sendResponse(client, frame, WSResponseData{})
+}
+
+func (h *Hub) sendSequenceGap(client *Client, gap WSSequenceGapData) {
+	content, err := json.Marshal(gap)
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	data, err := json.Marshal(WSFrame{
+		ID:       0,
+		Type:     WSTypeSequenceGap,
+		Sender:   gap.Peer,
+		Receiver: client.UUID,
+		Data:     string(content),
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	if err := SafeWrite(client, websocket.TextMessage, data); err != nil {
+		log.Printf("failed to send sequence gap to %s: %v", client.UUID, err)
+	}
+}
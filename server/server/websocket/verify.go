@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"double-ratchet-server/config"
+	"double-ratchet-server/ratchet"
+	"double-ratchet-server/signature"
+)
+
+var (
+	ErrInvalidEnvelope = errors.New("invalid signature envelope")
+	ErrStaleEnvelope   = errors.New("signature envelope timestamp out of range")
+)
+
+// WSVerifyFailedData tells the sender which of its frames was rejected.
+type WSVerifyFailedData struct {
+	Type     string `json:"type"`
+	Receiver string `json:"receiver"`
+	Reason   string `json:"reason"`
+}
+
+// verifyEnvelope checks that the frame data is an envelope signed by the
+// registered identity key of the frame sender, for this frame type and
+// receiver, and recently enough.
+func (h *Hub) verifyEnvelope(frame WSFrame) (*ratchet.Envelope, error) {
+	var envelope ratchet.Envelope
+	if err := json.Unmarshal([]byte(frame.Data), &envelope); err != nil || envelope.Data == "" {
+		return nil, ErrInvalidEnvelope
+	}
+
+	skew := time.Since(time.UnixMilli(envelope.Timestamp))
+	if skew > config.ENVELOPE_CLOCK_SKEW || skew < -config.ENVELOPE_CLOCK_SKEW {
+		return nil, ErrStaleEnvelope
+	}
+
+	sender, err := h.store.FindUserByUUID(frame.Sender)
+	if err != nil {
+		return nil, err
+	}
+
+	identityKey, err := signature.ParseUserKey(sender.PublicKey, sender.KeyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ratchet.VerifyEnvelope(identityKey, frame.Type, frame.Sender, frame.Receiver, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// sendVerifyFailed keeps the verify_failed frame for clients that predate the
+// coded error frames, it is sent next to the error frame.
+func sendVerifyFailed(client *Client, frame WSFrame, reason string) {
+	content, err := json.Marshal(WSVerifyFailedData{
+		Type:     frame.Type,
+		Receiver: frame.Receiver,
+		Reason:   reason,
+	})
+	if err != nil {
+		log.Println("json marshal error:", err)
+		return
+	}
+
+	writeReply(client, frame, WSTypeVerifyFailed, content)
+}
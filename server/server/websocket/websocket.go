@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
-	"double-ratchet-server/utils"
+	"double-ratchet-server/database"
+	"double-ratchet-server/server/middleware"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -21,14 +24,66 @@ const (
 	WSTypeChangePublickey  = "change_publickey"
 	WSTypeUpdateUserlist   = "update_userlist"
 	WSTypeUpdateFriendlist = "update_friendlist"
+	WSTypeDeliveryStatus   = "delivery_status"
+	WSTypeGroupCreate      = "group_create"
+	WSTypeGroupInvite      = "group_invite"
+	WSTypeGroupRemove      = "group_remove"
+	WSTypeGroupUpdate      = "group_update"
+	WSTypeGroupMessage     = "group_text"
+	WSTypeGroupSenderKey   = "group_senderkey"
+	WSTypeUpdateGrouplist  = "update_grouplist"
+	WSTypeAttachment       = "attachment"
+	WSTypeGroupAttachment  = "group_attachment"
+	WSTypeKeyChanged       = "key_changed"
+	WSTypeKeychainConflict = "keychain_conflict"
+	WSTypeRetransmit       = "retransmit_request"
+	WSTypeSequenceGap      = "sequence_gap"
+	WSTypeVerifyFailed     = "verify_failed"
+	WSTypeError            = "error"
+	WSTypeResponse         = "response"
 )
 
+// Hub owns the live connections and the storage every frame handler uses.
+type Hub struct {
+	store      database.Store
+	outbox     *Outbox
+	router     *Router
+	clients    map[string]map[*Client]struct{}
+	clientsMux sync.RWMutex
+}
+
+func NewHub(store database.Store) *Hub {
+	hub := &Hub{
+		store:   store,
+		outbox:  newOutbox(),
+		router:  NewRouter(),
+		clients: make(map[string]map[*Client]struct{}),
+	}
+	hub.registerRoutes()
+	go hub.runOutbox()
+	go hub.runReaper()
+	return hub
+}
+
+// WSFrame.Sequence is only set on text frames, it counts the frames of one
+// sender to one receiver without gaps. RequestID is chosen by the client and
+// echoed in the error or response frame that answers the frame.
 type WSFrame struct {
-	ID       uint   `json:"id"`
-	Type     string `json:"type"`
-	Sender   string `json:"sender"`
-	Receiver string `json:"receiver"`
-	Data     string `json:"data"`
+	ID        uint   `json:"id"`
+	Type      string `json:"type"`
+	Sender    string `json:"sender"`
+	Receiver  string `json:"receiver"`
+	Data      string `json:"data"`
+	Sequence  uint64 `json:"seq,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// relay is the frame as forwarded to its receiver, it carries the id of the
+// stored message but not the request id of the sender.
+func (f WSFrame) relay(id uint) WSFrame {
+	f.ID = id
+	f.RequestID = ""
+	return f
 }
 
 // NOTE: 配置允许进行 WebSocket 连接的域
@@ -52,17 +107,31 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func HandleWebSocket(ctx *gin.Context) {
+func (h *Hub) HandleWebSocket(ctx *gin.Context) {
 	token := ctx.Query("token")
 
-	if !utils.ValidateJWT(token) {
+	claims, err := middleware.Authenticate(h.store, token)
+	if err != nil {
 		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			"message": "invalid or expired token",
 		})
 		return
 	}
 
-	claims, _ := utils.ParseJWT(token)
+	deviceID := ctx.DefaultQuery("device", DefaultDeviceID)
+	if deviceID == "" || len(deviceID) > maxDeviceIDLength {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "invalid device id",
+		})
+		return
+	}
+
+	if err := h.registerDevice(claims.UUID, deviceID); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "register device failed",
+		})
+		return
+	}
 
 	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
@@ -72,13 +141,22 @@ func HandleWebSocket(ctx *gin.Context) {
 		return
 	}
 
-	AddClient(claims.UUID, conn)
-	defer RemoveClient(claims.UUID)
+	client := h.AddClient(claims.UUID, deviceID, claims.SessionID, conn)
+	defer h.RemoveClient(client)
+
+	// NOTE: pong 由读循环处理，处理函数必须在读循环开始前设置
+	conn.SetPongHandler(func(string) error {
+		return client.touch(time.Now())
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go h.keepAlive(client, done)
 
 	// 建立连接后主动推送用户的信息
-	go pushUserList(claims.UUID)
-	go pushFriendList(claims.UUID)
-	go pushUndeliveredMessages(claims.UUID)
+	go h.pushUserList(client)
+	go h.pushFriendList(client)
+	go h.pushGroupList(client)
+	go h.pushUndeliveredMessages(client)
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -86,37 +164,15 @@ func HandleWebSocket(ctx *gin.Context) {
 			log.Println("socket read error: ", err)
 			break
 		}
+		client.touch(time.Now())
 
 		var frame WSFrame
 		if err := json.Unmarshal(message, &frame); err != nil {
 			log.Println("invalid message struct: ", err)
-			continue
-		} else if frame.Sender != claims.UUID && frame.Receiver != claims.UUID {
-			log.Printf("invalid message for [%s]\n", claims.UUID)
+			sendError(client, frame, ErrCodeMalformed, "invalid frame")
 			continue
 		}
 
-		switch frame.Type {
-		case WSTypeTextMessage:
-			handleTextMessage(frame)
-		case WSTypeEventConfirm:
-			handleEventConfirm(frame)
-		case WSTypeEventAddFriend:
-			handleEventAddFriend(frame)
-		case WSTypeEventDenyFriend:
-			handleEventDenyFriend(frame)
-		case WSTypeEventAllowFriend:
-			handleEventAllowFriend(frame)
-		case WSTypeChangeKeychain:
-			handleChangeKeychain(frame)
-		case WSTypeChangePublickey:
-			handleChangePublickey(frame)
-		case WSTypeUpdateUserlist:
-			pushUserList(claims.UUID)
-		case WSTypeUpdateFriendlist:
-			pushFriendList(claims.UUID)
-		default:
-			log.Printf("[%s] - unknown message type: %s\n", frame.Sender, frame.Type)
-		}
+		h.router.Dispatch(client, frame)
 	}
 }
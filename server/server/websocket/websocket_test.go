@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"double-ratchet-server/database"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub returns a hub without the outbox and reaper goroutines, tests
+// drive the parts they need themselves.
+func newTestHub(t *testing.T) (*Hub, database.Store) {
+	t.Helper()
+
+	store := database.NewMemoryStore()
+	hub := &Hub{
+		store:   store,
+		outbox:  newOutbox(),
+		router:  NewRouter(),
+		clients: make(map[string]map[*Client]struct{}),
+	}
+	hub.registerRoutes()
+	return hub, store
+}
+
+// newTestClient connects a client over a real websocket and returns it with
+// the peer end. The writer of the client is not started.
+func newTestClient(t *testing.T, userUUID string) (*Client, *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	conn := <-conns
+	client := &Client{UUID: userUUID, DeviceID: DefaultDeviceID, Conn: conn, queue: newSendQueue()}
+	t.Cleanup(func() {
+		conn.Close()
+		client.queue.close()
+	})
+	return client, peer
+}
+
+// readFrame reads frames from the peer until one of frameType arrives.
+func readFrame(t *testing.T, peer *websocket.Conn, frameType string) WSFrame {
+	t.Helper()
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, message, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s frame: %v", frameType, err)
+		}
+
+		var frame WSFrame
+		if err := json.Unmarshal(message, &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+// eventually polls condition until it holds or a second passed.
+func eventually(t *testing.T, condition func() bool) bool {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// queuedFrames decodes the frames waiting in the queue of a client whose
+// writer is not running.
+func queuedFrames(t *testing.T, client *Client) []WSFrame {
+	t.Helper()
+
+	client.queue.mutex.Lock()
+	defer client.queue.mutex.Unlock()
+
+	frames := []WSFrame{}
+	for _, queued := range client.queue.frames {
+		var frame WSFrame
+		if err := json.Unmarshal(queued.data, &frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// frameData decodes the data of the only queued frame of frameType.
+func frameData[T any](t *testing.T, client *Client, frameType string) T {
+	t.Helper()
+
+	var content T
+	found := 0
+	for _, frame := range queuedFrames(t, client) {
+		if frame.Type != frameType {
+			continue
+		}
+		found++
+		if err := json.Unmarshal([]byte(frame.Data), &content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found != 1 {
+		t.Fatalf("%d queued %s frames, want 1", found, frameType)
+	}
+	return content
+}
@@ -0,0 +1,53 @@
+package signature
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+)
+
+// Fingerprint is the hex sha256 of the SPKI encoding of the key, it names a
+// key in the identity key history.
+func (k *PublicKey) Fingerprint() string {
+	digest := sha256.Sum256(k.der)
+	return hex.EncodeToString(digest[:])
+}
+
+// displayableFingerprint iterates sha512 over the key and the owner's uuid
+// and renders the first 30 bytes as six 5-digit groups, as Signal does.
+func displayableFingerprint(uuid string, key *PublicKey) string {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, fingerprintVersion)
+
+	hash := append(append(version, key.der...), uuid...)
+	for range fingerprintIterations {
+		digest := sha512.Sum512(append(hash, key.der...))
+		hash = digest[:]
+	}
+
+	groups := make([]string, 0, 6)
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(hash[i])<<32 | uint64(hash[i+1])<<24 | uint64(hash[i+2])<<16 | uint64(hash[i+3])<<8 | uint64(hash[i+4])
+		groups = append(groups, fmt.Sprintf("%05d", chunk%100000))
+	}
+	return strings.Join(groups, "")
+}
+
+// SafetyNumber combines the fingerprints of both sides of a conversation into
+// 60 digits. The halves are ordered, so both friends see the same number.
+func SafetyNumber(localUUID string, localKey *PublicKey, remoteUUID string, remoteKey *PublicKey) string {
+	local := displayableFingerprint(localUUID, localKey)
+	remote := displayableFingerprint(remoteUUID, remoteKey)
+	if local > remote {
+		local, remote = remote, local
+	}
+	return local + remote
+}
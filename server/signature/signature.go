@@ -0,0 +1,123 @@
+// Package signature verifies signatures made with a user's identity key.
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+const (
+	AlgorithmP256    = "ecdsa-p256"
+	AlgorithmP384    = "ecdsa-p384"
+	AlgorithmP521    = "ecdsa-p521"
+	AlgorithmEd25519 = "ed25519"
+)
+
+var (
+	ErrPubkeyEncoding    = errors.New("incorrect encoding method for pubkey")
+	ErrPubkeyFormat      = errors.New("invalid pubkey format")
+	ErrPubkeyParse       = errors.New("failed to parse pubkey")
+	ErrUnsupportedKey    = errors.New("unsupported identity key algorithm")
+	ErrAlgorithmMismatch = errors.New("identity key does not match its recorded algorithm")
+)
+
+// PublicKey is an identity key together with the algorithm it was parsed as.
+type PublicKey struct {
+	Algorithm string
+	key       crypto.PublicKey
+	der       []byte
+}
+
+// FromPublicKey wraps an ECDSA key on a supported curve or an Ed25519 key.
+func FromPublicKey(key crypto.PublicKey) (*PublicKey, error) {
+	var algorithm string
+	switch public := key.(type) {
+	case *ecdsa.PublicKey:
+		switch public.Curve.Params().Name {
+		case "P-256":
+			algorithm = AlgorithmP256
+		case "P-384":
+			algorithm = AlgorithmP384
+		case "P-521":
+			algorithm = AlgorithmP521
+		default:
+			return nil, ErrUnsupportedKey
+		}
+	case ed25519.PublicKey:
+		algorithm = AlgorithmEd25519
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, ErrPubkeyParse
+	}
+	return &PublicKey{Algorithm: algorithm, key: key, der: der}, nil
+}
+
+// ParsePublicKey decodes a User.PublicKey (base64 over a SPKI PEM document)
+// and detects its algorithm.
+func ParsePublicKey(encoded string) (*PublicKey, error) {
+	pubBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrPubkeyEncoding
+	}
+
+	block, _ := pem.Decode(pubBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrPubkeyFormat
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrPubkeyParse
+	}
+	return FromPublicKey(key)
+}
+
+// ParseUserKey parses a stored identity key and checks it against the
+// algorithm recorded for the user. Users registered before the algorithm was
+// recorded have it empty, their key is accepted as detected.
+func ParseUserKey(encoded, algorithm string) (*PublicKey, error) {
+	key, err := ParsePublicKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm != "" && algorithm != key.Algorithm {
+		return nil, ErrAlgorithmMismatch
+	}
+	return key, nil
+}
+
+// Verify checks a signature over message. ECDSA signatures are made over
+// SHA-256(message) as WebCrypto does, encoded either as the fixed-width r||s
+// of IEEE P1363 or as ASN.1 DER. Ed25519 signs the message itself.
+func (k *PublicKey) Verify(message, sig []byte) bool {
+	switch public := k.key.(type) {
+	case ed25519.PublicKey:
+		return len(sig) == ed25519.SignatureSize && ed25519.Verify(public, message, sig)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(message)
+
+		// NOTE: 长度符合 P1363 时先按 r||s 校验，失败再按 DER 解析
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(public, hash[:], r, s) {
+				return true
+			}
+		}
+		return ecdsa.VerifyASN1(public, hash[:], sig)
+	default:
+		return false
+	}
+}
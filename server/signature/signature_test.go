@@ -0,0 +1,144 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// encodeKey encodes a public key the way User.PublicKey stores it.
+func encodeKey(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// toP1363 converts an ASN.1 DER signature to the fixed-width r||s WebCrypto
+// produces.
+func toP1363(t *testing.T, der []byte, size int) []byte {
+	t.Helper()
+
+	var inner cryptobyte.String
+	var r, s []byte
+	input := cryptobyte.String(der)
+	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
+		!inner.ReadASN1Integer(&r) ||
+		!inner.ReadASN1Integer(&s) {
+		t.Fatal("malformed DER signature")
+	}
+
+	sig := make([]byte, 2*size)
+	copy(sig[size-len(r):size], r)
+	copy(sig[2*size-len(s):], s)
+	return sig
+}
+
+func TestVerifyECDSARoundTrip(t *testing.T) {
+	tests := []struct {
+		curve     elliptic.Curve
+		algorithm string
+	}{
+		{elliptic.P256(), AlgorithmP256},
+		{elliptic.P384(), AlgorithmP384},
+		{elliptic.P521(), AlgorithmP521},
+	}
+	message := []byte("alice:nonce:1700000000000")
+
+	for _, test := range tests {
+		t.Run(test.algorithm, func(t *testing.T) {
+			private, err := ecdsa.GenerateKey(test.curve, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := ParsePublicKey(encodeKey(t, &private.PublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Algorithm != test.algorithm {
+				t.Fatalf("algorithm = %s, want %s", key.Algorithm, test.algorithm)
+			}
+
+			size := (test.curve.Params().BitSize + 7) / 8
+			// several signatures, so an r or s with leading zero bytes is padded too
+			for range 16 {
+				hash := sha256.Sum256(message)
+				der, err := ecdsa.SignASN1(rand.Reader, private, hash[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				p1363 := toP1363(t, der, size)
+
+				if !key.Verify(message, der) {
+					t.Fatal("DER signature rejected")
+				}
+				if !key.Verify(message, p1363) {
+					t.Fatal("P1363 signature rejected")
+				}
+				if key.Verify([]byte("tampered"), der) || key.Verify([]byte("tampered"), p1363) {
+					t.Fatal("signature accepted for another message")
+				}
+				if key.Verify(message, p1363[1:]) || key.Verify(message, der[:len(der)-1]) {
+					t.Fatal("truncated signature accepted")
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyEd25519RoundTrip(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePublicKey(encodeKey(t, public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Algorithm != AlgorithmEd25519 {
+		t.Fatalf("algorithm = %s, want %s", key.Algorithm, AlgorithmEd25519)
+	}
+
+	message := []byte("alice:nonce:1700000000000")
+	sig := ed25519.Sign(private, message)
+	if !key.Verify(message, sig) {
+		t.Fatal("signature rejected")
+	}
+	if key.Verify([]byte("tampered"), sig) || key.Verify(message, sig[1:]) {
+		t.Fatal("invalid signature accepted")
+	}
+}
+
+func TestParseUserKeyAlgorithm(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := encodeKey(t, &private.PublicKey)
+
+	for _, algorithm := range []string{"", AlgorithmP256} {
+		if _, err := ParseUserKey(encoded, algorithm); err != nil {
+			t.Errorf("ParseUserKey(%q) = %v", algorithm, err)
+		}
+	}
+	if _, err := ParseUserKey(encoded, AlgorithmEd25519); !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Errorf("ParseUserKey with another algorithm = %v, want ErrAlgorithmMismatch", err)
+	}
+	if _, err := ParsePublicKey("not base64!"); !errors.Is(err, ErrPubkeyEncoding) {
+		t.Errorf("ParsePublicKey of bad base64 = %v, want ErrPubkeyEncoding", err)
+	}
+}
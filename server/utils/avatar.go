@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// NOTE: 头像统一输出为以下几种正方形尺寸，第一个为默认尺寸
+var AvatarSizes = []int{256, 128, 64}
+
+const maxAvatarPixels = 4096 * 4096
+
+var (
+	ErrAvatarFormat    = errors.New("unsupported avatar format")
+	ErrAvatarDimension = errors.New("invalid avatar dimension")
+)
+
+var avatarDecoders = map[string]func(*bytes.Reader) (image.Image, error){
+	"image/png":  func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) },
+	"image/jpeg": func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) },
+	"image/gif":  func(r *bytes.Reader) (image.Image, error) { return gif.Decode(r) },
+}
+
+var avatarConfigs = map[string]func(*bytes.Reader) (image.Config, error){
+	"image/png":  func(r *bytes.Reader) (image.Config, error) { return png.DecodeConfig(r) },
+	"image/jpeg": func(r *bytes.Reader) (image.Config, error) { return jpeg.DecodeConfig(r) },
+	"image/gif":  func(r *bytes.Reader) (image.Config, error) { return gif.DecodeConfig(r) },
+}
+
+// ProcessAvatar sniffs and decodes the upload, crops it to a centered square
+// and re-encodes it as PNG for every size in AvatarSizes. Re-encoding drops
+// EXIF and every other metadata chunk of the original file.
+func ProcessAvatar(data []byte) (map[int][]byte, error) {
+	mimeType := http.DetectContentType(data)
+	decode, ok := avatarDecoders[mimeType]
+	if !ok {
+		return nil, ErrAvatarFormat
+	}
+
+	// 先读取尺寸，避免解码超大图片耗尽内存
+	cfg, err := avatarConfigs[mimeType](bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	} else if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, ErrAvatarDimension
+	}
+
+	src, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	}
+
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	))
+
+	outputs := make(map[int][]byte, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+		outputs[size] = buf.Bytes()
+	}
+	return outputs, nil
+}
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"time"
 
 	"double-ratchet-server/config"
@@ -8,38 +12,62 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-type claims struct {
+// Claims of an access token, SessionID ties it to a revocable Session row.
+type Claims struct {
 	jwt.RegisteredClaims
-	UUID     string `json:"uuid"`
-	Username string `json:"username"`
+	UUID      string `json:"uuid"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
 }
 
-func GenerateJWT(uuid, username string, remember bool) (string, error) {
-	var expirationTime time.Duration
-	if remember {
-		expirationTime = 7 * 24 * time.Hour
-	} else {
-		expirationTime = 24 * time.Hour
+var signingKeys *KeySet
+
+// LoadKeySet loads the signing keys configured in config, it has to run
+// before any token is generated or parsed.
+func LoadKeySet() (*KeySet, error) {
+	ks, err := NewKeySet(config.JWT_ALGORITHM, config.JWT_KEYSET_PATH)
+	if err != nil {
+		return nil, err
+	}
+	signingKeys = ks
+	return ks, nil
+}
+
+// PublicKeys returns the verification keys of the loaded keyset.
+func PublicKeys() []JWK {
+	if signingKeys == nil {
+		return []JWK{}
+	}
+	return signingKeys.JWKS()
+}
+
+func GenerateJWT(uuid, username, sessionID string) (string, error) {
+	if signingKeys == nil {
+		return "", ErrKeySetNotLoaded
 	}
 
-	claims := &claims{
-		UUID:     uuid,
-		Username: username,
+	claims := &Claims{
+		UUID:      uuid,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expirationTime)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(config.ACCESS_TOKEN_TTL)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.JWT_SERRET))
+	return signingKeys.Sign(claims)
 }
 
-func ParseJWT(tokenStr string) (*claims, error) {
-	claims := &claims{}
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (any, error) {
-		return []byte(config.JWT_SERRET), nil
-	})
+func ParseJWT(tokenStr string) (*Claims, error) {
+	if signingKeys == nil {
+		return nil, ErrKeySetNotLoaded
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, signingKeys.Keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodES256.Alg()}),
+	)
 
 	if err != nil || !token.Valid {
 		return nil, err
@@ -56,3 +84,17 @@ func ValidateJWT(tokenStr string) bool {
 	return true
 
 }
+
+// GenerateRefreshToken returns an opaque random token, only its hash is stored.
+func GenerateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func HashRefreshToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unsupported jwt signing algorithm")
+	ErrUnknownKeyID     = errors.New("unknown jwt key id")
+	ErrKeySetFormat     = errors.New("invalid jwt keyset file")
+	ErrKeySetNotLoaded  = errors.New("jwt keyset is not loaded")
+)
+
+// NOTE: 曾随仓库泄露的签名密钥，加载到这些密钥时直接丢弃并生成新密钥，用它们签发的令牌全部失效
+var compromisedKeyIDs = map[string]bool{
+	"opLXSg5O2prEa_wLZ_yrIiILnGIQCfxRl6Ys7MgSVM4": true,
+}
+
+// SigningKey is one asymmetric key of the keyset, ID is its RFC 7638
+// thumbprint and goes into the `kid` header of every token it signs.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	var private crypto.Signer
+	switch algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	case jwt.SigningMethodES256.Alg():
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+
+	key := &SigningKey{Algorithm: algorithm, Private: private, CreatedAt: time.Now()}
+	jwk, err := key.JWK()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+	return key, nil
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// JWK is the public part of a signing key as published in jwks.json.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func (k *SigningKey) JWK() (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := k.Private.Public().(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: encode(public), Kid: k.ID, Use: "sig", Alg: k.Algorithm}, nil
+	case *ecdsa.PublicKey:
+		ecdh, err := public.ECDH()
+		if err != nil {
+			return JWK{}, err
+		}
+		// 未压缩格式为 0x04 || X || Y
+		point := ecdh.Bytes()[1:]
+		size := len(point) / 2
+		return JWK{Kty: "EC", Crv: "P-256", X: encode(point[:size]), Y: encode(point[size:]), Kid: k.ID, Use: "sig", Alg: k.Algorithm}, nil
+	default:
+		return JWK{}, ErrUnknownAlgorithm
+	}
+}
+
+// thumbprint hashes the required members in lexicographic order (RFC 7638).
+func (j JWK) thumbprint() string {
+	var canonical string
+	if j.Kty == "EC" {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, j.Crv, j.Kty, j.X, j.Y)
+	} else {
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, j.Crv, j.Kty, j.X)
+	}
+	digest := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// KeySet holds the current signing key and the previous one, so tokens signed
+// right before a rotation keep verifying until they expire.
+type KeySet struct {
+	mutex     sync.RWMutex
+	path      string
+	algorithm string
+	current   *SigningKey
+	previous  *SigningKey
+}
+
+type storedSigningKey struct {
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Private   string `json:"private_key"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// NewKeySet loads the keyset from path, or generates a fresh one. An empty
+// path keeps the keys in memory only.
+func NewKeySet(algorithm, path string) (*KeySet, error) {
+	ks := &KeySet{path: path, algorithm: algorithm}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	if ks.current == nil || ks.current.Algorithm != algorithm {
+		if err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) load() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var stored []storedSigningKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ErrKeySetFormat
+	}
+
+	keys := []*SigningKey{}
+	dropped := false
+	for _, item := range stored {
+		block, _ := pem.Decode([]byte(item.Private))
+		if block == nil {
+			return ErrKeySetFormat
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return ErrUnknownAlgorithm
+		}
+		key := &SigningKey{
+			Algorithm: item.Algorithm,
+			Private:   signer,
+			CreatedAt: time.UnixMilli(item.CreatedAt),
+		}
+		jwk, err := key.JWK()
+		if err != nil {
+			return err
+		}
+		// 以公钥重新计算 kid，不信任文件中保存的值
+		key.ID = jwk.thumbprint()
+		if compromisedKeyIDs[key.ID] {
+			log.Printf("dropped compromised jwt signing key %s\n", key.ID)
+			dropped = true
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) > 0 {
+		ks.current = keys[0]
+	}
+	if len(keys) > 1 {
+		ks.previous = keys[1]
+	}
+	if dropped {
+		return ks.save()
+	}
+	return nil
+}
+
+func (ks *KeySet) save() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	stored := []storedSigningKey{}
+	for _, key := range []*SigningKey{ks.current, ks.previous} {
+		if key == nil {
+			continue
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, storedSigningKey{
+			ID:        key.ID,
+			Algorithm: key.Algorithm,
+			Private:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			CreatedAt: key.CreatedAt.UnixMilli(),
+		})
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0o700); err != nil {
+		return err
+	}
+	temp := ks.path + ".tmp"
+	if err := os.WriteFile(temp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temp, ks.path)
+}
+
+// Rotate makes a fresh key current and keeps the old current as previous.
+func (ks *KeySet) Rotate() error {
+	key, err := generateSigningKey(ks.algorithm)
+	if err != nil {
+		return err
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	ks.previous, ks.current = ks.current, key
+	return ks.save()
+}
+
+// RunRotation rotates the keyset whenever the current key is older than
+// interval. The interval has to be longer than the access token lifetime.
+func (ks *KeySet) RunRotation(interval time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		ks.mutex.RLock()
+		due := now.Sub(ks.current.CreatedAt) >= interval
+		ks.mutex.RUnlock()
+
+		if !due {
+			continue
+		}
+		if err := ks.Rotate(); err != nil {
+			log.Println("failed to rotate jwt signing key:", err)
+			continue
+		}
+		log.Println("jwt signing key rotated")
+	}
+}
+
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mutex.RLock()
+	key := ks.current
+	ks.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc resolves the verification key from the `kid` header.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, key := range []*SigningKey{ks.current, ks.previous} {
+		if key != nil && key.ID == kid {
+			if token.Method.Alg() != key.Algorithm {
+				return nil, ErrUnknownAlgorithm
+			}
+			return key.Private.Public(), nil
+		}
+	}
+	return nil, ErrUnknownKeyID
+}
+
+// JWKS returns the public keys of the keyset for /.well-known/jwks.json.
+func (ks *KeySet) JWKS() []JWK {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	keys := []JWK{}
+	for _, key := range []*SigningKey{ks.current, ks.previous} {
+		if key == nil {
+			continue
+		}
+		if jwk, err := key.JWK(); err == nil {
+			keys = append(keys, jwk)
+		}
+	}
+	return keys
+}
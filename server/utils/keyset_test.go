@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNewKeySetDropsCompromisedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	leaked, err := NewKeySet(jwt.SigningMethodEdDSA.Alg(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leakedID := leaked.current.ID
+
+	compromisedKeyIDs[leakedID] = true
+	defer delete(compromisedKeyIDs, leakedID)
+
+	ks, err := NewKeySet(jwt.SigningMethodEdDSA.Alg(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, jwk := range ks.JWKS() {
+		if jwk.Kid == leakedID {
+			t.Fatalf("compromised key %s is still published", leakedID)
+		}
+	}
+
+	token, err := leaked.Sign(jwt.RegisteredClaims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(token, ks.Keyfunc); err == nil {
+		t.Fatal("token signed with the compromised key still verifies")
+	}
+
+	reloaded, err := NewKeySet(jwt.SigningMethodEdDSA.Alg(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.current.ID != ks.current.ID {
+		t.Fatalf("rotated key was not saved: got %s, want %s", reloaded.current.ID, ks.current.ID)
+	}
+}
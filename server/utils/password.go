@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"double-ratchet-server/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+var ErrPasswordHashFormat = errors.New("invalid password hash format")
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func currentArgon2Params() argon2Params {
+	return argon2Params{
+		memory:  uint32(config.PASSWORD_ARGON2_MEMORY),
+		time:    uint32(config.PASSWORD_ARGON2_TIME),
+		threads: uint8(config.PASSWORD_ARGON2_THREADS),
+	}
+}
+
+// HashPassword hashes the password with the algorithm and cost selected in
+// config, the result is self-describing so the policy can change later.
+func HashPassword(password string) (string, error) {
+	if config.PASSWORD_ALGORITHM == "bcrypt" {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), config.PASSWORD_BCRYPT_COST)
+		return string(hashed), err
+	}
+
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	params := currentArgon2Params()
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeySize)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword checks the password against a stored hash in constant time.
+// needsRehash reports that the hash is legacy plaintext or was produced with
+// a policy other than the current one.
+func VerifyPassword(encoded, password string) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false
+		}
+		derived := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(derived, key) != 1 {
+			return false, false
+		}
+		return true, config.PASSWORD_ALGORITHM == "bcrypt" || params != currentArgon2Params()
+	case isBcryptHash(encoded):
+		if bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) != nil {
+			return false, false
+		}
+		cost, _ := bcrypt.Cost([]byte(encoded))
+		return true, config.PASSWORD_ALGORITHM != "bcrypt" || cost != config.PASSWORD_BCRYPT_COST
+	default:
+		// NOTE: 旧版本直接保存明文，校验通过后需要立即重新哈希
+		if subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrPasswordHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrPasswordHashFormat
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, ErrPasswordHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrPasswordHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrPasswordHashFormat
+	}
+
+	return params, salt, key, nil
+}